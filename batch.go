@@ -6,8 +6,8 @@ package main
 import (
     "fmt"
     "sync"
-    "time"
     "context"
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
     "github.com/arslanm/kafka-timescaledb-adapter/log"
 )
 
@@ -17,7 +17,7 @@ var wg sync.WaitGroup
 // Creates a struct that will hold a number of metrics. A work request
 // is created by the routine that consumes messages from Kafka. 
 type WorkRequest struct {
-    Metrics     []string
+    Metrics     []format.Message
     NumMetrics  int
 }
 
@@ -25,20 +25,22 @@ type WorkRequest struct {
 // consumer to the worker routines. 
 var WorkQueue = make(chan WorkRequest)
 
-// Once a worker routine receives a work request it will run the 
-// handler function in order to process the request. Each worker
-// routine runs the handler function within a context to limit 
-// handler's time processing the request.
-type Handler func(context.Context, int, int, []string, int) (error)
+// Once a worker routine receives a work request it decodes the
+// metrics once and runs the handler function with the samples. The
+// handler is responsible for the time limits and retries of the
+// targets it writes to.
+type Handler func(context.Context, int, []format.Sample) (error)
+
+// Decodes the metrics of a work request into samples
+type Decode func([]format.Message, int) []format.Sample
 
 // Creates a new worker 
-func NewWorker(id int, handler Handler, timeout time.Duration, retry int, workerQueue chan chan WorkRequest) Worker {
+func NewWorker(id int, handler Handler, decode Decode, workerQueue chan chan WorkRequest) Worker {
     worker := Worker{
         ID          : id,
         Work        : make(chan WorkRequest),
         Execute     : handler,
-        Timeout     : timeout,
-        Retry       : retry,
+        Decode      : decode,
         WorkerQueue : workerQueue,
         QuitChan    : make(chan bool),
     }
@@ -50,38 +52,23 @@ type Worker struct {
     ID          int
     Work        chan WorkRequest
     Execute     Handler
-    Timeout     time.Duration
-    Retry       int
+    Decode      Decode
     WorkerQueue chan chan WorkRequest
     QuitChan    chan bool
 }
 
 // Worker routines call ProcessWork to process a work request.
-// ProcessWork first creates a context to set a deadline on the 
-// request that will be made to the database, then runs the 
-// handler function within a routine. If the function does
-// return before the deadline the context will be cancelled.
-func (w *Worker) ProcessWork(work WorkRequest, attempt int) bool {
-    ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
-    defer cancel()
-
-    done := make(chan bool, 1)
-    go func(ctx context.Context, id int, work WorkRequest, ok chan bool) {
-        err := w.Execute(ctx, id, attempt, work.Metrics, work.NumMetrics)
-        if err != nil {
-            ok <- false
-        } else {
-            ok <- true
-        }
-    }(ctx, w.ID, work, done)
-
-    select {
-        case rc := <-done:
-            return rc
-        case <-ctx.Done():
-            log.Info("msg", "Unable to submit metrics", "timeout", w.Timeout, "error", ctx.Err())
-            return false
+// ProcessWork decodes the metrics and runs the handler function with
+// the samples.
+func (w *Worker) ProcessWork(work WorkRequest) bool {
+    samples := w.Decode(work.Metrics, work.NumMetrics)
+
+    err := w.Execute(context.Background(), w.ID, samples)
+    if err != nil {
+        log.Info("msg", "Unable to submit metrics", "error", err)
+        return false
     }
+    return true
 }
 
 // Each worker routine first adds itself to the queue of available workers
@@ -94,12 +81,7 @@ func (w *Worker) Run() {
             w.WorkerQueue <- w.Work
             select {
             case work := <-w.Work:
-                for attempt := 1 ; attempt <= w.Retry ; attempt++ {
-                    rc := w.ProcessWork(work, attempt)
-                    if rc == true {
-                        break
-                    }
-                }
+                w.ProcessWork(work)
             case <-w.QuitChan:
                 log.Debug("msg", fmt.Sprintf("Worker #%d is stopping", w.ID))
                 return
@@ -136,12 +118,12 @@ var QuitChan chan bool
 // Foreman first creates a WorkerQueue, runs worker routines and 
 // waits for a work request. When a request is received it runs
 // a routine that assigns the request to the next available worker.
-func Foreman(handler Handler, timeout time.Duration, retry int, workerCnt int) {
+func Foreman(handler Handler, decode Decode, workerCnt int) {
     WorkerQueue = make(chan chan WorkRequest, workerCnt)
   
     WorkerList := make([]Worker, 0)
     for i := 1; i <= workerCnt; i++ {
-        worker := NewWorker(i, handler, timeout, retry, WorkerQueue) 
+        worker := NewWorker(i, handler, decode, WorkerQueue) 
         worker.Run()
         WorkerList = append(WorkerList, worker)
         log.Info("msg", fmt.Sprintf("Running Worker #%d", i))
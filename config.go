@@ -1,9 +1,8 @@
 package main
 
 import (
-    "time"
-
     "github.com/arslanm/kafka-timescaledb-adapter/db"
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
     "github.com/arslanm/kafka-timescaledb-adapter/kafka"
 
     "github.com/arslanm/kafka-timescaledb-adapter/util"
@@ -13,11 +12,10 @@ type Config struct {
     listenAddr      string
     telemetryPath   string
     pgKafkaConfig   pgkafka.Config
-    pgDBConfig      pgdb.Config
+    pgDBConfig      pgdb.TargetsConfig
+    formatConfig    format.Config
     logLevel        string
     batchSize       int
-    writeTimeout    time.Duration
-    writeRetry      int
     whitelistFile   string
 }
 
@@ -26,8 +24,6 @@ var (
     DEFAULT_TELEMETRY_PATH = "/metrics"
     DEFAULT_LOG_LEVEL      = "info"
     DEFAULT_BATCH_SIZE     = 10000
-    DEFAULT_WRITE_TIMEOUT  = "30s"
-    DEFAULT_WRITE_RETRY    = 3
 
     DEFAULT_WHITELIST_FILE = "/etc/prometheus/kafka-timescaledb-adapter.whitelist.regex"
 )
@@ -39,12 +35,11 @@ func GetConfig() *Config {
     cfg.telemetryPath = util.GetEnvWithDefault("TELEMETRY_PATH", DEFAULT_TELEMETRY_PATH)
     cfg.batchSize = util.GetEnvWithDefaultInt("BATCH_SIZE", DEFAULT_BATCH_SIZE)
     cfg.logLevel = util.GetEnvWithDefault("LOG_LEVEL", DEFAULT_LOG_LEVEL)
-    cfg.writeTimeout = util.GetEnvWithDefaultDuration("WRITE_TIMEOUT", DEFAULT_WRITE_TIMEOUT)
-    cfg.writeRetry = util.GetEnvWithDefaultInt("WRITE_RETRY", DEFAULT_WRITE_RETRY)
     cfg.whitelistFile = util.GetEnvWithDefault("WHITELIST_FILE", DEFAULT_WHITELIST_FILE)
    
     pgkafka.GetConfig(&cfg.pgKafkaConfig)
-    pgdb.GetConfig(&cfg.pgDBConfig)
+    pgdb.GetTargetsConfig(&cfg.pgDBConfig)
+    format.GetConfig(&cfg.formatConfig)
 
     return cfg
 }
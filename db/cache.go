@@ -0,0 +1,105 @@
+package pgdb
+
+import (
+    "sync"
+    "container/list"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+    seriesCacheHits = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace : "kafka_timescale_adapter",
+            Name      : "series_cache_hits_total",
+            Help      : "Total number of samples whose series id was found in the cache.",
+        },
+        []string{"remote"},
+    )
+
+    seriesCacheMisses = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace : "kafka_timescale_adapter",
+            Name      : "series_cache_misses_total",
+            Help      : "Total number of samples whose series id had to be looked up in the database.",
+        },
+        []string{"remote"},
+    )
+
+    seriesCacheSize = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace : "kafka_timescale_adapter",
+            Name      : "series_cache_size",
+            Help      : "Number of series ids in the cache.",
+        },
+        []string{"remote"},
+    )
+)
+
+// seriesCache is an LRU cache of the ids of series, keyed by metric
+// name and labels. A nil cache caches nothing.
+type seriesCache struct {
+    mtx       sync.Mutex
+    capacity  int
+    remote    string
+    entries   map[string]*list.Element
+    order     *list.List
+}
+
+type seriesEntry struct {
+    key  string
+    id   int64
+}
+
+func newSeriesCache(capacity int, remote string) *seriesCache {
+    return &seriesCache{
+        capacity : capacity,
+        remote   : remote,
+        entries  : make(map[string]*list.Element),
+        order    : list.New(),
+    }
+}
+
+// The key of a series is its name and its labels as staged
+func seriesKey(name string, labels []byte) string {
+    return name + "\x00" + string(labels)
+}
+
+func (c *seriesCache) get(key string) (int64, bool) {
+    if c == nil {
+        return 0, false
+    }
+
+    c.mtx.Lock()
+    defer c.mtx.Unlock()
+
+    e, ok := c.entries[key]
+    if !ok {
+        return 0, false
+    }
+    c.order.MoveToFront(e)
+    return e.Value.(*seriesEntry).id, true
+}
+
+func (c *seriesCache) put(key string, id int64) {
+    if c == nil {
+        return
+    }
+
+    c.mtx.Lock()
+    defer c.mtx.Unlock()
+
+    if e, ok := c.entries[key]; ok {
+        e.Value.(*seriesEntry).id = id
+        c.order.MoveToFront(e)
+        return
+    }
+
+    c.entries[key] = c.order.PushFront(&seriesEntry{key: key, id: id})
+    for c.order.Len() > c.capacity {
+        e := c.order.Back()
+        c.order.Remove(e)
+        delete(c.entries, e.Value.(*seriesEntry).key)
+    }
+    seriesCacheSize.WithLabelValues(c.remote).Set(float64(c.order.Len()))
+}
@@ -0,0 +1,148 @@
+package pgdb
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+    "time"
+    "context"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+)
+
+// The keys of a cache, most recently used first
+func cacheKeys(c *seriesCache) []string {
+    var keys []string
+    for e := c.order.Front(); e != nil; e = e.Next() {
+        keys = append(keys, e.Value.(*seriesEntry).key)
+    }
+    return keys
+}
+
+func TestSeriesCache(t *testing.T) {
+    tests := []struct {
+        name  string
+        ops   func(c *seriesCache)
+        want  string
+    }{
+        {"below capacity", func(c *seriesCache) {
+            c.put("a", 1)
+            c.put("b", 2)
+        }, "b a"},
+        {"least recently put evicted", func(c *seriesCache) {
+            c.put("a", 1)
+            c.put("b", 2)
+            c.put("c", 3)
+            c.put("d", 4)
+        }, "d c b"},
+        {"get keeps an entry", func(c *seriesCache) {
+            c.put("a", 1)
+            c.put("b", 2)
+            c.put("c", 3)
+            c.get("a")
+            c.put("d", 4)
+        }, "d a c"},
+        {"put of a cached key", func(c *seriesCache) {
+            c.put("a", 1)
+            c.put("b", 2)
+            c.put("c", 3)
+            c.put("a", 5)
+            c.put("d", 4)
+        }, "d a c"},
+        {"get of a missing key", func(c *seriesCache) {
+            c.put("a", 1)
+            c.get("b")
+        }, "a"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            c := newSeriesCache(3, "test")
+            tt.ops(c)
+
+            if got := strings.Join(cacheKeys(c), " "); got != tt.want {
+                t.Errorf("got keys %q, want %q", got, tt.want)
+            }
+            if len(c.entries) != c.order.Len() {
+                t.Errorf("got %d entries for %d keys", len(c.entries), c.order.Len())
+            }
+        })
+    }
+}
+
+func TestSeriesCacheIds(t *testing.T) {
+    c := newSeriesCache(2, "test")
+    c.put("a", 1)
+    c.put("b", 2)
+    c.put("a", 3)
+
+    if id, ok := c.get("a"); !ok || id != 3 {
+        t.Errorf("got %d, %v for a, want 3", id, ok)
+    }
+    if _, ok := c.get("c"); ok {
+        t.Error("expected c not to be cached")
+    }
+}
+
+func TestSeriesCacheNil(t *testing.T) {
+    var c *seriesCache
+    c.put("a", 1)
+    if _, ok := c.get("a"); ok {
+        t.Error("expected a nil cache to cache nothing")
+    }
+}
+
+func TestSeriesCacheCommitted(t *testing.T) {
+    next := 0
+    queries := &fakeLog{answer: func(query string, args []string) ([]string, [][]string) {
+        if !strings.Contains(query, "_series (metric_name, labels)") {
+            return nil, nil
+        }
+        if len(args) == 0 {
+            return []string{"id"}, nil
+        }
+        next++
+        return []string{"id"}, [][]string{{fmt.Sprint(next)}}
+    }}
+
+    c := newFakeClient(t, "test", nil, queries)
+    c.cfg.table = "metrics"
+    c.copier = &pqCopier{}
+    c.cache = newSeriesCache(10, "test")
+    c.schema = newPlainSchema(c)
+
+    samples := []format.Sample{
+        {Name: "up", Labels: map[string]string{"job": "a"}, Value: 1, Timestamp: time.Unix(1600000000, 0)},
+        {Name: "up", Labels: map[string]string{"job": "b"}, Value: 1, Timestamp: time.Unix(1600000000, 0)},
+    }
+
+    // Series inserted by a transaction that doesn't commit aren't cached
+    queries.mtx.Lock()
+    queries.fail = "COMMIT"
+    queries.mtx.Unlock()
+    if err := c.insertBatch(context.Background(), samples); err == nil {
+        t.Fatal("expected an error, got nil")
+    }
+    if n := c.cache.order.Len(); n != 0 {
+        t.Errorf("got %d cached series after a failed commit, want 0", n)
+    }
+
+    queries.mtx.Lock()
+    queries.fail = ""
+    queries.mtx.Unlock()
+    if err := c.insertBatch(context.Background(), samples); err != nil {
+        t.Fatal(err)
+    }
+    if n := c.cache.order.Len(); n != 2 {
+        t.Errorf("got %d cached series after the commit, want 2", n)
+    }
+
+    // Cached series aren't looked up again
+    before := queries.count("_series (metric_name, labels)")
+    if err := c.insertBatch(context.Background(), samples); err != nil {
+        t.Fatal(err)
+    }
+    if n := queries.count("_series (metric_name, labels)") - before; n != 0 {
+        t.Errorf("got %d series lookups for cached series, want 0", n)
+    }
+}
@@ -0,0 +1,226 @@
+package pgdb
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    "context"
+    "strings"
+    "hash/fnv"
+    "database/sql"
+    "encoding/json"
+
+    "github.com/prometheus/client_golang/prometheus"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+    "github.com/arslanm/kafka-timescaledb-adapter/log"
+)
+
+const (
+    SERIES_LIMIT_DROP  = "drop"
+    SERIES_LIMIT_STRIP = "strip"
+
+    // How often a metric over its limit is logged at most
+    seriesLimitLogInterval = time.Minute
+)
+
+var seriesLimitViolations = prometheus.NewCounterVec(
+    prometheus.CounterOpts{
+        Namespace : "kafka_timescale_adapter",
+        Name      : "series_limit_violations_total",
+        Help      : "Total number of samples of new series of metrics which had reached their series limit.",
+    },
+    []string{"remote", "metric", "action"},
+)
+
+// seriesLimiter keeps the number of series of each metric under a limit.
+// It tracks a hash of every series it has seen per metric name. Samples
+// of new series of a metric at its limit are dropped, or written without
+// the labels to strip. A nil limiter admits everything.
+type seriesLimiter struct {
+    remote  string
+    limit   int
+    action  string
+    strip   []string
+
+    mtx     sync.Mutex
+    series  map[string]map[uint64]struct{}
+    logged  map[string]time.Time
+}
+
+func newSeriesLimiter(cfg *Config, remote string) (*seriesLimiter, error) {
+    if cfg.seriesLimit <= 0 {
+        return nil, nil
+    }
+
+    var strip []string
+    for _, label := range strings.Split(cfg.seriesLimitLabels, ",") {
+        if label = strings.TrimSpace(label); len(label) > 0 {
+            strip = append(strip, label)
+        }
+    }
+
+    switch cfg.seriesLimitAction {
+    case SERIES_LIMIT_DROP:
+    case SERIES_LIMIT_STRIP:
+        if len(strip) == 0 {
+            return nil, fmt.Errorf("Series limit action %q needs labels to strip", cfg.seriesLimitAction)
+        }
+    default:
+        return nil, fmt.Errorf("Unknown series limit action %q", cfg.seriesLimitAction)
+    }
+
+    return &seriesLimiter{
+        remote: remote,
+        limit:  cfg.seriesLimit,
+        action: cfg.seriesLimitAction,
+        strip:  strip,
+        series: make(map[string]map[uint64]struct{}),
+        logged: make(map[string]time.Time),
+    }, nil
+}
+
+// Loads the series that are in the database, query returns the metric
+// name and labels of each of them
+func (l *seriesLimiter) seed(ctx context.Context, db *sql.DB, query string) error {
+    if l == nil {
+        return nil
+    }
+    if len(query) == 0 {
+        log.Warn("msg", "Series limit starts empty, the series of this layout can't be listed", "remote", l.remote)
+        return nil
+    }
+
+    rows, err := db.QueryContext(ctx, query)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    var labels []byte
+    var keys []string
+
+    l.mtx.Lock()
+    defer l.mtx.Unlock()
+
+    n := 0
+    for rows.Next() {
+        var name string
+        var raw []byte
+        if err = rows.Scan(&name, &raw); err != nil {
+            return err
+        }
+
+        var m map[string]string
+        if err = json.Unmarshal(raw, &m); err != nil {
+            return err
+        }
+        labels, keys = appendLabelsJSON(labels[:0], keys[:0], m)
+        l.metric(name)[seriesHash(name, labels)] = struct{}{}
+        n++
+    }
+    if err = rows.Err(); err != nil {
+        return err
+    }
+
+    log.Info("msg", "Loaded series for series limit", "remote", l.remote, "series", n, "metrics", len(l.series))
+    return nil
+}
+
+// Returns the samples of a batch that are within the limits. The labels
+// of the samples passed in are never changed, stripped samples get a
+// copy.
+func (l *seriesLimiter) admit(samples []format.Sample) []format.Sample {
+    if l == nil {
+        return samples
+    }
+
+    var labels []byte
+    var keys []string
+
+    l.mtx.Lock()
+    defer l.mtx.Unlock()
+
+    admitted := make([]format.Sample, 0, len(samples))
+    for i := range samples {
+        s := &samples[i]
+        labels, keys = appendLabelsJSON(labels[:0], keys[:0], s.Labels)
+
+        series := l.metric(s.Name)
+        hash := seriesHash(s.Name, labels)
+        if _, ok := series[hash]; ok || len(series) < l.limit {
+            series[hash] = struct{}{}
+            admitted = append(admitted, *s)
+            continue
+        }
+
+        seriesLimitViolations.WithLabelValues(l.remote, s.Name, l.action).Inc()
+        l.warn(s.Name)
+
+        // Series without the stripped labels are admitted over the limit,
+        // there are only as many of them as their other labels make
+        if stripped, ok := l.stripLabels(s); ok {
+            labels, keys = appendLabelsJSON(labels[:0], keys[:0], stripped.Labels)
+            series[seriesHash(stripped.Name, labels)] = struct{}{}
+            admitted = append(admitted, stripped)
+            continue
+        }
+        rejectedMetrics.WithLabelValues(l.remote, "series_limit").Inc()
+    }
+    return admitted
+}
+
+func (l *seriesLimiter) metric(name string) map[uint64]struct{} {
+    series, ok := l.series[name]
+    if !ok {
+        series = make(map[uint64]struct{})
+        l.series[name] = series
+    }
+    return series
+}
+
+// Returns a copy of the sample without the labels to strip, if it has
+// any of them
+func (l *seriesLimiter) stripLabels(s *format.Sample) (format.Sample, bool) {
+    if l.action != SERIES_LIMIT_STRIP {
+        return format.Sample{}, false
+    }
+
+    found := false
+    for _, label := range l.strip {
+        if _, ok := s.Labels[label]; ok {
+            found = true
+            break
+        }
+    }
+    if !found {
+        return format.Sample{}, false
+    }
+
+    stripped := *s
+    stripped.Labels = make(map[string]string, len(s.Labels))
+    for k, v := range s.Labels {
+        stripped.Labels[k] = v
+    }
+    for _, label := range l.strip {
+        delete(stripped.Labels, label)
+    }
+    return stripped, true
+}
+
+func (l *seriesLimiter) warn(name string) {
+    now := time.Now()
+    if now.Sub(l.logged[name]) < seriesLimitLogInterval {
+        return
+    }
+    l.logged[name] = now
+    log.Warn("msg", "Metric reached its series limit", "remote", l.remote, "metric", name, "limit", l.limit, "action", l.action)
+}
+
+func seriesHash(name string, labels []byte) uint64 {
+    h := fnv.New64a()
+    h.Write([]byte(name))
+    h.Write([]byte{0})
+    h.Write(labels)
+    return h.Sum64()
+}
@@ -0,0 +1,106 @@
+package pgdb
+
+import (
+    "reflect"
+    "testing"
+    "time"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+)
+
+func TestNewSeriesLimiter(t *testing.T) {
+    tests := []struct {
+        name   string
+        cfg    Config
+        strip  []string
+        isNil  bool
+        err    bool
+    }{
+        {"disabled", Config{seriesLimit: 0, seriesLimitAction: "bogus"}, nil, true, false},
+        {"drop", Config{seriesLimit: 10, seriesLimitAction: SERIES_LIMIT_DROP}, nil, false, false},
+        {"strip", Config{seriesLimit: 10, seriesLimitAction: SERIES_LIMIT_STRIP, seriesLimitLabels: " pod, ,instance "}, []string{"pod", "instance"}, false, false},
+        {"strip without labels", Config{seriesLimit: 10, seriesLimitAction: SERIES_LIMIT_STRIP, seriesLimitLabels: " , "}, nil, false, true},
+        {"unknown action", Config{seriesLimit: 10, seriesLimitAction: "truncate"}, nil, false, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            l, err := newSeriesLimiter(&tt.cfg, "test")
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("expected an error, got %v", l)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if tt.isNil {
+                if l != nil {
+                    t.Errorf("expected no limiter, got %v", l)
+                }
+                return
+            }
+            if !reflect.DeepEqual(l.strip, tt.strip) {
+                t.Errorf("got labels to strip %v, want %v", l.strip, tt.strip)
+            }
+        })
+    }
+}
+
+func TestSeriesLimiterAdmit(t *testing.T) {
+    ts := time.Unix(1600000000, 0).UTC()
+    sample := func(name string, labels map[string]string) format.Sample {
+        return format.Sample{Name: name, Labels: labels, Value: 1, Timestamp: ts}
+    }
+
+    a := sample("up", map[string]string{"job": "api", "pod": "a"})
+    b := sample("up", map[string]string{"job": "api", "pod": "b"})
+    c := sample("up", map[string]string{"job": "api", "pod": "c"})
+    noPod := sample("up", map[string]string{"job": "db"})
+    other := sample("requests_total", map[string]string{"job": "api", "pod": "c"})
+    stripped := sample("up", map[string]string{"job": "api"})
+
+    tests := []struct {
+        name     string
+        action   string
+        batches  [][]format.Sample
+        want     []format.Sample
+    }{
+        {"under the limit", SERIES_LIMIT_DROP, [][]format.Sample{{a, b}}, []format.Sample{a, b}},
+        {"known series over the limit", SERIES_LIMIT_DROP, [][]format.Sample{{a, b}, {c, a, b}}, []format.Sample{a, b}},
+        {"limit per metric", SERIES_LIMIT_DROP, [][]format.Sample{{a, b}, {other}}, []format.Sample{other}},
+        {"drop new series", SERIES_LIMIT_DROP, [][]format.Sample{{a, b, c, noPod}}, []format.Sample{a, b}},
+        {"strip new series", SERIES_LIMIT_STRIP, [][]format.Sample{{a, b, c, noPod}}, []format.Sample{a, b, stripped}},
+        {"stripped series admitted again", SERIES_LIMIT_STRIP, [][]format.Sample{{a, b, c}, {c}}, []format.Sample{stripped}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            l, err := newSeriesLimiter(&Config{seriesLimit: 2, seriesLimitAction: tt.action, seriesLimitLabels: "pod"}, "test")
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            var got []format.Sample
+            for _, batch := range tt.batches {
+                got = l.admit(batch)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("got %v, want %v", got, tt.want)
+            }
+        })
+    }
+
+    if c.Labels["pod"] != "c" {
+        t.Error("expected the labels of the sample passed in to stay unchanged")
+    }
+}
+
+func TestSeriesLimiterNil(t *testing.T) {
+    var l *seriesLimiter
+    samples := []format.Sample{{Name: "up", Labels: map[string]string{}, Value: 1}}
+    if got := l.admit(samples); !reflect.DeepEqual(got, samples) {
+        t.Errorf("expected a nil limiter to admit everything, got %v", got)
+    }
+}
@@ -8,21 +8,25 @@ import (
     "fmt"
     "time"
     "sort"
+    "sync"
     "strings"
     "context"
     "database/sql"
-    "encoding/json"
 
     _ "github.com/lib/pq"
 
     "github.com/prometheus/client_golang/prometheus"
 
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
     "github.com/arslanm/kafka-timescaledb-adapter/log"
     "github.com/arslanm/kafka-timescaledb-adapter/util"
 )
 
 // Config for the database
 type Config struct {
+    name                      string
+    writeTimeout              time.Duration
+    writeRetry                int
     host                      string
     port                      int
     username                  string
@@ -36,6 +40,32 @@ type Config struct {
     pgPrometheusNormalize     bool
     pgPrometheusChunkInterval time.Duration
     useTimescaleDb            bool
+    driver                    string
+    seriesCacheSize           int
+    schemaMode                string
+    metricTableTemplate       string
+    dsn                       string
+    sslMode                   string
+    sslRootCert               string
+    sslCert                   string
+    sslKey                    string
+    targetSessionAttrs        string
+    managePolicies            bool
+    compressAfter             time.Duration
+    retention                 time.Duration
+    reorder                   bool
+    rollups                   string
+    rollupsFile               string
+    rollupStatusInterval      time.Duration
+    dedupe                    string
+    autoMigrate               bool
+    copyParallelism           int
+    seriesLimit               int
+    seriesLimitAction         string
+    seriesLimitLabels         string
+    pgbouncer                 bool
+    lateThreshold             time.Duration
+    latePolicy                string
 }
 
 const (
@@ -53,11 +83,40 @@ const (
     DEFAULT_PG_CHUNK_INTERVAL     = "12h"
     DEFAULT_PG_NORMALIZE          = true
     DEFAULT_PG_USE_TIMESCALEDB    = true
-
-    sqlCreateTmpTable = "CREATE TEMPORARY TABLE IF NOT EXISTS %s_tmp_%d(sample prom_sample) ON COMMIT DELETE ROWS;"
-    sqlCopyTable      = "COPY \"%s\" FROM STDIN"
-    sqlInsertLabels   = "INSERT INTO %s_labels (metric_name, labels) SELECT tmp.prom_name, tmp.prom_labels FROM (SELECT prom_time(sample), prom_value(sample), prom_name(sample), prom_labels(sample) FROM %s_tmp_%d) tmp LEFT JOIN %s_labels l ON tmp.prom_name=l.metric_name AND tmp.prom_labels=l.labels WHERE l.metric_name IS NULL ON CONFLICT (metric_name, labels) DO NOTHING;"
-    sqlInsertValues   = "INSERT INTO %s_values SELECT tmp.prom_time, tmp.prom_value, l.id FROM (SELECT prom_time(sample), prom_value(sample), prom_name(sample), prom_labels(sample) FROM %s_tmp_%d) tmp INNER JOIN %s_labels l on tmp.prom_name=l.metric_name AND  tmp.prom_labels=l.labels;"
+    DEFAULT_PG_DRIVER             = DRIVER_PQ
+    DEFAULT_PG_SERIES_CACHE_SIZE  = 100000
+    DEFAULT_PG_SCHEMA_MODE        = SCHEMA_PG_PROMETHEUS
+    DEFAULT_PG_METRIC_TABLE_TEMPLATE = ""
+    DEFAULT_PG_DSN                = ""
+    DEFAULT_PG_SSLMODE            = "disable"
+    DEFAULT_PG_SSLROOTCERT        = ""
+    DEFAULT_PG_SSLCERT            = ""
+    DEFAULT_PG_SSLKEY             = ""
+    DEFAULT_PG_TARGET_SESSION_ATTRS = ""
+    DEFAULT_PG_WRITE_TIMEOUT      = "30s"
+    DEFAULT_PG_WRITE_RETRY        = 3
+    DEFAULT_PG_MANAGE_POLICIES    = false
+    DEFAULT_PG_COMPRESS_AFTER     = "0s"
+    DEFAULT_PG_RETENTION          = "0s"
+    DEFAULT_PG_REORDER            = false
+    DEFAULT_PG_ROLLUPS            = ""
+    DEFAULT_PG_ROLLUPS_FILE       = ""
+    DEFAULT_PG_ROLLUP_STATUS_INTERVAL = "1m"
+    DEFAULT_PG_DEDUPE             = DEDUPE_OFF
+    DEFAULT_PG_AUTO_MIGRATE       = true
+    DEFAULT_PG_COPY_PARALLELISM   = 1
+    DEFAULT_PG_SERIES_LIMIT       = 0
+    DEFAULT_PG_SERIES_LIMIT_ACTION = SERIES_LIMIT_DROP
+    DEFAULT_PG_SERIES_LIMIT_LABELS = ""
+    DEFAULT_PG_PGBOUNCER          = false
+    DEFAULT_PG_LATE_THRESHOLD     = "0s"
+    DEFAULT_PG_LATE_POLICY        = LATE_ACCEPT
+
+    // Name of the only target when PG_TARGETS is not set
+    DEFAULT_TARGET_NAME = "kafka-timescaledb-adapter"
+
+    sqlCreateMetadataTable = "CREATE TABLE IF NOT EXISTS %s_metadata (metric_name TEXT PRIMARY KEY, type TEXT, help TEXT, unit TEXT, last_updated TIMESTAMPTZ NOT NULL DEFAULT now());"
+    sqlUpsertMetadata      = "INSERT INTO %s_metadata AS m (metric_name, type, help, unit, last_updated) VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), now()) ON CONFLICT (metric_name) DO UPDATE SET type = COALESCE(EXCLUDED.type, m.type), help = COALESCE(EXCLUDED.help, m.help), unit = COALESCE(EXCLUDED.unit, m.unit), last_updated = now();"
 )
 
 var (
@@ -87,6 +146,15 @@ var (
         []string{"remote"},
     )
 
+    rejectedMetrics = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace : "kafka_timescale_adapter",
+            Name      : "rejected_metrics_total",
+            Help      : "Total number of metrics which were skipped because they could not be decoded or written.",
+        },
+        []string{"remote", "reason"},
+    )
+
     sentDuration = prometheus.NewHistogramVec(
         prometheus.HistogramOpts{
             Namespace : "kafka_timescale_adapter",
@@ -96,293 +164,445 @@ var (
         },
         []string{"remote"},
     )
-
-    createTmpTableStmt *sql.Stmt
-    copyTableUniqId int64
 )
 
-func GetConfig(cfg *Config) *Config {
-
-    cfg.host = util.GetEnvWithDefault("PG_HOST", DEFAULT_PG_HOST)
-    cfg.port = util.GetEnvWithDefaultInt("PG_PORT", DEFAULT_PG_PORT)
-    cfg.database = util.GetEnvWithDefault("PG_DATABASE", DEFAULT_PG_DATABASE)
-    cfg.username = util.GetEnvWithDefault("PG_USERNAME", DEFAULT_PG_USERNAME)
-    cfg.password = util.GetEnvWithDefault("PG_PASSWORD", DEFAULT_PG_PASSWORD)
-    cfg.table = util.GetEnvWithDefault("PG_TABLE", DEFAULT_PG_TABLE)
-    cfg.copyTable = util.GetEnvWithDefault("PG_COPY_TABLE", DEFAULT_PG_COPY_TABLE)
-    cfg.maxOpenConns = util.GetEnvWithDefaultInt("PG_MAX_OPEN_CONNS", DEFAULT_PG_MAX_OPEN_CONNS)
-    cfg.maxIdleConns = util.GetEnvWithDefaultInt("PG_MAX_IDLE_CONNS", DEFAULT_PG_MAX_IDLE_CONNS)
-    cfg.maxConnLifetime = util.GetEnvWithDefaultDuration("PG_MAX_CONN_LIFETIME", DEFAULT_PG_MAX_CONN_LIFETIME)
-    cfg.pgPrometheusNormalize = util.GetEnvWithDefaultBool("PG_NORMALIZE", DEFAULT_PG_NORMALIZE)
-    cfg.pgPrometheusChunkInterval = util.GetEnvWithDefaultDuration("PG_CHUNK_INTERVAL", DEFAULT_PG_CHUNK_INTERVAL)
-    cfg.useTimescaleDb = util.GetEnvWithDefaultBool("PG_USE_TIMESCALEDB", DEFAULT_PG_USE_TIMESCALEDB)
+// Reads the config of a target. Each setting is read from
+// PG_<NAME>_<SETTING> if it is set, otherwise from PG_<SETTING>, so
+// targets only need to set what differs. The target without a name reads
+// PG_<SETTING> only.
+func GetConfig(cfg *Config, name string) *Config {
+    env := func(setting string) string {
+        return targetEnv(name, setting)
+    }
+
+    cfg.name = name
+
+    cfg.host = util.GetEnvWithDefault(env("HOST"), DEFAULT_PG_HOST)
+    cfg.port = util.GetEnvWithDefaultInt(env("PORT"), DEFAULT_PG_PORT)
+    cfg.database = util.GetEnvWithDefault(env("DATABASE"), DEFAULT_PG_DATABASE)
+    cfg.username = util.GetEnvWithDefault(env("USERNAME"), DEFAULT_PG_USERNAME)
+    cfg.password = util.GetEnvWithDefault(env("PASSWORD"), DEFAULT_PG_PASSWORD)
+    cfg.table = util.GetEnvWithDefault(env("TABLE"), DEFAULT_PG_TABLE)
+    cfg.copyTable = util.GetEnvWithDefault(env("COPY_TABLE"), DEFAULT_PG_COPY_TABLE)
+    cfg.maxOpenConns = util.GetEnvWithDefaultInt(env("MAX_OPEN_CONNS"), DEFAULT_PG_MAX_OPEN_CONNS)
+    cfg.maxIdleConns = util.GetEnvWithDefaultInt(env("MAX_IDLE_CONNS"), DEFAULT_PG_MAX_IDLE_CONNS)
+    cfg.maxConnLifetime = util.GetEnvWithDefaultDuration(env("MAX_CONN_LIFETIME"), DEFAULT_PG_MAX_CONN_LIFETIME)
+    cfg.pgPrometheusNormalize = util.GetEnvWithDefaultBool(env("NORMALIZE"), DEFAULT_PG_NORMALIZE)
+    cfg.pgPrometheusChunkInterval = util.GetEnvWithDefaultDuration(env("CHUNK_INTERVAL"), DEFAULT_PG_CHUNK_INTERVAL)
+    cfg.useTimescaleDb = util.GetEnvWithDefaultBool(env("USE_TIMESCALEDB"), DEFAULT_PG_USE_TIMESCALEDB)
+    cfg.driver = util.GetEnvWithDefault(env("DRIVER"), DEFAULT_PG_DRIVER)
+    cfg.seriesCacheSize = util.GetEnvWithDefaultInt(env("SERIES_CACHE_SIZE"), DEFAULT_PG_SERIES_CACHE_SIZE)
+    cfg.schemaMode = util.GetEnvWithDefault(env("SCHEMA_MODE"), DEFAULT_PG_SCHEMA_MODE)
+    cfg.metricTableTemplate = util.GetEnvWithDefault(env("METRIC_TABLE_TEMPLATE"), DEFAULT_PG_METRIC_TABLE_TEMPLATE)
+    cfg.dsn = util.GetEnvWithDefault(env("DSN"), DEFAULT_PG_DSN)
+    cfg.sslMode = util.GetEnvWithDefault(env("SSLMODE"), DEFAULT_PG_SSLMODE)
+    cfg.sslRootCert = util.GetEnvWithDefault(env("SSLROOTCERT"), DEFAULT_PG_SSLROOTCERT)
+    cfg.sslCert = util.GetEnvWithDefault(env("SSLCERT"), DEFAULT_PG_SSLCERT)
+    cfg.sslKey = util.GetEnvWithDefault(env("SSLKEY"), DEFAULT_PG_SSLKEY)
+    cfg.targetSessionAttrs = util.GetEnvWithDefault(env("TARGET_SESSION_ATTRS"), DEFAULT_PG_TARGET_SESSION_ATTRS)
+    cfg.managePolicies = util.GetEnvWithDefaultBool(env("MANAGE_POLICIES"), DEFAULT_PG_MANAGE_POLICIES)
+    cfg.compressAfter = util.GetEnvWithDefaultDuration(env("COMPRESS_AFTER"), DEFAULT_PG_COMPRESS_AFTER)
+    cfg.retention = util.GetEnvWithDefaultDuration(env("RETENTION"), DEFAULT_PG_RETENTION)
+    cfg.reorder = util.GetEnvWithDefaultBool(env("REORDER"), DEFAULT_PG_REORDER)
+    cfg.rollups = util.GetEnvWithDefault(env("ROLLUPS"), DEFAULT_PG_ROLLUPS)
+    cfg.rollupsFile = util.GetEnvWithDefault(env("ROLLUPS_FILE"), DEFAULT_PG_ROLLUPS_FILE)
+    cfg.rollupStatusInterval = util.GetEnvWithDefaultDuration(env("ROLLUP_STATUS_INTERVAL"), DEFAULT_PG_ROLLUP_STATUS_INTERVAL)
+    cfg.dedupe = util.GetEnvWithDefault(env("DEDUPE"), DEFAULT_PG_DEDUPE)
+    cfg.autoMigrate = util.GetEnvWithDefaultBool(env("AUTO_MIGRATE"), DEFAULT_PG_AUTO_MIGRATE)
+    cfg.copyParallelism = util.GetEnvWithDefaultInt(env("COPY_PARALLELISM"), DEFAULT_PG_COPY_PARALLELISM)
+    cfg.seriesLimit = util.GetEnvWithDefaultInt(env("SERIES_LIMIT"), DEFAULT_PG_SERIES_LIMIT)
+    cfg.seriesLimitAction = util.GetEnvWithDefault(env("SERIES_LIMIT_ACTION"), DEFAULT_PG_SERIES_LIMIT_ACTION)
+    cfg.seriesLimitLabels = util.GetEnvWithDefault(env("SERIES_LIMIT_LABELS"), DEFAULT_PG_SERIES_LIMIT_LABELS)
+    cfg.pgbouncer = util.GetEnvWithDefaultBool(env("PGBOUNCER"), DEFAULT_PG_PGBOUNCER)
+    cfg.lateThreshold = util.GetEnvWithDefaultDuration(env("LATE_THRESHOLD"), DEFAULT_PG_LATE_THRESHOLD)
+    cfg.latePolicy = util.GetEnvWithDefault(env("LATE_POLICY"), DEFAULT_PG_LATE_POLICY)
+
+    // WRITE_TIMEOUT and WRITE_RETRY are still read for all targets
+    writeTimeout := util.GetEnvWithDefault("WRITE_TIMEOUT", DEFAULT_PG_WRITE_TIMEOUT)
+    writeRetry := util.GetEnvWithDefaultInt("WRITE_RETRY", DEFAULT_PG_WRITE_RETRY)
+    cfg.writeTimeout = util.GetEnvWithDefaultDuration(env("WRITE_TIMEOUT"), writeTimeout)
+    cfg.writeRetry = util.GetEnvWithDefaultInt(env("WRITE_RETRY"), writeRetry)
 
     return cfg
 }
 
+// Returns the environment variable a setting of a target is read from
+func targetEnv(name string, setting string) string {
+    if len(name) > 0 {
+        env := fmt.Sprintf("PG_%s_%s", strings.ToUpper(strings.Replace(name, "-", "_", -1)), setting)
+        if len(os.Getenv(env)) > 0 {
+            return env
+        }
+    }
+    return "PG_" + setting
+}
+
 type Client struct {
     DB         *sql.DB
     cfg        *Config
-    Whitelist  *util.Whitelist
+    copier     copier
+    cache      *seriesCache
+    schema     schema
+    rollups    []rollup
+    limiter    *seriesLimiter
+
+    mtx          sync.Mutex
+    rollupViews  []string
+    chunks       map[string]*chunkUse
 }
 
+var registerMetrics sync.Once
+
+// Registers the metrics of the package, calling it again does nothing
 func InitPromMetrics() {
-    prometheus.MustRegister(receivedMetrics)
-    prometheus.MustRegister(sentMetrics)
-    prometheus.MustRegister(failedMetrics)
-    prometheus.MustRegister(sentDuration)
+    registerMetrics.Do(func() {
+        prometheus.MustRegister(receivedMetrics)
+        prometheus.MustRegister(sentMetrics)
+        prometheus.MustRegister(failedMetrics)
+        prometheus.MustRegister(rejectedMetrics)
+        prometheus.MustRegister(sentDuration)
+        prometheus.MustRegister(routedSamples)
+        prometheus.MustRegister(seriesCacheHits)
+        prometheus.MustRegister(seriesCacheMisses)
+        prometheus.MustRegister(seriesCacheSize)
+        prometheus.MustRegister(rollupLastSuccess)
+        prometheus.MustRegister(rollupFailures)
+        prometheus.MustRegister(duplicateSamples)
+        prometheus.MustRegister(seriesLimitViolations)
+        prometheus.MustRegister(lateSamples)
+    })
 }
 
-func NewClient(cfg *Config, wl *util.Whitelist) *Client {
-    connStr := fmt.Sprintf("host=%v port=%v user=%v dbname=%v password='%v' sslmode=disable connect_timeout=10",
-        cfg.host, cfg.port, cfg.username, cfg.database, cfg.password)
+func NewClient(cfg *Config) *Client {
+    client, err := openClient(cfg)
+    if err != nil {
+        log.Error("error", err)
+        os.Exit(1)
+    }
 
-    db, err := sql.Open("postgres", connStr)
+    err = client.schema.setup()
+    if err != nil {
+        log.Error("error", err)
+        os.Exit(1)
+    }
 
+    if cfg.autoMigrate {
+        _, err = client.migrate(context.Background())
+    } else {
+        var pending int
+        pending, err = client.pendingMigrations(context.Background())
+        if err == nil && pending > 0 {
+            err = fmt.Errorf("Schema of %s has %d pending migrations, apply them with the migrate up command", cfg.table, pending)
+        }
+    }
     if err != nil {
         log.Error("error", err)
         os.Exit(1)
     }
 
-    db.SetMaxOpenConns(cfg.maxOpenConns)
-    db.SetMaxIdleConns(cfg.maxIdleConns)
-    db.SetConnMaxLifetime(cfg.maxConnLifetime)
+    tables, err := client.schema.valueTables(context.Background())
+    if err != nil {
+        log.Error("msg", "Error listing value tables", "error", err)
+        os.Exit(1)
+    }
 
-    client := &Client{DB: db, cfg: cfg, Whitelist: wl}
+    err = client.setupDedupe(context.Background(), tables)
+    if err != nil {
+        log.Error("error", err)
+        os.Exit(1)
+    }
 
-    err = client.setupPgPrometheus()
+    err = client.setupLate(tables)
     if err != nil {
         log.Error("error", err)
         os.Exit(1)
     }
 
-    copyTableUniqId = time.Now().UnixNano() / int64(time.Millisecond)
-    createTmpTableStmt, err = db.Prepare(fmt.Sprintf(sqlCreateTmpTable, cfg.table, copyTableUniqId))
+    client.limiter, err = newSeriesLimiter(cfg, client.Name())
+    if err == nil {
+        err = client.limiter.seed(context.Background(), client.DB, client.schema.seriesQuery())
+    }
     if err != nil {
-        log.Error("msg", "Error on preparing create tmp table statement", "error", err)
+        log.Error("msg", "Error setting up series limit", "error", err)
         os.Exit(1)
     }
 
-    InitPromMetrics()
+    client.applyPolicies(context.Background(), tables)
+    client.applyRollups(context.Background(), tables)
+
+    if len(client.rollups) > 0 {
+        client.trackRollups(tables)
+        go client.runRollupStatus()
+    }
 
     return client
 }
 
-func (c *Client) setupPgPrometheus() error {
-    tx, err := c.DB.Begin()
+// Connects to a target and picks its layout without touching its tables
+func openClient(cfg *Config) (*Client, error) {
+    connStr, err := connString(cfg)
     if err != nil {
-        return err
+        return nil, err
     }
 
-    defer tx.Rollback()
-
-    _, err = tx.Exec("CREATE EXTENSION IF NOT EXISTS pg_prometheus")
+    cp, err := newCopier(cfg.driver)
     if err != nil {
-        return err
+        return nil, err
     }
 
-    if c.cfg.useTimescaleDb {
-        _, err = tx.Exec("CREATE EXTENSION IF NOT EXISTS timescaledb CASCADE")
-    }
+    db, err := sql.Open(cfg.driver, connStr)
     if err != nil {
-        log.Info("msg", "Could not enable TimescaleDB extension", "error", err)
+        return nil, err
     }
 
-    var rows *sql.Rows
-    rows, err = tx.Query("SELECT create_prometheus_table($1, normalized_tables => $2, chunk_time_interval => $3,  use_timescaledb=> $4)",
-        c.cfg.table, c.cfg.pgPrometheusNormalize, c.cfg.pgPrometheusChunkInterval.String(), c.cfg.useTimescaleDb)
+    db.SetMaxOpenConns(cfg.maxOpenConns)
+    db.SetMaxIdleConns(cfg.maxIdleConns)
+    db.SetConnMaxLifetime(cfg.maxConnLifetime)
 
+    rollups, err := parseRollups(cfg.rollups, cfg.rollupsFile)
     if err != nil {
-        if strings.Contains(err.Error(), "already exists") {
-            return nil
-        }
-        return err
+        db.Close()
+        return nil, err
     }
-    rows.Close()
 
-    err = tx.Commit()
+    client := &Client{DB: db, cfg: cfg, copier: cp, rollups: rollups}
+    if cfg.seriesCacheSize > 0 {
+        client.cache = newSeriesCache(cfg.seriesCacheSize, client.Name())
+    }
 
+    client.schema, err = newSchema(cfg.schemaMode, client)
     if err != nil {
-        return err
+        db.Close()
+        return nil, err
     }
-
-    log.Info("msg", "Initialized pg_prometheus extension")
-    return nil
+    return client, nil
 }
 
-func parseJSONMetric(m string) (interface {}, error) {
-    var f interface{}
-    err := json.Unmarshal([]byte(m), &f)
-    return f, err
+// The metadata table holds the type, help and unit of the metrics whose
+// input format carries them. Every layout has one.
+func (c *Client) metadataMigration(version int) migration {
+    return migration{version: version, description: "Create metadata table", up: execMigration(func() []string {
+        return []string{fmt.Sprintf(sqlCreateMetadataTable, c.cfg.table)}
+    })}
 }
 
-func (c *Client) Insert(ctx context.Context, metrics []string) (int, error) {
-    tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
-    if err != nil {
-        log.Error("msg", "Error on Begin when writing samples", "error", err)
-        return 0, err
+// Upserts the metadata the decoder has collected since the last batch.
+// Metadata is best effort, errors are logged and the samples of the
+// batch are not affected.
+func (c *Client) writeMetadata(ctx context.Context, metadata []format.Metadata) error {
+    if len(metadata) == 0 {
+        return nil
     }
 
-    defer tx.Rollback()
-
-    _, err = tx.Stmt(createTmpTableStmt).Exec()
+    tx, err := c.DB.BeginTx(ctx, nil)
     if err != nil {
-        log.Error("msg", "Error executing create tmp table", "error", err)
-        return 0, err
+        log.Error("msg", "Error on Begin when writing metadata", "error", err)
+        return err
     }
+    defer tx.Rollback()
 
-    var copyTable string
-    if len(c.cfg.copyTable) > 0 {
-        copyTable = c.cfg.copyTable
-    } else if c.cfg.pgPrometheusNormalize {
-        copyTable = fmt.Sprintf("%s_tmp_%d", c.cfg.table, copyTableUniqId)
-    } else {
-        copyTable = fmt.Sprintf("%s_samples", c.cfg.table)
+    for _, md := range metadata {
+        _, err = tx.Exec(fmt.Sprintf(sqlUpsertMetadata, c.cfg.table), md.Name, md.Type, md.Help, md.Unit)
+        if err != nil {
+            log.Error("msg", "Error writing metadata", "metric", md.Name, "error", err)
+            return err
+        }
     }
 
-    copyStmt, err := tx.Prepare(fmt.Sprintf(sqlCopyTable, copyTable))
+    err = tx.Commit()
     if err != nil {
-        log.Error("msg", "Error on COPY prepare", "error", err)
-        return 0, err
+        log.Error("msg", "Error on Commit when writing metadata", "error", err)
+        return err
     }
+    log.Debug("msg", "Wrote metadata", "metrics", len(metadata))
+    return nil
+}
 
-    sentCount := 0
-    for _, metric := range metrics {
-        jsonMsg, err := parseJSONMetric(metric)
-        if err != nil {
-            log.Error("msg", "Can't parse JSON metric", "error", err)
-            continue
-        }
+// Formats a sample the way pg_prometheus expects it:
+// name{label="value",...} value timestamp_ms
+func formatSample(s *format.Sample) string {
+    labelStrings := make([]string, 0, len(s.Labels))
+    for l, v := range s.Labels {
+        labelStrings = append(labelStrings, fmt.Sprintf("%s=%q", l, v))
+    }
 
-        m, ok := jsonMsg.(map[string]interface{})
-        if !ok {
-            log.Error("msg", "Can't find metric object")
-            continue
-        }
+    sort.Strings(labelStrings)
+    labels := fmt.Sprintf("{%s}", strings.Join(labelStrings, ","))
 
-        name := fmt.Sprintf("%v", m["name"])
-        if c.Whitelist != nil {
-            if !c.Whitelist.IsWhitelisted(name) {
-                continue
-            }
-        }
+    return fmt.Sprintf("%s%s %s %v", s.Name, labels, format.FormatValue(s.Value), s.Timestamp.UnixNano() / 1000000)
+}
 
-        timestamp := fmt.Sprintf("%v", m["timestamp"])
-        value := fmt.Sprintf("%v", m["value"])
+// Labels are staged as a JSON object so they can be compared with the
+// labels column of the normalized tables
+func formatLabels(labels map[string]string) string {
+    b, _ := appendLabelsJSON(nil, nil, labels)
+    return string(b)
+}
 
-        labelMap := m["labels"].(map[string]interface{})
-        labelStrings := make([]string, 0, len(labelMap))
+// Writes the samples, in one transaction or with PG_COPY_PARALLELISM in
+// several concurrent ones. Returns the number of samples written and the
+// samples of the transactions that failed, which are all that need to be
+// retried.
+func (c *Client) Insert(ctx context.Context, samples []format.Sample) (int, []format.Sample, error) {
+    samples = c.dedupeBatch(samples)
 
-        for l, v := range labelMap {
-            if l == "__name__" {
-                name = fmt.Sprintf("%s", v)
-                continue
-            }
-            if l != name {
-                labelStrings = append(labelStrings, fmt.Sprintf("%s=%q", l, v))
-            }
-        }
+    parts := c.splitBatch(samples)
+    if len(parts) > 1 {
+        return c.insertParallel(ctx, parts)
+    }
 
-        sort.Strings(labelStrings)
-        labels := fmt.Sprintf("{%s}", strings.Join(labelStrings, ","))
+    return c.insertRejecting(ctx, samples)
+}
 
-        ts, err := time.Parse(time.RFC3339, timestamp)
-        if err != nil {
-            log.Error("error", "Can't parse timestamp -- ignoring metric", "error", err)
-            continue
-        }
+// Writes samples like insertBatch. When PostgreSQL refuses a value the
+// samples are split in halves that are written on their own, down to
+// the single samples it refuses, which are counted and skipped instead
+// of failing the batch on every retry. Returns the number of samples
+// written and the samples of the transactions that failed.
+func (c *Client) insertRejecting(ctx context.Context, samples []format.Sample) (int, []format.Sample, error) {
+    err := c.insertBatch(ctx, samples)
+    if err == nil {
+        return len(samples), nil, nil
+    }
+    if !isDataError(err) || ctx.Err() != nil {
+        return 0, samples, err
+    }
+
+    if len(samples) == 1 {
+        log.Debug("msg", "Sample refused by the database -- ignoring", "remote", c.Name(), "sample", formatSample(&samples[0]), "error", err)
+        rejectedMetrics.WithLabelValues(c.Name(), "refused").Inc()
+        return 0, nil, nil
+    }
 
-        line := fmt.Sprintf("%s%s %s %v", name, labels, value, ts.UnixNano() / 1000000)
+    half := len(samples) / 2
+    written, failed, err := c.insertRejecting(ctx, samples[:half])
+    n, f, ferr := c.insertRejecting(ctx, samples[half:])
+    if ferr != nil {
+        err = ferr
+    }
+
+    // failed may be the first half, appending to it must not overwrite
+    // the second one
+    if len(f) > 0 {
+        failed = append(failed[:len(failed):len(failed)], f...)
+    }
+    return written + n, failed, err
+}
 
-        _, err = copyStmt.Exec(line)
+// Writes samples in a transaction of their own. Depending on
+// PG_LATE_POLICY late samples go to the backfill table, or the chunks
+// they fall into are decompressed first and recompressed afterwards.
+func (c *Client) insertBatch(ctx context.Context, samples []format.Sample) error {
+    if c.cfg.lateThreshold > 0 && c.cfg.latePolicy == LATE_DECOMPRESS {
+        chunks, err := c.decompressChunks(ctx, samples)
+        defer c.releaseChunks(chunks)
         if err != nil {
-            log.Error("msg", "Error executing COPY statement", "stmt", line, "error", err)
-            return 0, err
+            log.Error("msg", "Error decompressing chunks for late samples", "error", err)
+            return err
         }
+    }
 
-        sentCount += 1
+    var late []format.Sample
+    if c.cfg.lateThreshold > 0 && c.cfg.latePolicy == LATE_BACKFILL {
+        samples, late = c.splitLate(samples)
     }
 
-    _, err = copyStmt.Exec()
+    err := c.schema.ensureTables(ctx, samples)
     if err != nil {
-        log.Error("msg", "Error executing COPY statement", "error", err)
-        return 0, err
+        return err
     }
 
-    if copyTable == fmt.Sprintf("%s_tmp_%d", c.cfg.table, copyTableUniqId) {
-        stmtLabels, err := tx.Prepare(fmt.Sprintf(sqlInsertLabels, c.cfg.table, c.cfg.table, copyTableUniqId, c.cfg.table))
-        if err != nil {
-            log.Error("msg", "Error on preparing labels statement", "error", err)
-            return 0, err
-        }
-        _, err = stmtLabels.Exec()
-        if err != nil {
-            log.Error("msg", "Error executing labels statement", "error", err)
-            return 0, err
-        }
+    // The COPY of pgx needs the connection the transaction runs on
+    conn, err := c.DB.Conn(ctx)
+    if err != nil {
+        log.Error("msg", "Error on getting a connection when writing samples", "error", err)
+        return err
+    }
 
-        stmtValues, err := tx.Prepare(fmt.Sprintf(sqlInsertValues, c.cfg.table, c.cfg.table, copyTableUniqId, c.cfg.table))
-        if err != nil {
-            log.Error("msg", "Error on preparing values statement", "error", err)
-            return 0, err
-        }
-        _, err = stmtValues.Exec()
-        if err != nil {
-            log.Error("msg", "Error executing values statement", "error", err)
-            return 0, err
-        }
+    defer conn.Close()
 
-        err = stmtLabels.Close()
-        if err != nil {
-            log.Error("msg", "Error on closing labels statement", "error", err)
-            return 0, err
-        }
+    tx, err := conn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+    if err != nil {
+        log.Error("msg", "Error on Begin when writing samples", "error", err)
+        return err
+    }
+
+    defer tx.Rollback()
 
-        err = stmtValues.Close()
+    var committed func()
+    if len(samples) > 0 {
+        committed, err = c.schema.insert(ctx, conn, tx, samples)
         if err != nil {
-            log.Error("msg", "Error on closing values statement", "error", err)
-            return 0, err
+            return err
         }
     }
 
-    err = copyStmt.Close()
-    if err != nil {
-        log.Error("msg", "Error on COPY Close when writing samples", "error", err)
-        return 0, err
+    if len(late) > 0 {
+        err = c.copier.copySamples(ctx, conn, tx, fmt.Sprintf("%s_backfill", c.cfg.table), late)
+        if err != nil {
+            log.Error("msg", "Error copying late samples into backfill table", "error", err)
+            return err
+        }
     }
 
     err = tx.Commit()
     if err != nil {
         log.Error("msg", "Error on Commit when writing samples", "error", err)
-        return 0, err
+        return err
+    }
+
+    if committed != nil {
+        committed()
     }
-    return sentCount, nil
+    return nil
 }
 
-func (c *Client) Write(ctx context.Context, id int, attempt int, metrics []string, count int) error {
-    receivedMetrics.Add(float64(count))
+// Writes the samples of a batch, retrying up to PG_WRITE_RETRY times
+// with each attempt limited to PG_WRITE_TIMEOUT. A retry only writes
+// the samples the previous attempt failed to write.
+func (c *Client) Write(ctx context.Context, id int, samples []format.Sample) error {
+    samples = c.limiter.admit(samples)
+    samples = c.checkLate(samples)
+
+    var err error
+    for attempt := 1; attempt <= c.cfg.writeRetry; attempt++ {
+        samples, err = c.write(ctx, id, attempt, samples)
+        if err == nil {
+            return nil
+        }
+        log.Info("worker", id, "msg", "Unable to submit metrics", "remote", c.Name(), "attempt", attempt, "error", err)
+    }
+    return err
+}
 
-    log.Debug("worker", id, "msg", "Start shipping metrics", "metrics", count, "attempt", attempt)
+func (c *Client) write(ctx context.Context, id int, attempt int, samples []format.Sample) ([]format.Sample, error) {
+    ctx, cancel := context.WithTimeout(ctx, c.cfg.writeTimeout)
+    defer cancel()
+
+    log.Debug("worker", id, "msg", "Start shipping metrics", "remote", c.Name(), "metrics", len(samples), "attempt", attempt)
 
     begin := time.Now()
-    sentCount, err := c.Insert(ctx, metrics)
+    sentCount, failed, err := c.Insert(ctx, samples)
     duration := time.Since(begin).Seconds()
 
+    // Samples of the transactions that committed are sent even if others
+    // failed
+    sentMetrics.WithLabelValues(c.Name()).Add(float64(sentCount))
+
     if err != nil {
-        failedMetrics.WithLabelValues(c.Name()).Add(float64(count))
-        return err
+        failedMetrics.WithLabelValues(c.Name()).Add(float64(len(failed)))
+        return failed, err
     }
 
-    log.Debug("worker", id, "msg", "End shipping metrics", "metrics", sentCount, "attempt", attempt, "duration", duration)
+    log.Debug("worker", id, "msg", "End shipping metrics", "remote", c.Name(), "metrics", sentCount, "attempt", attempt, "duration", duration)
 
-    sentMetrics.WithLabelValues(c.Name()).Add(float64(sentCount))
     sentDuration.WithLabelValues(c.Name()).Observe(duration)
 
-    return nil
+    return nil, nil
 }
 
 func (c *Client) Close() {
-    log.Info("msg", "Closing DB connection")
+    log.Info("msg", "Closing DB connection", "remote", c.Name())
     if c.DB != nil {
         if err := c.DB.Close(); err != nil {
             log.Error("msg", "Error closing DB connection", "error", err.Error())
@@ -390,6 +610,10 @@ func (c *Client) Close() {
     }
 }
 
+// The name of the target, which is the remote label of its metrics
 func (c *Client) Name() string {
-    return "kafka-timescaledb-adapter"
+    if len(c.cfg.name) == 0 {
+        return DEFAULT_TARGET_NAME
+    }
+    return c.cfg.name
 }
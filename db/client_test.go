@@ -0,0 +1,168 @@
+package pgdb
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+    "context"
+    "database/sql"
+
+    "github.com/lib/pq"
+    "github.com/jackc/pgconn"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+    "github.com/arslanm/kafka-timescaledb-adapter/log"
+)
+
+func TestMain(m *testing.M) {
+    log.Init("error")
+    os.Exit(m.Run())
+}
+
+// A layout that keeps the samples of committed transactions in memory
+// and fails the insert of a batch as refuse tells it to
+type fakeSchema struct {
+    mtx      sync.Mutex
+    refuse   func(s *format.Sample) error
+    written  []format.Sample
+}
+
+func (f *fakeSchema) setup() error             { return nil }
+func (f *fakeSchema) migrations() []migration  { return nil }
+func (f *fakeSchema) seriesQuery() string      { return "" }
+
+func (f *fakeSchema) ensureTables(ctx context.Context, samples []format.Sample) error {
+    return nil
+}
+
+func (f *fakeSchema) insert(ctx context.Context, conn *sql.Conn, tx *sql.Tx, samples []format.Sample) (func(), error) {
+    for i := range samples {
+        if f.refuse != nil {
+            if err := f.refuse(&samples[i]); err != nil {
+                return nil, err
+            }
+        }
+    }
+    return func() {
+        f.mtx.Lock()
+        defer f.mtx.Unlock()
+        f.written = append(f.written, samples...)
+    }, nil
+}
+
+func (f *fakeSchema) count() int {
+    f.mtx.Lock()
+    defer f.mtx.Unlock()
+    return len(f.written)
+}
+
+func (f *fakeSchema) valueTables(ctx context.Context) ([]valueTable, error) {
+    return nil, nil
+}
+
+// Opens a database on a fake server that records the queries in queries
+// if it isn't nil. params are added to the DSN as key, value pairs.
+func openFakeDB(t *testing.T, queries *fakeLog, params ...string) *sql.DB {
+    addr, stop := startLoggingServer(t, queries)
+    t.Cleanup(stop)
+
+    dsn := fmt.Sprintf("postgres://test@%s/test?sslmode=disable", addr)
+    for i := 0; i+1 < len(params); i += 2 {
+        dsn = appendConnParam(dsn, params[i], params[i+1])
+    }
+
+    db, err := sql.Open(DRIVER_PQ, dsn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { db.Close() })
+    return db
+}
+
+// Creates a client writing through the fake server of the copy benchmark
+func newFakeClient(t *testing.T, name string, schema schema, queries *fakeLog) *Client {
+    cfg := &Config{name: name, writeRetry: 1, writeTimeout: 10 * time.Second, dedupe: DEDUPE_OFF}
+    return &Client{DB: openFakeDB(t, queries), cfg: cfg, schema: schema}
+}
+
+func TestIsDataError(t *testing.T) {
+    tests := []struct {
+        name  string
+        err   error
+        want  bool
+    }{
+        {"lib/pq data exception", &pq.Error{Code: "22008"}, true},
+        {"pgx data exception", &pgconn.PgError{Code: "22P02"}, true},
+        {"wrapped", fmt.Errorf("copy failed: %w", &pq.Error{Code: "22021"}), true},
+        {"serialization failure", &pq.Error{Code: "40001"}, false},
+        {"pgx unique violation", &pgconn.PgError{Code: "23505"}, false},
+        {"other error", fmt.Errorf("connection refused"), false},
+    }
+
+    for _, tt := range tests {
+        if got := isDataError(tt.err); got != tt.want {
+            t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestInsertRejecting(t *testing.T) {
+    ts := time.Unix(1600000000, 0).UTC()
+    samples := make([]format.Sample, 10)
+    for i := range samples {
+        samples[i] = format.Sample{Name: "up", Labels: map[string]string{}, Value: float64(i), Timestamp: ts}
+    }
+
+    tests := []struct {
+        name     string
+        refuse   func(s *format.Sample) error
+        written  int
+        failed   int
+        err      bool
+    }{
+        {"all written", nil, 10, 0, false},
+        {"refused values skipped", func(s *format.Sample) error {
+            if s.Value == 3 || s.Value == 7 {
+                return &pq.Error{Code: "22008", Message: "timestamp out of range"}
+            }
+            return nil
+        }, 8, 0, false},
+        {"other errors fail", func(s *format.Sample) error {
+            return &pq.Error{Code: "40001", Message: "could not serialize access"}
+        }, 0, 10, true},
+        {"other errors fail their half", func(s *format.Sample) error {
+            switch {
+            case s.Value == 1:
+                return &pq.Error{Code: "22008", Message: "timestamp out of range"}
+            case s.Value >= 5:
+                return &pq.Error{Code: "40001", Message: "could not serialize access"}
+            }
+            return nil
+        }, 4, 5, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            fs := &fakeSchema{refuse: tt.refuse}
+            c := newFakeClient(t, "test", fs, nil)
+
+            written, failed, err := c.insertRejecting(context.Background(), samples)
+            if tt.err != (err != nil) {
+                t.Fatalf("unexpected error %v", err)
+            }
+            if written != tt.written || fs.count() != tt.written {
+                t.Errorf("got %d samples written, %d committed, want %d", written, fs.count(), tt.written)
+            }
+            if len(failed) != tt.failed {
+                t.Errorf("got %d failed samples, want %d", len(failed), tt.failed)
+            }
+            for i := range samples {
+                if samples[i].Value != float64(i) {
+                    t.Fatal("expected the samples passed in to stay unchanged")
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,67 @@
+package pgdb
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Builds the connection string from the configuration. A DSN, in the
+// key/value or the URL form, is used as it is. Several hosts can be
+// given separated by commas, which like target_session_attrs only pgx
+// supports.
+func connString(cfg *Config) (string, error) {
+    if len(cfg.dsn) > 0 {
+        dsn := cfg.dsn
+        if cfg.pgbouncer {
+            params := pgbouncerParams(cfg.driver)
+            dsn = appendConnParam(dsn, params[0], params[1])
+        }
+        return dsn, nil
+    }
+
+    if strings.Contains(cfg.host, ",") && cfg.driver != DRIVER_PGX {
+        return "", fmt.Errorf("Connecting to several hosts needs PG_DRIVER=%s", DRIVER_PGX)
+    }
+
+    // lib/pq would pass it on to the server, which refuses it
+    if len(cfg.targetSessionAttrs) > 0 && cfg.driver != DRIVER_PGX {
+        return "", fmt.Errorf("PG_TARGET_SESSION_ATTRS needs PG_DRIVER=%s", DRIVER_PGX)
+    }
+
+    params := []string{
+        "host", cfg.host,
+        "port", fmt.Sprintf("%d", cfg.port),
+        "user", cfg.username,
+        "dbname", cfg.database,
+        "password", cfg.password,
+        "sslmode", cfg.sslMode,
+        "sslrootcert", cfg.sslRootCert,
+        "sslcert", cfg.sslCert,
+        "sslkey", cfg.sslKey,
+        "target_session_attrs", cfg.targetSessionAttrs,
+        "connect_timeout", "10",
+    }
+    if cfg.pgbouncer {
+        params = append(params, pgbouncerParams(cfg.driver)...)
+    }
+
+    var b strings.Builder
+    for i := 0; i < len(params); i += 2 {
+        if len(params[i+1]) == 0 && params[i] != "password" {
+            continue
+        }
+        if b.Len() > 0 {
+            b.WriteByte(' ')
+        }
+        b.WriteString(params[i])
+        b.WriteByte('=')
+        b.WriteString(quoteConnValue(params[i+1]))
+    }
+    return b.String(), nil
+}
+
+// Values of a key/value connection string are quoted, with quotes and
+// backslashes in them escaped
+func quoteConnValue(v string) string {
+    return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
@@ -0,0 +1,60 @@
+package pgdb
+
+import (
+    "testing"
+)
+
+func TestConnString(t *testing.T) {
+    base := func() Config {
+        return Config{host: "localhost", port: 5432, username: "postgres", database: "metrics", sslMode: "disable", driver: DRIVER_PQ}
+    }
+
+    tests := []struct {
+        name    string
+        cfg     func(cfg *Config)
+        want    string
+        err     bool
+    }{
+        {"defaults", func(cfg *Config) {},
+            "host='localhost' port='5432' user='postgres' dbname='metrics' password='' sslmode='disable' connect_timeout='10'", false},
+        {"quoted password", func(cfg *Config) { cfg.password = `it's a \secret` },
+            `host='localhost' port='5432' user='postgres' dbname='metrics' password='it\'s a \\secret' sslmode='disable' connect_timeout='10'`, false},
+        {"certificates", func(cfg *Config) { cfg.sslMode, cfg.sslRootCert = "verify-full", "/etc/ssl/ca.pem" },
+            "host='localhost' port='5432' user='postgres' dbname='metrics' password='' sslmode='verify-full' sslrootcert='/etc/ssl/ca.pem' connect_timeout='10'", false},
+        {"several hosts with pgx", func(cfg *Config) { cfg.driver, cfg.host, cfg.targetSessionAttrs = DRIVER_PGX, "a,b", "read-write" },
+            "host='a,b' port='5432' user='postgres' dbname='metrics' password='' sslmode='disable' target_session_attrs='read-write' connect_timeout='10'", false},
+        {"several hosts with lib/pq", func(cfg *Config) { cfg.host = "a,b" }, "", true},
+        {"target session attrs with lib/pq", func(cfg *Config) { cfg.targetSessionAttrs = "read-write" }, "", true},
+        {"pgbouncer with lib/pq", func(cfg *Config) { cfg.pgbouncer = true },
+            "host='localhost' port='5432' user='postgres' dbname='metrics' password='' sslmode='disable' connect_timeout='10' binary_parameters='yes'", false},
+        {"pgbouncer with pgx", func(cfg *Config) { cfg.pgbouncer, cfg.driver = true, DRIVER_PGX },
+            "host='localhost' port='5432' user='postgres' dbname='metrics' password='' sslmode='disable' connect_timeout='10' prefer_simple_protocol='true'", false},
+        {"dsn", func(cfg *Config) { cfg.dsn = "postgres://u@db/metrics?sslmode=require" },
+            "postgres://u@db/metrics?sslmode=require", false},
+        {"url dsn with pgbouncer", func(cfg *Config) { cfg.dsn, cfg.pgbouncer = "postgres://u@db/metrics?sslmode=require", true },
+            "postgres://u@db/metrics?sslmode=require&binary_parameters=yes", false},
+        {"key/value dsn with pgbouncer", func(cfg *Config) { cfg.dsn, cfg.pgbouncer, cfg.driver = "host=db", true, DRIVER_PGX },
+            "host=db prefer_simple_protocol='true'", false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cfg := base()
+            tt.cfg(&cfg)
+
+            got, err := connString(&cfg)
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("expected an error, got %s", got)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if got != tt.want {
+                t.Errorf("got  %s\nwant %s", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,311 @@
+package pgdb
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "bytes"
+    "errors"
+    "context"
+    "unicode/utf8"
+    "database/sql"
+
+    "github.com/lib/pq"
+    "github.com/jackc/pgconn"
+    "github.com/jackc/pgx/v4"
+    "github.com/jackc/pgx/v4/stdlib"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+)
+
+const (
+    DRIVER_PQ  = "postgres"
+    DRIVER_PGX = "pgx"
+)
+
+// Columns of the tables samples are staged in
+var stagingColumns = []string{"time", "value", "name", "labels"}
+
+// A copier streams samples into a table within the transaction tx that
+// was started on conn. Samples are either copied into the staging
+// columns, as lines of the pg_prometheus text format or, with the ids
+// of their series, into the time, value and id columns of a table given
+// by its name and optionally its schema.
+type copier interface {
+    copySamples(ctx context.Context, conn *sql.Conn, tx *sql.Tx, table string, samples []format.Sample) error
+    copyValues(ctx context.Context, conn *sql.Conn, tx *sql.Tx, table []string, columns []string, samples []format.Sample, ids []int64) error
+    copyLines(ctx context.Context, conn *sql.Conn, tx *sql.Tx, table string, samples []format.Sample) error
+}
+
+func newCopier(driver string) (copier, error) {
+    switch driver {
+    case DRIVER_PQ:
+        return &pqCopier{}, nil
+    case DRIVER_PGX:
+        return &pgxCopier{}, nil
+    }
+    return nil, fmt.Errorf("Unknown database driver %q", driver)
+}
+
+// Copies row by row through the COPY support of lib/pq, which sends
+// every row in the text format
+type pqCopier struct{}
+
+func (p *pqCopier) copySamples(ctx context.Context, conn *sql.Conn, tx *sql.Tx, table string, samples []format.Sample) error {
+    stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, stagingColumns...))
+    if err != nil {
+        return err
+    }
+
+    for i := range samples {
+        s := &samples[i]
+        _, err = stmt.ExecContext(ctx, s.Timestamp, format.FormatValue(s.Value), s.Name, formatLabels(s.Labels))
+        if err != nil {
+            stmt.Close()
+            return err
+        }
+    }
+    return closeCopy(ctx, stmt)
+}
+
+func (p *pqCopier) copyValues(ctx context.Context, conn *sql.Conn, tx *sql.Tx, table []string, columns []string, samples []format.Sample, ids []int64) error {
+    query := pq.CopyIn(table[0], columns...)
+    if len(table) == 2 {
+        query = pq.CopyInSchema(table[0], table[1], columns...)
+    }
+
+    stmt, err := tx.PrepareContext(ctx, query)
+    if err != nil {
+        return err
+    }
+
+    for i := range samples {
+        s := &samples[i]
+        _, err = stmt.ExecContext(ctx, s.Timestamp, format.FormatValue(s.Value), ids[i])
+        if err != nil {
+            stmt.Close()
+            return err
+        }
+    }
+    return closeCopy(ctx, stmt)
+}
+
+func (p *pqCopier) copyLines(ctx context.Context, conn *sql.Conn, tx *sql.Tx, table string, samples []format.Sample) error {
+    stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(sqlCopyTable, table))
+    if err != nil {
+        return err
+    }
+
+    for i := range samples {
+        _, err = stmt.ExecContext(ctx, formatSample(&samples[i]))
+        if err != nil {
+            stmt.Close()
+            return err
+        }
+    }
+    return closeCopy(ctx, stmt)
+}
+
+// Tells whether PostgreSQL refused a value of a row, e.g. a timestamp
+// out of its range, an error of SQLSTATE class 22. Retrying the rows
+// as they are fails the same way.
+func isDataError(err error) bool {
+    var pqErr *pq.Error
+    if errors.As(err, &pqErr) {
+        return pqErr.Code.Class() == "22"
+    }
+    var pgErr *pgconn.PgError
+    if errors.As(err, &pgErr) {
+        return len(pgErr.Code) == 5 && pgErr.Code[:2] == "22"
+    }
+    return false
+}
+
+// An Exec without arguments ends a COPY of lib/pq
+func closeCopy(ctx context.Context, stmt *sql.Stmt) error {
+    _, err := stmt.ExecContext(ctx)
+    if err != nil {
+        stmt.Close()
+        return err
+    }
+    return stmt.Close()
+}
+
+// Copies through the connection of pgx underneath database/sql. Staged
+// samples are streamed with the binary COPY protocol, lines are written
+// to a buffer and streamed in the text format. Row values and buffers
+// are reused across batches.
+type pgxCopier struct {
+    sources  sync.Pool
+    buffers  sync.Pool
+}
+
+func (p *pgxCopier) copySamples(ctx context.Context, conn *sql.Conn, tx *sql.Tx, table string, samples []format.Sample) error {
+    src, ok := p.sources.Get().(*sampleSource)
+    if !ok {
+        src = &sampleSource{row: make([]interface{}, len(stagingColumns))}
+    }
+    src.samples, src.next = samples, 0
+    defer func() {
+        src.samples = nil
+        p.sources.Put(src)
+    }()
+
+    return conn.Raw(func(dc interface{}) error {
+        _, err := dc.(*stdlib.Conn).Conn().CopyFrom(ctx, pgx.Identifier{table}, stagingColumns, src)
+        return err
+    })
+}
+
+func (p *pgxCopier) copyValues(ctx context.Context, conn *sql.Conn, tx *sql.Tx, table []string, columns []string, samples []format.Sample, ids []int64) error {
+    src := &valueSource{samples: samples, ids: ids, row: make([]interface{}, len(columns))}
+
+    return conn.Raw(func(dc interface{}) error {
+        _, err := dc.(*stdlib.Conn).Conn().CopyFrom(ctx, pgx.Identifier(table), columns, src)
+        return err
+    })
+}
+
+func (p *pgxCopier) copyLines(ctx context.Context, conn *sql.Conn, tx *sql.Tx, table string, samples []format.Sample) error {
+    buf, ok := p.buffers.Get().(*bytes.Buffer)
+    if !ok {
+        buf = &bytes.Buffer{}
+    }
+    buf.Reset()
+    defer p.buffers.Put(buf)
+
+    for i := range samples {
+        appendCopyText(buf, formatSample(&samples[i]))
+        buf.WriteByte('\n')
+    }
+
+    return conn.Raw(func(dc interface{}) error {
+        _, err := dc.(*stdlib.Conn).Conn().PgConn().CopyFrom(ctx, buf, fmt.Sprintf(sqlCopyTable, table))
+        return err
+    })
+}
+
+// Hands the samples over to pgx.CopyFrom one row at a time. pgx encodes
+// a row before asking for the next one, so the row and the labels
+// buffer are reused.
+type sampleSource struct {
+    samples  []format.Sample
+    next     int
+    row      []interface{}
+    labels   []byte
+    keys     []string
+}
+
+func (s *sampleSource) Next() bool {
+    s.next++
+    return s.next <= len(s.samples)
+}
+
+func (s *sampleSource) Values() ([]interface{}, error) {
+    smp := &s.samples[s.next-1]
+    s.labels, s.keys = appendLabelsJSON(s.labels[:0], s.keys[:0], smp.Labels)
+
+    s.row[0] = smp.Timestamp
+    s.row[1] = smp.Value
+    s.row[2] = smp.Name
+    s.row[3] = s.labels
+    return s.row, nil
+}
+
+func (s *sampleSource) Err() error {
+    return nil
+}
+
+// Hands samples over to pgx.CopyFrom together with the ids of their
+// series
+type valueSource struct {
+    samples  []format.Sample
+    ids      []int64
+    next     int
+    row      []interface{}
+}
+
+func (s *valueSource) Next() bool {
+    s.next++
+    return s.next <= len(s.samples)
+}
+
+func (s *valueSource) Values() ([]interface{}, error) {
+    smp := &s.samples[s.next-1]
+
+    s.row[0] = smp.Timestamp
+    s.row[1] = smp.Value
+    s.row[2] = s.ids[s.next-1]
+    return s.row, nil
+}
+
+func (s *valueSource) Err() error {
+    return nil
+}
+
+// Escapes the characters that have a meaning in the COPY text format
+func appendCopyText(buf *bytes.Buffer, s string) {
+    for i := 0; i < len(s); i++ {
+        switch c := s[i]; c {
+        case '\\':
+            buf.WriteString(`\\`)
+        case '\n':
+            buf.WriteString(`\n`)
+        case '\r':
+            buf.WriteString(`\r`)
+        case '\t':
+            buf.WriteString(`\t`)
+        default:
+            buf.WriteByte(c)
+        }
+    }
+}
+
+// Appends labels as a JSON object with sorted keys, keys is scratch
+// space for the sort and returned for reuse
+func appendLabelsJSON(buf []byte, keys []string, labels map[string]string) ([]byte, []string) {
+    for k := range labels {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    buf = append(buf, '{')
+    for i, k := range keys {
+        if i > 0 {
+            buf = append(buf, ',')
+        }
+        buf = appendJSONString(buf, k)
+        buf = append(buf, ':')
+        buf = appendJSONString(buf, labels[k])
+    }
+    return append(buf, '}'), keys
+}
+
+func appendJSONString(buf []byte, s string) []byte {
+    const hex = "0123456789abcdef"
+
+    buf = append(buf, '"')
+    for i := 0; i < len(s); {
+        c := s[i]
+        if c >= utf8.RuneSelf {
+            r, size := utf8.DecodeRuneInString(s[i:])
+            if r == utf8.RuneError && size == 1 {
+                buf = append(buf, `�`...)
+            } else {
+                buf = append(buf, s[i:i+size]...)
+            }
+            i += size
+            continue
+        }
+        switch {
+        case c == '"' || c == '\\':
+            buf = append(buf, '\\', c)
+        case c < 0x20:
+            buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+        default:
+            buf = append(buf, c)
+        }
+        i++
+    }
+    return append(buf, '"')
+}
@@ -0,0 +1,364 @@
+package pgdb
+
+import (
+    "os"
+    "fmt"
+    "net"
+    "sync"
+    "regexp"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+    "context"
+    "database/sql"
+
+    "github.com/jackc/pgproto3/v2"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+)
+
+// Compares the copiers on the same staged batch. Without BENCH_PG_URL
+// the batch goes to an in-process server that speaks just enough of the
+// protocol to accept a COPY and discards the rows, which measures the
+// encoding and the protocol overhead of the drivers. With BENCH_PG_URL
+// set, e.g. to postgres://localhost/bench?sslmode=disable, the rows are
+// copied into a temporary table of that server.
+func BenchmarkCopySamples(b *testing.B) {
+    url := os.Getenv("BENCH_PG_URL")
+    if len(url) == 0 {
+        addr, stop := startFakeServer(b)
+        defer stop()
+        url = fmt.Sprintf("postgres://bench@%s/bench?sslmode=disable", addr)
+    }
+
+    samples := benchSamples(10000)
+    for _, driver := range []string{DRIVER_PQ, DRIVER_PGX} {
+        b.Run(driver, func(b *testing.B) {
+            benchmarkCopier(b, driver, url, samples)
+        })
+    }
+}
+
+func benchmarkCopier(b *testing.B, driver string, url string, samples []format.Sample) {
+    ctx := context.Background()
+    cp, err := newCopier(driver)
+    if err != nil {
+        b.Fatal(err)
+    }
+
+    db, err := sql.Open(driver, url)
+    if err != nil {
+        b.Fatal(err)
+    }
+    defer db.Close()
+
+    conn, err := db.Conn(ctx)
+    if err != nil {
+        b.Fatal(err)
+    }
+    defer conn.Close()
+
+    _, err = conn.ExecContext(ctx, "CREATE TEMPORARY TABLE IF NOT EXISTS bench_staging (time TIMESTAMPTZ, value DOUBLE PRECISION, name TEXT, labels JSONB)")
+    if err != nil {
+        b.Fatal(err)
+    }
+
+    b.ReportAllocs()
+    b.ResetTimer()
+    begin := time.Now()
+    for i := 0; i < b.N; i++ {
+        tx, err := conn.BeginTx(ctx, nil)
+        if err != nil {
+            b.Fatal(err)
+        }
+        err = cp.copySamples(ctx, conn, tx, "bench_staging", samples)
+        if err != nil {
+            b.Fatal(err)
+        }
+        if err = tx.Rollback(); err != nil {
+            b.Fatal(err)
+        }
+    }
+    b.ReportMetric(float64(b.N*len(samples))/time.Since(begin).Seconds(), "samples/s")
+}
+
+func benchSamples(n int) []format.Sample {
+    ts := time.Unix(1600000000, 0).UTC()
+    samples := make([]format.Sample, n)
+    for i := range samples {
+        samples[i] = format.Sample{
+            Name      : fmt.Sprintf("http_requests_total_%d", i%50),
+            Labels    : map[string]string{"job": "api", "instance": fmt.Sprintf("10.0.0.%d:9090", i%200), "code": "200"},
+            Value     : float64(i) * 1.5,
+            Timestamp : ts.Add(time.Duration(i) * time.Millisecond),
+        }
+    }
+    return samples
+}
+
+// Queries a fake server received, with the arguments of those that had
+// any, and the queries of the statements prepared under a name. Queries
+// containing fail, if set, are answered with an error, and queries
+// answer returns columns for are answered with its rows.
+type fakeLog struct {
+    mtx       sync.Mutex
+    queries   []string
+    prepared  []string
+    fail      string
+    answer    func(query string, args []string) ([]string, [][]string)
+}
+
+func (l *fakeLog) prepare(name string, query string) {
+    if l == nil || len(name) == 0 {
+        return
+    }
+    l.mtx.Lock()
+    defer l.mtx.Unlock()
+    l.prepared = append(l.prepared, query)
+}
+
+func (l *fakeLog) record(query string, args []string) bool {
+    if l == nil {
+        return true
+    }
+    if len(args) > 0 {
+        query += " -- " + strings.Join(args, ", ")
+    }
+    l.mtx.Lock()
+    defer l.mtx.Unlock()
+    l.queries = append(l.queries, query)
+    return len(l.fail) == 0 || !strings.Contains(query, l.fail)
+}
+
+func (l *fakeLog) rows(query string, args []string) ([]string, [][]string) {
+    if l == nil || l.answer == nil {
+        return nil, nil
+    }
+    return l.answer(query, args)
+}
+
+func (l *fakeLog) count(substr string) int {
+    return len(l.matching(substr))
+}
+
+// The queries containing substr, in the order they were received
+func (l *fakeLog) matching(substr string) []string {
+    l.mtx.Lock()
+    defer l.mtx.Unlock()
+    var queries []string
+    for _, q := range l.queries {
+        if strings.Contains(q, substr) {
+            queries = append(queries, q)
+        }
+    }
+    return queries
+}
+
+// Types of the columns the fake server describes for pgx, which looks
+// them up before a binary COPY
+var fakeColumnTypes = map[string]uint32{
+    "time"   : 1184,
+    "value"  : 701,
+    "name"   : 25,
+    "labels" : 3802,
+    "id"     : 20,
+}
+
+func startFakeServer(tb testing.TB) (string, func()) {
+    return startLoggingServer(tb, nil)
+}
+
+func startLoggingServer(tb testing.TB, queries *fakeLog) (string, func()) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        tb.Fatal(err)
+    }
+
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go serveFake(conn, queries)
+        }
+    }()
+    return ln.Addr().String(), func() { ln.Close() }
+}
+
+func serveFake(conn net.Conn, queries *fakeLog) {
+    defer conn.Close()
+
+    be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+    if _, err := be.ReceiveStartupMessage(); err != nil {
+        return
+    }
+    be.Send(&pgproto3.AuthenticationOk{})
+    be.Send(&pgproto3.ParameterStatus{Name: "server_version", Value: "12.0"})
+    be.Send(&pgproto3.ParameterStatus{Name: "standard_conforming_strings", Value: "on"})
+    be.Send(&pgproto3.ParameterStatus{Name: "client_encoding", Value: "UTF8"})
+    be.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+
+    status := byte('I')
+    statements := make(map[string]string)
+    portals := make(map[string]string)
+    args := make(map[string][]string)
+    for {
+        msg, err := be.Receive()
+        if err != nil {
+            return
+        }
+
+        switch m := msg.(type) {
+        case *pgproto3.Query:
+            q := strings.ToUpper(strings.TrimSpace(m.String))
+            if !queries.record(m.String, nil) {
+                // A failed COMMIT ends the transaction like a ROLLBACK
+                switch {
+                case strings.HasPrefix(q, "COMMIT"):
+                    status = 'I'
+                case status == 'T':
+                    status = 'E'
+                }
+                be.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "XX000", Message: "fake failure"})
+                be.Send(&pgproto3.ReadyForQuery{TxStatus: status})
+                continue
+            }
+            switch {
+            case strings.HasPrefix(q, "COPY"):
+                var f byte
+                if strings.Contains(q, "BINARY") {
+                    f = 1
+                }
+                be.Send(&pgproto3.CopyInResponse{OverallFormat: f, ColumnFormatCodes: []uint16{uint16(f), uint16(f), uint16(f), uint16(f)}})
+                continue
+            case strings.HasPrefix(q, "BEGIN"):
+                status = 'T'
+            case strings.HasPrefix(q, "COMMIT"), strings.HasPrefix(q, "ROLLBACK"):
+                status = 'I'
+            }
+            if cols, rows := queries.rows(m.String, nil); cols != nil {
+                sendFakeRows(be, cols, rows)
+            } else {
+                be.Send(&pgproto3.CommandComplete{CommandTag: []byte(strings.Fields(q)[0])})
+            }
+            be.Send(&pgproto3.ReadyForQuery{TxStatus: status})
+        case *pgproto3.Parse:
+            statements[m.Name] = m.Query
+            queries.prepare(m.Name, m.Query)
+            be.Send(&pgproto3.ParseComplete{})
+        case *pgproto3.Describe:
+            // Portals are bound, only statements describe their parameters
+            query := portals[m.Name]
+            if m.ObjectType == 'S' {
+                query = statements[m.Name]
+                be.Send(fakeParameterDescription(query))
+            }
+            if cols, _ := queries.rows(query, nil); cols != nil {
+                be.Send(fakeColumns(cols))
+            } else if strings.HasPrefix(query, "select ") {
+                be.Send(fakeRowDescription(query))
+            } else {
+                be.Send(&pgproto3.NoData{})
+            }
+        case *pgproto3.Bind:
+            portals[m.DestinationPortal] = statements[m.PreparedStatement]
+            values := make([]string, len(m.Parameters))
+            for i, p := range m.Parameters {
+                values[i] = string(p)
+            }
+            args[m.DestinationPortal] = values
+            be.Send(&pgproto3.BindComplete{})
+        case *pgproto3.Execute:
+            query := portals[m.Portal]
+            if !queries.record(query, args[m.Portal]) {
+                be.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "XX000", Message: "fake failure"})
+                status = 'E'
+                continue
+            }
+            if cols, rows := queries.rows(query, args[m.Portal]); cols != nil {
+                for _, row := range rows {
+                    be.Send(fakeDataRow(row))
+                }
+                be.Send(&pgproto3.CommandComplete{CommandTag: []byte(fmt.Sprintf("SELECT %d", len(rows)))})
+            } else {
+                be.Send(&pgproto3.CommandComplete{CommandTag: []byte("INSERT 0 1")})
+            }
+        case *pgproto3.Close:
+            if m.ObjectType == 'S' {
+                delete(statements, m.Name)
+            } else {
+                delete(portals, m.Name)
+            }
+            be.Send(&pgproto3.CloseComplete{})
+        case *pgproto3.Sync:
+            be.Send(&pgproto3.ReadyForQuery{TxStatus: status})
+        case *pgproto3.CopyDone:
+            be.Send(&pgproto3.CommandComplete{CommandTag: []byte("COPY 0")})
+            be.Send(&pgproto3.ReadyForQuery{TxStatus: status})
+        case *pgproto3.CopyFail:
+            be.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "57014", Message: m.Message})
+            be.Send(&pgproto3.ReadyForQuery{TxStatus: status})
+        case *pgproto3.Terminate:
+            return
+        }
+    }
+}
+
+func sendFakeRows(be *pgproto3.Backend, cols []string, rows [][]string) {
+    be.Send(fakeColumns(cols))
+    for _, row := range rows {
+        be.Send(fakeDataRow(row))
+    }
+    be.Send(&pgproto3.CommandComplete{CommandTag: []byte(fmt.Sprintf("SELECT %d", len(rows)))})
+}
+
+// Describes text columns, columns named *_at are timestamps
+func fakeColumns(cols []string) *pgproto3.RowDescription {
+    desc := &pgproto3.RowDescription{}
+    for _, col := range cols {
+        oid := uint32(25)
+        if strings.HasSuffix(col, "_at") {
+            oid = 1184
+        }
+        desc.Fields = append(desc.Fields, pgproto3.FieldDescription{Name: []byte(col), DataTypeOID: oid, DataTypeSize: -1})
+    }
+    return desc
+}
+
+func fakeDataRow(row []string) *pgproto3.DataRow {
+    values := make([][]byte, len(row))
+    for i, v := range row {
+        values[i] = []byte(v)
+    }
+    return &pgproto3.DataRow{Values: values}
+}
+
+var fakeParameterRE = regexp.MustCompile(`\$[0-9]+`)
+
+// Describes the $n parameters of a query as text
+func fakeParameterDescription(query string) *pgproto3.ParameterDescription {
+    n := 0
+    for _, p := range fakeParameterRE.FindAllString(query, -1) {
+        if i, _ := strconv.Atoi(p[1:]); i > n {
+            n = i
+        }
+    }
+    desc := &pgproto3.ParameterDescription{}
+    for i := 0; i < n; i++ {
+        desc.ParameterOIDs = append(desc.ParameterOIDs, 25)
+    }
+    return desc
+}
+
+// Describes the columns of "select a, b from t"
+func fakeRowDescription(query string) *pgproto3.RowDescription {
+    desc := &pgproto3.RowDescription{}
+    cols := strings.TrimPrefix(strings.SplitN(query, " from ", 2)[0], "select ")
+    for _, col := range strings.Split(cols, ",") {
+        col = strings.Trim(strings.TrimSpace(col), `"`)
+        desc.Fields = append(desc.Fields, pgproto3.FieldDescription{Name: []byte(col), DataTypeOID: fakeColumnTypes[col], DataTypeSize: -1})
+    }
+    return desc
+}
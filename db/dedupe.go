@@ -0,0 +1,182 @@
+package pgdb
+
+import (
+    "fmt"
+    "time"
+    "strings"
+    "context"
+    "database/sql"
+
+    "github.com/prometheus/client_golang/prometheus"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+    "github.com/arslanm/kafka-timescaledb-adapter/log"
+)
+
+const (
+    DEDUPE_OFF    = "off"
+    DEDUPE_IGNORE = "ignore"
+    DEDUPE_UPDATE = "update"
+
+    sqlCreateUniqueIndex  = "CREATE UNIQUE INDEX IF NOT EXISTS \"%s_%s_time_key\" ON \"%s\" (%s, time);"
+    sqlCreateDedupeTable  = "CREATE TEMPORARY TABLE IF NOT EXISTS dedupe_values (time TIMESTAMPTZ, value DOUBLE PRECISION, id BIGINT) ON COMMIT DELETE ROWS;"
+    sqlInsertDedupe       = "INSERT INTO %s (time, value, %s) SELECT time, value, id FROM %s staged"
+
+    // Counts the rows an INSERT ... RETURNING wrote and how many of them
+    // updated a row that was there
+    sqlCountInserted      = "WITH w AS (%s RETURNING xmax::text::bigint <> 0 AS updated) SELECT count(*), count(*) FILTER (WHERE updated) FROM w;"
+)
+
+// Columns samples are staged in before they are inserted into a table
+// with a unique index
+var dedupeColumns = []string{"time", "value", "id"}
+
+var duplicateSamples = prometheus.NewCounterVec(
+    prometheus.CounterOpts{
+        Namespace : "kafka_timescale_adapter",
+        Name      : "duplicate_samples_total",
+        Help      : "Total number of samples whose series and time were already in the batch or in the database.",
+    },
+    []string{"remote", "stage"},
+)
+
+// Creates the unique index on series and time a table needs for
+// conflicting inserts
+func (c *Client) createUniqueIndex(ctx context.Context, q querier, vt valueTable) error {
+    _, err := q.ExecContext(ctx, fmt.Sprintf(sqlCreateUniqueIndex, vt.name, vt.segmentBy, vt.name, vt.segmentBy))
+    return err
+}
+
+// Checks the dedupe mode and creates the unique indexes on the tables
+// samples are written to. Promscale and the samples table of pg_prometheus
+// have no series id to key on.
+func (c *Client) setupDedupe(ctx context.Context, tables []valueTable) error {
+    switch c.cfg.dedupe {
+    case DEDUPE_OFF:
+        return nil
+    case DEDUPE_IGNORE, DEDUPE_UPDATE:
+    default:
+        return fmt.Errorf("Unknown dedupe mode %q", c.cfg.dedupe)
+    }
+
+    if c.cfg.schemaMode == SCHEMA_PROMSCALE || len(tables) == 0 && c.cfg.schemaMode == SCHEMA_PG_PROMETHEUS {
+        return fmt.Errorf("Dedupe mode %q is not supported by this table layout", c.cfg.dedupe)
+    }
+
+    for _, vt := range tables {
+        err := c.createUniqueIndex(ctx, c.DB, vt)
+        if err != nil {
+            return fmt.Errorf("Can't create unique index on %s: %v", vt.name, err)
+        }
+    }
+    log.Info("msg", "Deduplicating samples", "mode", c.cfg.dedupe, "tables", len(tables))
+    return nil
+}
+
+// Removes the samples of a batch that have the series and time of
+// another sample. The first sample is kept when duplicates are ignored,
+// the last one when they update. TIMESTAMPTZ holds microseconds, so
+// timestamps are truncated to them first; otherwise samples less than a
+// microsecond apart would meet on the unique index, and an update would
+// fail the whole statement. Drivers round nanoseconds differently, so
+// the truncated timestamps are also the ones that are written.
+func (c *Client) dedupeBatch(samples []format.Sample) []format.Sample {
+    if c.cfg.dedupe == DEDUPE_OFF {
+        return samples
+    }
+
+    var labels []byte
+    var keys []string
+
+    index := make(map[string]int, len(samples))
+    deduped := make([]format.Sample, 0, len(samples))
+    for i := range samples {
+        s := samples[i]
+        s.Timestamp = s.Timestamp.Truncate(time.Microsecond)
+        labels, keys = appendLabelsJSON(labels[:0], keys[:0], s.Labels)
+        key := fmt.Sprintf("%s\x00%d", seriesKey(s.Name, labels), s.Timestamp.UnixNano())
+
+        if j, ok := index[key]; ok {
+            if c.cfg.dedupe == DEDUPE_UPDATE {
+                deduped[j] = s
+            }
+            continue
+        }
+        index[key] = len(deduped)
+        deduped = append(deduped, s)
+    }
+
+    if n := len(samples) - len(deduped); n > 0 {
+        duplicateSamples.WithLabelValues(c.Name(), "batch").Add(float64(n))
+    }
+    return deduped
+}
+
+// What an INSERT does with a sample whose series and time are in the
+// table
+func (c *Client) conflictClause(idColumn string) string {
+    switch c.cfg.dedupe {
+    case DEDUPE_IGNORE:
+        return fmt.Sprintf(" ON CONFLICT (%s, time) DO NOTHING", idColumn)
+    case DEDUPE_UPDATE:
+        return fmt.Sprintf(" ON CONFLICT (%s, time) DO UPDATE SET value = EXCLUDED.value", idColumn)
+    }
+    return ""
+}
+
+// Runs an INSERT of count samples with the conflict clause and counts
+// the samples that were in the table already. insert has no trailing
+// semicolon.
+func (c *Client) insertDeduped(ctx context.Context, tx *sql.Tx, insert string, idColumn string, count int) error {
+    insert += c.conflictClause(idColumn)
+    if c.cfg.dedupe == DEDUPE_OFF {
+        _, err := tx.ExecContext(ctx, insert)
+        return err
+    }
+
+    var written, updated int
+    err := tx.QueryRowContext(ctx, fmt.Sprintf(sqlCountInserted, insert)).Scan(&written, &updated)
+    if err != nil {
+        return err
+    }
+
+    if n := count - written + updated; n > 0 {
+        duplicateSamples.WithLabelValues(c.Name(), "table").Add(float64(n))
+    }
+    return nil
+}
+
+// Copies samples with the ids of their series into a table. With dedupe
+// COPY can't resolve conflicts, so the samples are staged and inserted
+// from there.
+func (c *Client) writeValues(ctx context.Context, conn *sql.Conn, tx *sql.Tx, table []string, idColumn string, samples []format.Sample, ids []int64) error {
+    if c.cfg.dedupe == DEDUPE_OFF {
+        return c.copier.copyValues(ctx, conn, tx, table, []string{"time", "value", idColumn}, samples, ids)
+    }
+
+    staging := c.valuesStaging()
+    if !c.cfg.pgbouncer {
+        _, err := tx.ExecContext(ctx, sqlCreateDedupeTable)
+        if err != nil {
+            return err
+        }
+    }
+
+    err := c.copier.copyValues(ctx, conn, tx, []string{staging}, dedupeColumns, samples, ids)
+    if err != nil {
+        return err
+    }
+
+    quoted := make([]string, len(table))
+    for i, part := range table {
+        quoted[i] = quoteIdent(part)
+    }
+
+    err = c.insertDeduped(ctx, tx, fmt.Sprintf(sqlInsertDedupe, strings.Join(quoted, "."), idColumn, c.stagedRows(staging)), idColumn, len(samples))
+    if err != nil {
+        return err
+    }
+
+    // Samples of several tables can be staged in one transaction
+    return c.clearStaged(ctx, tx, staging)
+}
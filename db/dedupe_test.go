@@ -0,0 +1,98 @@
+package pgdb
+
+import (
+    "reflect"
+    "testing"
+    "time"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+)
+
+func TestDedupeBatch(t *testing.T) {
+    ts := time.Unix(1600000000, 0).UTC()
+    api := map[string]string{"job": "api", "instance": "a:9090"}
+    apiReordered := map[string]string{"instance": "a:9090", "job": "api"}
+    db := map[string]string{"job": "db"}
+
+    samples := []format.Sample{
+        {Name: "up", Labels: api, Value: 1, Timestamp: ts},
+        {Name: "up", Labels: db, Value: 1, Timestamp: ts},
+        {Name: "up", Labels: apiReordered, Value: 0, Timestamp: ts},
+        {Name: "up", Labels: api, Value: 1, Timestamp: ts.Add(time.Second)},
+        {Name: "http_requests_total", Labels: api, Value: 5, Timestamp: ts},
+        {Name: "up", Labels: db, Value: 0, Timestamp: ts},
+    }
+
+    tests := []struct {
+        mode  string
+        want  []format.Sample
+    }{
+        {DEDUPE_OFF, samples},
+        {DEDUPE_IGNORE, []format.Sample{samples[0], samples[1], samples[3], samples[4]}},
+        {DEDUPE_UPDATE, []format.Sample{samples[2], samples[5], samples[3], samples[4]}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.mode, func(t *testing.T) {
+            c := &Client{cfg: &Config{dedupe: tt.mode}}
+            if got := c.dedupeBatch(samples); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("got %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestConflictClause(t *testing.T) {
+    tests := []struct {
+        mode  string
+        want  string
+    }{
+        {DEDUPE_OFF, ""},
+        {DEDUPE_IGNORE, " ON CONFLICT (series_id, time) DO NOTHING"},
+        {DEDUPE_UPDATE, " ON CONFLICT (series_id, time) DO UPDATE SET value = EXCLUDED.value"},
+    }
+
+    for _, tt := range tests {
+        c := &Client{cfg: &Config{dedupe: tt.mode}}
+        if got := c.conflictClause("series_id"); got != tt.want {
+            t.Errorf("%s: got %q, want %q", tt.mode, got, tt.want)
+        }
+    }
+}
+
+func TestDedupeBatchMicroseconds(t *testing.T) {
+    ts := time.Unix(1600000000, 123456000).UTC()
+    labels := map[string]string{"job": "api"}
+    samples := []format.Sample{
+        {Name: "up", Labels: labels, Value: 1, Timestamp: ts.Add(100 * time.Nanosecond)},
+        {Name: "up", Labels: labels, Value: 2, Timestamp: ts.Add(900 * time.Nanosecond)},
+        {Name: "up", Labels: labels, Value: 3, Timestamp: ts.Add(time.Microsecond)},
+    }
+
+    tests := []struct {
+        mode  string
+        want  []format.Sample
+    }{
+        {DEDUPE_IGNORE, []format.Sample{
+            {Name: "up", Labels: labels, Value: 1, Timestamp: ts},
+            {Name: "up", Labels: labels, Value: 3, Timestamp: ts.Add(time.Microsecond)},
+        }},
+        {DEDUPE_UPDATE, []format.Sample{
+            {Name: "up", Labels: labels, Value: 2, Timestamp: ts},
+            {Name: "up", Labels: labels, Value: 3, Timestamp: ts.Add(time.Microsecond)},
+        }},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.mode, func(t *testing.T) {
+            c := &Client{cfg: &Config{dedupe: tt.mode}}
+            if got := c.dedupeBatch(samples); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("got %v, want %v", got, tt.want)
+            }
+        })
+    }
+
+    if samples[0].Timestamp.Nanosecond() != 123456100 {
+        t.Error("expected the samples passed in to stay unchanged")
+    }
+}
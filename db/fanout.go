@@ -0,0 +1,285 @@
+package pgdb
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "strings"
+    "context"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+    "github.com/arslanm/kafka-timescaledb-adapter/log"
+    "github.com/arslanm/kafka-timescaledb-adapter/util"
+)
+
+const (
+    WRITE_POLICY_ALL     = "all"
+    WRITE_POLICY_PRIMARY = "primary"
+
+    DEFAULT_PG_TARGETS        = ""
+    DEFAULT_PG_WRITE_POLICY   = WRITE_POLICY_ALL
+    DEFAULT_PG_PRIMARY_TARGET = ""
+)
+
+// Config of the targets batches are written to
+type TargetsConfig struct {
+    targets     []Config
+    policy      string
+    primary     string
+    routing     string
+    shardRules  string
+}
+
+func GetTargetsConfig(cfg *TargetsConfig) *TargetsConfig {
+    names := make([]string, 0)
+    for _, name := range strings.Split(util.GetEnvWithDefault("PG_TARGETS", DEFAULT_PG_TARGETS), ",") {
+        if name = strings.TrimSpace(name); len(name) > 0 {
+            names = append(names, name)
+        }
+    }
+    if len(names) == 0 {
+        names = append(names, "")
+    }
+
+    cfg.targets = make([]Config, len(names))
+    for i, name := range names {
+        GetConfig(&cfg.targets[i], name)
+    }
+
+    cfg.policy = util.GetEnvWithDefault("PG_WRITE_POLICY", DEFAULT_PG_WRITE_POLICY)
+    cfg.primary = util.GetEnvWithDefault("PG_PRIMARY_TARGET", DEFAULT_PG_PRIMARY_TARGET)
+    cfg.routing = util.GetEnvWithDefault("PG_ROUTING", DEFAULT_PG_ROUTING)
+    cfg.shardRules = util.GetEnvWithDefault("PG_SHARD_RULES", DEFAULT_PG_SHARD_RULES)
+
+    return cfg
+}
+
+// Fanout decodes each batch once and writes it to every target. With the
+// all policy a batch succeeds once every target has committed it, with
+// the primary policy once the primary target has, while the others are
+// still written to and their failures only counted.
+//
+// With shard routing each sample is written to only one of the targets,
+// picked by the router, and a batch succeeds once every target has
+// committed its share.
+type Fanout struct {
+    Targets    []*Client
+    Decoder    format.Decoder
+    Whitelist  *util.Whitelist
+    policy     string
+    primary    *Client
+    router     *shardRouter
+}
+
+func NewFanout(cfg *TargetsConfig, wl *util.Whitelist, decoder format.Decoder) *Fanout {
+    if cfg.policy != WRITE_POLICY_ALL && cfg.policy != WRITE_POLICY_PRIMARY {
+        log.Error("error", fmt.Sprintf("Unknown write policy %q", cfg.policy))
+        os.Exit(1)
+    }
+
+    if cfg.routing != ROUTING_FANOUT && cfg.routing != ROUTING_SHARD {
+        log.Error("error", fmt.Sprintf("Unknown routing %q", cfg.routing))
+        os.Exit(1)
+    }
+
+    InitPromMetrics()
+
+    f := &Fanout{Decoder: decoder, Whitelist: wl, policy: cfg.policy}
+    for i := range cfg.targets {
+        c := NewClient(&cfg.targets[i])
+        f.Targets = append(f.Targets, c)
+
+        if c.cfg.name == cfg.primary {
+            f.primary = c
+        }
+    }
+
+    if f.primary == nil {
+        if len(cfg.primary) > 0 {
+            log.Error("error", fmt.Sprintf("Primary target %q is not in PG_TARGETS", cfg.primary))
+            os.Exit(1)
+        }
+        f.primary = f.Targets[0]
+    }
+
+    if cfg.routing == ROUTING_SHARD {
+        names := make([]string, len(f.Targets))
+        for i, c := range f.Targets {
+            names[i] = c.Name()
+        }
+
+        var err error
+        f.router, err = newShardRouter(names, cfg.shardRules)
+        if err != nil {
+            log.Error("error", err)
+            os.Exit(1)
+        }
+
+        log.Info("msg", "Sharding over targets", "targets", len(f.Targets), "rules", len(f.router.rules))
+        return f
+    }
+
+    log.Info("msg", "Writing to targets", "targets", len(f.Targets), "policy", f.policy, "primary", f.primary.Name())
+    return f
+}
+
+// Decodes the messages of a batch into the samples that are written.
+// Samples that are not whitelisted are dropped, messages and samples
+// that can't be written are counted and skipped.
+func (f *Fanout) Decode(metrics []format.Message, count int) []format.Sample {
+    receivedMetrics.Add(float64(count))
+
+    batch := make([]format.Sample, 0, len(metrics))
+    for i := range metrics {
+        samples, err := f.Decoder.Decode(&metrics[i])
+        if err != nil {
+            log.Error("msg", "Can't decode metric -- ignoring", "error", err)
+            rejectedMetrics.WithLabelValues(DEFAULT_TARGET_NAME, "decode").Inc()
+            continue
+        }
+
+        for j := range samples {
+            s := &samples[j]
+            if f.Whitelist != nil {
+                if !f.Whitelist.IsWhitelisted(s.Name) {
+                    continue
+                }
+            }
+
+            if reason := validateSample(s); reason != "" {
+                log.Debug("msg", "Invalid metric -- ignoring", "reason", reason, "sample", formatSample(s))
+                rejectedMetrics.WithLabelValues(DEFAULT_TARGET_NAME, reason).Inc()
+                continue
+            }
+
+            batch = append(batch, *s)
+        }
+    }
+    return batch
+}
+
+// Writes the samples to all targets at the same time and decides by the
+// write policy whether the batch succeeded. With the primary policy it
+// returns once the primary target is done, the others are written in
+// the background, each bounded by ctx and its own timeout and retries.
+// Metadata goes to every target, shards included, and is only marked as
+// written once all of them have it.
+func (f *Fanout) Write(ctx context.Context, id int, samples []format.Sample) error {
+    var metadata []format.Metadata
+    ack := func(bool) {}
+    if src, ok := f.Decoder.(format.MetadataSource); ok {
+        metadata, ack = src.Metadata()
+    }
+
+    shards := make([][]format.Sample, len(f.Targets))
+    if f.router != nil {
+        shards = f.shard(samples)
+    } else {
+        for i := range shards {
+            shards[i] = samples
+        }
+    }
+
+    errs := make([]error, len(f.Targets))
+    mdErrs := make([]error, len(f.Targets))
+    primaryDone := make(chan struct{})
+    primary := 0
+
+    var wg sync.WaitGroup
+    for i, c := range f.Targets {
+        if c == f.primary {
+            primary = i
+        }
+
+        wg.Add(1)
+        go func(i int, c *Client) {
+            defer wg.Done()
+            if c == f.primary {
+                defer close(primaryDone)
+            }
+
+            if f.router == nil || len(shards[i]) > 0 {
+                errs[i] = c.Write(ctx, id, shards[i])
+            }
+            if errs[i] == nil {
+                mdErrs[i] = c.writeMetadata(ctx, metadata)
+            } else {
+                mdErrs[i] = errs[i]
+            }
+        }(i, c)
+    }
+
+    // The metadata is due again unless every target has it
+    finish := func() {
+        written := true
+        for _, err := range mdErrs {
+            if err != nil {
+                written = false
+            }
+        }
+        ack(written)
+    }
+
+    if f.router == nil && f.policy == WRITE_POLICY_PRIMARY {
+        <-primaryDone
+        go func() {
+            wg.Wait()
+            for i, c := range f.Targets {
+                if errs[i] != nil && c != f.primary {
+                    log.Error("worker", id, "msg", "Failed to write batch to secondary target", "remote", c.Name(), "error", errs[i])
+                }
+            }
+            finish()
+        }()
+
+        if err := errs[primary]; err != nil {
+            return fmt.Errorf("Failed to write batch to %s: %v", f.primary.Name(), err)
+        }
+        return nil
+    }
+
+    wg.Wait()
+    finish()
+
+    var failed []string
+    for i, c := range f.Targets {
+        if errs[i] != nil {
+            failed = append(failed, fmt.Sprintf("%s: %v", c.Name(), errs[i]))
+        }
+    }
+
+    if len(failed) > 0 {
+        return fmt.Errorf("Failed to write batch to %s", strings.Join(failed, ", "))
+    }
+    return nil
+}
+
+// Splits the samples of a batch by the shard they are routed to
+func (f *Fanout) shard(samples []format.Sample) [][]format.Sample {
+    var labels []byte
+    var keys []string
+
+    shards := make([][]format.Sample, len(f.Targets))
+    ruled := make([]int, len(f.Targets))
+    for i := range samples {
+        var shard int
+        var rule bool
+        shard, rule, labels, keys = f.router.route(&samples[i], labels, keys)
+        shards[shard] = append(shards[shard], samples[i])
+        if rule {
+            ruled[shard]++
+        }
+    }
+
+    for i, c := range f.Targets {
+        routedSamples.WithLabelValues(c.Name(), "rule").Add(float64(ruled[i]))
+        routedSamples.WithLabelValues(c.Name(), "hash").Add(float64(len(shards[i]) - ruled[i]))
+    }
+    return shards
+}
+
+func (f *Fanout) Close() {
+    for _, c := range f.Targets {
+        c.Close()
+    }
+}
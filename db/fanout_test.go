@@ -0,0 +1,183 @@
+package pgdb
+
+import (
+    "testing"
+    "time"
+    "context"
+
+    "github.com/lib/pq"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+)
+
+// A decoder with metadata that reports every ack
+type metadataDecoder struct {
+    acks  chan bool
+}
+
+func (d *metadataDecoder) Decode(msg *format.Message) ([]format.Sample, error) {
+    return msg.Samples, nil
+}
+
+func (d *metadataDecoder) Metadata() ([]format.Metadata, func(written bool)) {
+    md := []format.Metadata{{Name: "up", Type: "gauge", Help: "Whether the target is up"}}
+    return md, func(written bool) { d.acks <- written }
+}
+
+func (d *metadataDecoder) ack(t *testing.T) bool {
+    select {
+    case written := <-d.acks:
+        return written
+    case <-time.After(5 * time.Second):
+        t.Fatal("expected the metadata to be acked")
+    }
+    return false
+}
+
+func refuseAll(s *format.Sample) error {
+    return &pq.Error{Code: "40001", Message: "could not serialize access"}
+}
+
+func fanoutSamples() []format.Sample {
+    ts := time.Unix(1600000000, 0).UTC()
+    return []format.Sample{
+        {Name: "up", Labels: map[string]string{"job": "api"}, Value: 1, Timestamp: ts},
+        {Name: "up", Labels: map[string]string{"job": "db"}, Value: 1, Timestamp: ts},
+    }
+}
+
+func TestFanoutWritePolicies(t *testing.T) {
+    tests := []struct {
+        name         string
+        policy       string
+        refuseA      func(s *format.Sample) error
+        refuseB      func(s *format.Sample) error
+        err          bool
+        written      bool
+    }{
+        {"all written", WRITE_POLICY_ALL, nil, nil, false, true},
+        {"all with failed secondary", WRITE_POLICY_ALL, nil, refuseAll, true, false},
+        {"all with failed primary", WRITE_POLICY_ALL, refuseAll, nil, true, false},
+        {"primary written", WRITE_POLICY_PRIMARY, nil, nil, false, true},
+        {"primary with failed secondary", WRITE_POLICY_PRIMARY, nil, refuseAll, false, false},
+        {"primary failed", WRITE_POLICY_PRIMARY, refuseAll, nil, true, false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            a := &fakeSchema{refuse: tt.refuseA}
+            b := &fakeSchema{refuse: tt.refuseB}
+            aQueries, bQueries := &fakeLog{}, &fakeLog{}
+            d := &metadataDecoder{acks: make(chan bool, 1)}
+
+            f := &Fanout{Decoder: d, policy: tt.policy}
+            f.Targets = []*Client{newFakeClient(t, "a", a, aQueries), newFakeClient(t, "b", b, bQueries)}
+            f.primary = f.Targets[0]
+
+            err := f.Write(context.Background(), 1, fanoutSamples())
+            if tt.err != (err != nil) {
+                t.Fatalf("unexpected error %v", err)
+            }
+            if written := d.ack(t); written != tt.written {
+                t.Errorf("got metadata written %v, want %v", written, tt.written)
+            }
+
+            // Metadata is only sent to targets that committed the samples
+            for _, target := range []struct {
+                schema   *fakeSchema
+                queries  *fakeLog
+            }{{a, aQueries}, {b, bQueries}} {
+                want := 0
+                if target.schema.count() > 0 {
+                    want = 1
+                }
+                if n := target.queries.count("_metadata"); n != want {
+                    t.Errorf("got %d metadata upserts, want %d", n, want)
+                }
+            }
+        })
+    }
+}
+
+func TestFanoutPrimaryDoesNotWait(t *testing.T) {
+    release := make(chan struct{})
+    slow := &fakeSchema{refuse: func(s *format.Sample) error {
+        <-release
+        return nil
+    }}
+    d := &metadataDecoder{acks: make(chan bool, 1)}
+
+    f := &Fanout{Decoder: d, policy: WRITE_POLICY_PRIMARY}
+    f.Targets = []*Client{newFakeClient(t, "a", &fakeSchema{}, nil), newFakeClient(t, "b", slow, nil)}
+    f.primary = f.Targets[0]
+
+    done := make(chan error, 1)
+    go func() {
+        done <- f.Write(context.Background(), 1, fanoutSamples())
+    }()
+
+    select {
+    case err := <-done:
+        if err != nil {
+            t.Fatal(err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("expected the batch to succeed before the secondary is done")
+    }
+
+    // The metadata waits for the secondary
+    select {
+    case written := <-d.acks:
+        t.Fatalf("got metadata acked with %v before the secondary is done", written)
+    default:
+    }
+
+    close(release)
+    if !d.ack(t) {
+        t.Error("expected the metadata to be written")
+    }
+    if slow.count() != 2 {
+        t.Errorf("got %d samples written to the secondary, want 2", slow.count())
+    }
+}
+
+func TestFanoutShardMetadata(t *testing.T) {
+    tests := []struct {
+        name     string
+        fail     string
+        written  bool
+    }{
+        {"every shard gets metadata", "", true},
+        {"shard without samples fails metadata", "_metadata", false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            a, b := &fakeSchema{}, &fakeSchema{}
+            bQueries := &fakeLog{fail: tt.fail}
+            d := &metadataDecoder{acks: make(chan bool, 1)}
+
+            router, err := newShardRouter([]string{"a", "b"}, "up=a")
+            if err != nil {
+                t.Fatal(err)
+            }
+            f := &Fanout{Decoder: d, policy: WRITE_POLICY_ALL, router: router}
+            f.Targets = []*Client{newFakeClient(t, "a", a, nil), newFakeClient(t, "b", b, bQueries)}
+            f.primary = f.Targets[0]
+
+            err = f.Write(context.Background(), 1, fanoutSamples())
+            if err != nil {
+                t.Fatal(err)
+            }
+            if a.count() != 2 || b.count() != 0 {
+                t.Errorf("got %d and %d samples written, want 2 and 0", a.count(), b.count())
+            }
+            if n := bQueries.count("_metadata"); n != 1 {
+                t.Errorf("got %d metadata upserts on the shard without samples, want 1", n)
+            }
+            if written := d.ack(t); written != tt.written {
+                t.Errorf("got metadata written %v, want %v", written, tt.written)
+            }
+        })
+    }
+}
@@ -0,0 +1,326 @@
+package pgdb
+
+import (
+    "fmt"
+    "time"
+    "context"
+    "database/sql"
+
+    "github.com/prometheus/client_golang/prometheus"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+    "github.com/arslanm/kafka-timescaledb-adapter/log"
+)
+
+const (
+    LATE_ACCEPT     = "accept"
+    LATE_DROP       = "drop"
+    LATE_BACKFILL   = "backfill"
+    LATE_DECOMPRESS = "decompress"
+
+    sqlCreateBackfillTable = "CREATE TABLE IF NOT EXISTS %s_backfill (time TIMESTAMPTZ NOT NULL, value DOUBLE PRECISION, name TEXT NOT NULL, labels JSONB NOT NULL);"
+    sqlCreateBackfillIndex = "CREATE INDEX IF NOT EXISTS %s_backfill_name_time_idx ON %s_backfill (name, time);"
+    sqlListChunks          = "SELECT format('%I.%I', chunk_schema, chunk_name), range_start, range_end FROM timescaledb_information.chunks WHERE hypertable_name = $1;"
+    sqlDecompressChunk     = "SELECT decompress_chunk($1::regclass, if_compressed => true);"
+    sqlCompressChunk       = "SELECT compress_chunk($1::regclass, if_not_compressed => true);"
+)
+
+// Upper bounds of the ages late samples are counted by
+var lateAgeBuckets = []struct {
+    age    time.Duration
+    label  string
+}{
+    {time.Hour, "1h"},
+    {6 * time.Hour, "6h"},
+    {24 * time.Hour, "1d"},
+    {7 * 24 * time.Hour, "7d"},
+    {30 * 24 * time.Hour, "30d"},
+}
+
+var lateSamples = prometheus.NewCounterVec(
+    prometheus.CounterOpts{
+        Namespace : "kafka_timescale_adapter",
+        Name      : "late_samples_total",
+        Help      : "Total number of samples older than the late threshold by the bound of their age.",
+    },
+    []string{"remote", "age", "policy"},
+)
+
+func lateAge(age time.Duration) string {
+    for _, b := range lateAgeBuckets {
+        if age <= b.age {
+            return b.label
+        }
+    }
+    return "older"
+}
+
+// Creates the table late samples are written to with PG_LATE_POLICY=backfill.
+// It has the samples with their names and labels, so it needs no series
+// ids and fits every layout.
+func (c *Client) backfillMigration(version int) migration {
+    return migration{version: version, description: "Create backfill table", up: execMigration(func() []string {
+        return []string{
+            fmt.Sprintf(sqlCreateBackfillTable, c.cfg.table),
+            fmt.Sprintf(sqlCreateBackfillIndex, c.cfg.table, c.cfg.table),
+        }
+    })}
+}
+
+// Checks the late policy. Chunks can only be decompressed for the layouts
+// whose value tables are known.
+func (c *Client) setupLate(tables []valueTable) error {
+    if c.cfg.lateThreshold <= 0 {
+        return nil
+    }
+
+    switch c.cfg.latePolicy {
+    case LATE_ACCEPT, LATE_DROP, LATE_BACKFILL:
+    case LATE_DECOMPRESS:
+        if c.cfg.schemaMode == SCHEMA_PROMSCALE || len(tables) == 0 && c.cfg.schemaMode == SCHEMA_PG_PROMETHEUS {
+            return fmt.Errorf("Late policy %q is not supported by this table layout", c.cfg.latePolicy)
+        }
+    default:
+        return fmt.Errorf("Unknown late policy %q", c.cfg.latePolicy)
+    }
+
+    log.Info("msg", "Handling late samples", "remote", c.Name(), "threshold", c.cfg.lateThreshold, "policy", c.cfg.latePolicy)
+    return nil
+}
+
+// Counts the samples of a batch older than PG_LATE_THRESHOLD by their age
+// and drops them with PG_LATE_POLICY=drop
+func (c *Client) checkLate(samples []format.Sample) []format.Sample {
+    if c.cfg.lateThreshold <= 0 {
+        return samples
+    }
+
+    drop := c.cfg.latePolicy == LATE_DROP
+    kept := samples
+    if drop {
+        kept = make([]format.Sample, 0, len(samples))
+    }
+
+    now := time.Now()
+    for i := range samples {
+        age := now.Sub(samples[i].Timestamp)
+        if age <= c.cfg.lateThreshold {
+            if drop {
+                kept = append(kept, samples[i])
+            }
+            continue
+        }
+
+        lateSamples.WithLabelValues(c.Name(), lateAge(age), c.cfg.latePolicy).Inc()
+        if drop {
+            rejectedMetrics.WithLabelValues(c.Name(), "late").Inc()
+        }
+    }
+    return kept
+}
+
+// Splits the samples older than PG_LATE_THRESHOLD off a batch
+func (c *Client) splitLate(samples []format.Sample) ([]format.Sample, []format.Sample) {
+    threshold := time.Now().Add(-c.cfg.lateThreshold)
+
+    var onTime, late []format.Sample
+    for i := range samples {
+        if samples[i].Timestamp.Before(threshold) {
+            late = append(late, samples[i])
+        } else {
+            onTime = append(onTime, samples[i])
+        }
+    }
+    return onTime, late
+}
+
+// Decompresses the chunks late samples of a batch fall into and returns
+// every chunk they fall into, compressed or not, to be released once the
+// batch is written. Chunks are decompressed in transactions of their own.
+// If decompressing a chunk fails, the chunks before it are returned and
+// the failed one is released right away, it's only recompressed if
+// another batch decompressed it.
+func (c *Client) decompressChunks(ctx context.Context, samples []format.Sample) ([]string, error) {
+    _, late := c.splitLate(samples)
+    if len(late) == 0 {
+        return nil, nil
+    }
+
+    times := make(map[string][]time.Time)
+    for i := range late {
+        times[late[i].Name] = append(times[late[i].Name], late[i].Timestamp)
+    }
+
+    tables, err := c.schema.valueTables(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    var chunks []string
+    for _, vt := range tables {
+        if !vt.hypertable {
+            continue
+        }
+
+        var ts []time.Time
+        if len(vt.metric) == 0 {
+            for i := range late {
+                ts = append(ts, late[i].Timestamp)
+            }
+        } else {
+            ts = times[vt.metric]
+        }
+        if len(ts) == 0 {
+            continue
+        }
+
+        found, err := c.lateChunks(ctx, vt.name, ts)
+        if err != nil {
+            return nil, err
+        }
+        chunks = append(chunks, found...)
+    }
+
+    for i, chunk := range chunks {
+        err = c.acquireChunk(ctx, chunk)
+        if err != nil {
+            return chunks[:i], err
+        }
+
+        // Chunks that are not compressed give NULL
+        var decompressed sql.NullString
+        err = c.DB.QueryRowContext(ctx, sqlDecompressChunk, chunk).Scan(&decompressed)
+        if err != nil {
+            c.releaseChunks([]string{chunk})
+            return chunks[:i], fmt.Errorf("Can't decompress chunk %s: %v", chunk, err)
+        }
+        if decompressed.Valid {
+            c.markDecompressed(chunk)
+            log.Debug("msg", "Decompressed chunk for late samples", "remote", c.Name(), "chunk", chunk)
+        }
+    }
+    return chunks, nil
+}
+
+// Lists the chunks of a hypertable that any of the times fall into
+func (c *Client) lateChunks(ctx context.Context, hypertable string, times []time.Time) ([]string, error) {
+    rows, err := c.DB.QueryContext(ctx, sqlListChunks, hypertable)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var chunks []string
+    for rows.Next() {
+        var chunk string
+        var start, end time.Time
+        if err = rows.Scan(&chunk, &start, &end); err != nil {
+            return nil, err
+        }
+
+        for _, t := range times {
+            if !t.Before(start) && t.Before(end) {
+                chunks = append(chunks, chunk)
+                break
+            }
+        }
+    }
+    return chunks, rows.Err()
+}
+
+// Batches writing into a chunk, whether one of them decompressed it and
+// thus it is to be recompressed when the last one is done, and while
+// that happens a channel closed once it's done
+type chunkUse struct {
+    batches        int
+    decompressed   bool
+    recompressing  chan struct{}
+}
+
+// Counts a batch writing into a chunk. A chunk that is being recompressed
+// is waited for, so it's decompressed again rather than compressed while
+// the batch writes into it.
+func (c *Client) acquireChunk(ctx context.Context, chunk string) error {
+    for {
+        c.mtx.Lock()
+        if c.chunks == nil {
+            c.chunks = make(map[string]*chunkUse)
+        }
+        use, ok := c.chunks[chunk]
+        if !ok {
+            use = &chunkUse{}
+            c.chunks[chunk] = use
+        }
+        done := use.recompressing
+        if done == nil {
+            use.batches++
+        }
+        c.mtx.Unlock()
+
+        if done == nil {
+            return nil
+        }
+        select {
+        case <-done:
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+}
+
+func (c *Client) markDecompressed(chunk string) {
+    c.mtx.Lock()
+    defer c.mtx.Unlock()
+
+    c.chunks[chunk].decompressed = true
+}
+
+// Uncounts a batch and tells if the chunk is to be recompressed
+func (c *Client) releaseChunk(chunk string) bool {
+    c.mtx.Lock()
+    defer c.mtx.Unlock()
+
+    use := c.chunks[chunk]
+    use.batches--
+    if use.batches > 0 {
+        return false
+    }
+    if !use.decompressed {
+        delete(c.chunks, chunk)
+        return false
+    }
+    use.recompressing = make(chan struct{})
+    return true
+}
+
+func (c *Client) recompressed(chunk string) {
+    c.mtx.Lock()
+    defer c.mtx.Unlock()
+
+    close(c.chunks[chunk].recompressing)
+    delete(c.chunks, chunk)
+}
+
+// Recompresses the chunks no batch writes into anymore in the background,
+// so the batch doesn't wait for it. Chunks that were not compressed when
+// the batches came are left alone.
+func (c *Client) releaseChunks(chunks []string) {
+    if len(chunks) == 0 {
+        return
+    }
+
+    go func() {
+        for _, chunk := range chunks {
+            if !c.releaseChunk(chunk) {
+                continue
+            }
+            _, err := c.DB.Exec(sqlCompressChunk, chunk)
+            c.recompressed(chunk)
+            if err != nil {
+                log.Error("msg", "Error recompressing chunk", "remote", c.Name(), "chunk", chunk, "error", err)
+                continue
+            }
+            log.Debug("msg", "Recompressed chunk", "remote", c.Name(), "chunk", chunk)
+        }
+    }()
+}
@@ -0,0 +1,106 @@
+package pgdb
+
+import (
+    "testing"
+    "time"
+    "context"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+)
+
+func TestLateAge(t *testing.T) {
+    tests := []struct {
+        age   time.Duration
+        want  string
+    }{
+        {30 * time.Minute, "1h"},
+        {time.Hour, "1h"},
+        {2 * time.Hour, "6h"},
+        {12 * time.Hour, "1d"},
+        {3 * 24 * time.Hour, "7d"},
+        {10 * 24 * time.Hour, "30d"},
+        {90 * 24 * time.Hour, "older"},
+    }
+
+    for _, tt := range tests {
+        if got := lateAge(tt.age); got != tt.want {
+            t.Errorf("lateAge(%v) = %s, want %s", tt.age, got, tt.want)
+        }
+    }
+}
+
+func TestSplitLate(t *testing.T) {
+    c := &Client{cfg: &Config{lateThreshold: time.Hour}}
+    now := time.Now()
+    samples := []format.Sample{
+        {Name: "a", Timestamp: now},
+        {Name: "b", Timestamp: now.Add(-2 * time.Hour)},
+        {Name: "c", Timestamp: now.Add(-30 * time.Minute)},
+        {Name: "d", Timestamp: now.Add(-48 * time.Hour)},
+    }
+
+    onTime, late := c.splitLate(samples)
+    if len(onTime) != 2 || onTime[0].Name != "a" || onTime[1].Name != "c" {
+        t.Errorf("unexpected samples on time %v", onTime)
+    }
+    if len(late) != 2 || late[0].Name != "b" || late[1].Name != "d" {
+        t.Errorf("unexpected late samples %v", late)
+    }
+}
+
+func TestChunkUse(t *testing.T) {
+    ctx := context.Background()
+    c := &Client{}
+
+    // A chunk that wasn't compressed is not recompressed
+    if err := c.acquireChunk(ctx, "plain"); err != nil {
+        t.Fatal(err)
+    }
+    if c.releaseChunk("plain") {
+        t.Error("expected a chunk nobody decompressed not to be recompressed")
+    }
+
+    // A chunk is recompressed when the last batch is done, even if a
+    // later batch found it decompressed already
+    c.acquireChunk(ctx, "late")
+    c.markDecompressed("late")
+    c.acquireChunk(ctx, "late")
+    if c.releaseChunk("late") {
+        t.Error("expected the chunk to stay decompressed while a batch writes into it")
+    }
+    if !c.releaseChunk("late") {
+        t.Fatal("expected the chunk to be recompressed after the last batch")
+    }
+
+    // A batch coming while the chunk is recompressed waits for it
+    acquired := make(chan error)
+    go func() {
+        acquired <- c.acquireChunk(ctx, "late")
+    }()
+    select {
+    case <-acquired:
+        t.Fatal("expected the batch to wait for the recompression")
+    case <-time.After(50 * time.Millisecond):
+    }
+
+    c.recompressed("late")
+    if err := <-acquired; err != nil {
+        t.Fatal(err)
+    }
+    if c.releaseChunk("late") {
+        t.Error("expected a chunk recompressed before the batch came not to be recompressed again")
+    }
+}
+
+func TestChunkUseCanceled(t *testing.T) {
+    c := &Client{}
+    c.acquireChunk(context.Background(), "late")
+    c.markDecompressed("late")
+    c.releaseChunk("late")
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    if err := c.acquireChunk(ctx, "late"); err == nil {
+        t.Error("expected waiting for a recompression to end with the context")
+    }
+}
@@ -0,0 +1,212 @@
+package pgdb
+
+import (
+    "fmt"
+    "time"
+    "context"
+    "database/sql"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/log"
+)
+
+const (
+    sqlCreateMigrationsTable = "CREATE TABLE IF NOT EXISTS schema_migrations (table_name TEXT NOT NULL, version INT NOT NULL, description TEXT NOT NULL, applied_at TIMESTAMPTZ NOT NULL DEFAULT now(), PRIMARY KEY (table_name, version));"
+    sqlHasMigrationsTable    = "SELECT to_regclass('schema_migrations') IS NOT NULL;"
+    sqlLockMigrations        = "SELECT pg_advisory_xact_lock(hashtext('schema_migrations'));"
+    sqlListMigrations        = "SELECT version, applied_at FROM schema_migrations WHERE table_name = $1;"
+    sqlInsertMigration       = "INSERT INTO schema_migrations (table_name, version, description) VALUES ($1, $2, $3);"
+    sqlTableExists           = "SELECT to_regclass($1) IS NOT NULL;"
+)
+
+// A step creating or evolving the tables of a layout. Steps are applied
+// in the order of their versions and never change once released, later
+// changes are new steps.
+type migration struct {
+    version      int
+    description  string
+    up           func(ctx context.Context, tx *sql.Tx) error
+}
+
+// A migration of a target and whether it was applied
+type MigrationStatus struct {
+    Target       string
+    Table        string
+    Version      int
+    Description  string
+    Applied      bool
+    AppliedAt    time.Time
+}
+
+// Shows the migrations of each target and applies the pending ones if
+// apply is set. The statuses are read after the migrations are applied.
+func Migrate(cfg *TargetsConfig, apply bool) ([]MigrationStatus, error) {
+    var statuses []MigrationStatus
+    for i := range cfg.targets {
+        c, err := openClient(&cfg.targets[i])
+        if err != nil {
+            return nil, err
+        }
+
+        err = c.migrateStatus(apply, &statuses)
+        c.Close()
+        if err != nil {
+            return nil, fmt.Errorf("%s: %v", c.Name(), err)
+        }
+    }
+    return statuses, nil
+}
+
+func (c *Client) migrateStatus(apply bool, statuses *[]MigrationStatus) error {
+    ctx := context.Background()
+    if apply {
+        err := c.schema.setup()
+        if err != nil {
+            return err
+        }
+        _, err = c.migrate(ctx)
+        if err != nil {
+            return err
+        }
+    }
+
+    status, err := c.migrationStatus(ctx)
+    if err != nil {
+        return err
+    }
+    *statuses = append(*statuses, status...)
+    return nil
+}
+
+// Lists the migrations of the layout with the time they were applied
+func (c *Client) migrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+    applied := make(map[int]time.Time)
+
+    var exists bool
+    err := c.DB.QueryRowContext(ctx, sqlHasMigrationsTable).Scan(&exists)
+    if err != nil {
+        return nil, err
+    }
+    if exists {
+        applied, err = c.appliedMigrations(ctx, c.DB)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    migrations := c.schema.migrations()
+    statuses := make([]MigrationStatus, 0, len(migrations))
+    for _, m := range migrations {
+        at, ok := applied[m.version]
+        statuses = append(statuses, MigrationStatus{Target: c.Name(), Table: c.cfg.table, Version: m.version,
+            Description: m.description, Applied: ok, AppliedAt: at})
+        delete(applied, m.version)
+    }
+
+    // Applied by a newer release of the adapter
+    for version := range applied {
+        log.Warn("msg", "Schema has a migration this release doesn't know", "remote", c.Name(), "table", c.cfg.table, "version", version)
+    }
+    return statuses, nil
+}
+
+func (c *Client) appliedMigrations(ctx context.Context, q querier) (map[int]time.Time, error) {
+    rows, err := q.QueryContext(ctx, sqlListMigrations, c.cfg.table)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    applied := make(map[int]time.Time)
+    for rows.Next() {
+        var version int
+        var at time.Time
+        if err = rows.Scan(&version, &at); err != nil {
+            return nil, err
+        }
+        applied[version] = at
+    }
+    return applied, rows.Err()
+}
+
+// Applies the pending migrations of the layout and returns how many were
+// applied. Each one is applied in a transaction of its own holding an
+// advisory lock, so replicas starting together apply it only once.
+func (c *Client) migrate(ctx context.Context) (int, error) {
+    n := 0
+    for _, m := range c.schema.migrations() {
+        applied, err := c.applyMigration(ctx, m)
+        if err != nil {
+            return n, fmt.Errorf("Migration %d (%s) of %s failed: %v", m.version, m.description, c.cfg.table, err)
+        }
+        if applied {
+            log.Info("msg", "Applied schema migration", "remote", c.Name(), "table", c.cfg.table, "version", m.version, "description", m.description)
+            n++
+        }
+    }
+    return n, nil
+}
+
+func (c *Client) applyMigration(ctx context.Context, m migration) (bool, error) {
+    tx, err := c.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return false, err
+    }
+
+    defer tx.Rollback()
+
+    stmts := []string{sqlLockMigrations, sqlCreateMigrationsTable}
+    for _, stmt := range stmts {
+        _, err = tx.ExecContext(ctx, stmt)
+        if err != nil {
+            return false, err
+        }
+    }
+
+    applied, err := c.appliedMigrations(ctx, tx)
+    if err != nil {
+        return false, err
+    }
+    if _, ok := applied[m.version]; ok {
+        return false, nil
+    }
+
+    err = m.up(ctx, tx)
+    if err != nil {
+        return false, err
+    }
+
+    _, err = tx.ExecContext(ctx, sqlInsertMigration, c.cfg.table, m.version, m.description)
+    if err != nil {
+        return false, err
+    }
+    return true, tx.Commit()
+}
+
+// Counts the migrations of the layout that are not applied
+func (c *Client) pendingMigrations(ctx context.Context) (int, error) {
+    statuses, err := c.migrationStatus(ctx)
+    if err != nil {
+        return 0, err
+    }
+
+    n := 0
+    for _, s := range statuses {
+        if !s.Applied {
+            n++
+        }
+    }
+    return n, nil
+}
+
+// A migration running statements built from the config
+func execMigration(stmts func() []string) func(context.Context, *sql.Tx) error {
+    return func(ctx context.Context, tx *sql.Tx) error {
+        for _, stmt := range stmts() {
+            _, err := tx.ExecContext(ctx, stmt)
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+}
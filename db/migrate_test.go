@@ -0,0 +1,166 @@
+package pgdb
+
+import (
+    "fmt"
+    "reflect"
+    "strings"
+    "testing"
+    "context"
+)
+
+func TestMigrationVersions(t *testing.T) {
+    modes := []string{SCHEMA_PG_PROMETHEUS, SCHEMA_PROMSCALE, SCHEMA_PLAIN, SCHEMA_PER_METRIC}
+    for _, mode := range modes {
+        t.Run(mode, func(t *testing.T) {
+            c := &Client{cfg: &Config{table: "metrics", schemaMode: mode}}
+            s, err := newSchema(mode, c)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            migrations := s.migrations()
+            if len(migrations) == 0 {
+                t.Fatal("expected migrations, got none")
+            }
+            for i, m := range migrations {
+                if i > 0 && m.version <= migrations[i-1].version {
+                    t.Errorf("got version %d after %d", m.version, migrations[i-1].version)
+                }
+                if m.version < 1 || len(m.description) == 0 || m.up == nil {
+                    t.Errorf("got incomplete migration %d %q", m.version, m.description)
+                }
+            }
+        })
+    }
+}
+
+// A layout with the given migrations
+type migrationsSchema struct {
+    *fakeSchema
+    list  []migration
+}
+
+func (s *migrationsSchema) migrations() []migration {
+    return s.list
+}
+
+// A migration creating a table named after its version
+func tableMigration(version int) migration {
+    return migration{version: version, description: fmt.Sprintf("Create m%d", version), up: execMigration(func() []string {
+        return []string{fmt.Sprintf("CREATE TABLE m%d ();", version)}
+    })}
+}
+
+func TestMigrate(t *testing.T) {
+    const (
+        list   = "SELECT version, applied_at FROM schema_migrations WHERE table_name = $1; -- metrics"
+        begin  = "BEGIN READ WRITE"
+    )
+    // Each migration takes the lock before it looks for itself
+    lookup := []string{begin, sqlLockMigrations, sqlCreateMigrationsTable, list}
+    appended := func(lists ...[]string) []string {
+        var all []string
+        for _, l := range lists {
+            all = append(all, l...)
+        }
+        return all
+    }
+
+    tests := []struct {
+        name     string
+        applied  []string
+        fail     string
+        want     []string
+        n        int
+    }{
+        {"all pending", nil, "", appended(
+            lookup, []string{"CREATE TABLE m1 ();", sqlInsertMigration + " -- metrics, 1, Create m1", "COMMIT"},
+            lookup, []string{"CREATE TABLE m2 ();", sqlInsertMigration + " -- metrics, 2, Create m2", "COMMIT"},
+            lookup, []string{"CREATE TABLE m3 ();", sqlInsertMigration + " -- metrics, 3, Create m3", "COMMIT"},
+        ), 3},
+        {"applied skipped", []string{"1", "2"}, "", appended(
+            lookup, []string{"ROLLBACK"},
+            lookup, []string{"ROLLBACK"},
+            lookup, []string{"CREATE TABLE m3 ();", sqlInsertMigration + " -- metrics, 3, Create m3", "COMMIT"},
+        ), 1},
+        {"failed not recorded", nil, "m2", appended(
+            lookup, []string{"CREATE TABLE m1 ();", sqlInsertMigration + " -- metrics, 1, Create m1", "COMMIT"},
+            lookup, []string{"CREATE TABLE m2 ();", "ROLLBACK"},
+        ), 1},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            queries := &fakeLog{fail: tt.fail, answer: func(query string, args []string) ([]string, [][]string) {
+                if query != sqlListMigrations {
+                    return nil, nil
+                }
+                var rows [][]string
+                if len(args) > 0 {
+                    for _, version := range tt.applied {
+                        rows = append(rows, []string{version, "2020-09-13 12:00:00+00"})
+                    }
+                }
+                return []string{"version", "applied_at"}, rows
+            }}
+            s := &migrationsSchema{fakeSchema: &fakeSchema{}, list: []migration{tableMigration(1), tableMigration(2), tableMigration(3)}}
+            c := newFakeClient(t, "test", s, queries)
+            c.cfg.table = "metrics"
+
+            n, err := c.migrate(context.Background())
+            if len(tt.fail) > 0 && err == nil {
+                t.Error("expected an error, got nil")
+            }
+            if len(tt.fail) == 0 && err != nil {
+                t.Fatal(err)
+            }
+            if n != tt.n {
+                t.Errorf("got %d migrations applied, want %d", n, tt.n)
+            }
+            if !reflect.DeepEqual(queries.queries, tt.want) {
+                t.Errorf("got queries\n%s\nwant\n%s", strings.Join(queries.queries, "\n"), strings.Join(tt.want, "\n"))
+            }
+        })
+    }
+}
+
+func TestMigrationStatus(t *testing.T) {
+    queries := &fakeLog{answer: func(query string, args []string) ([]string, [][]string) {
+        switch query {
+        case sqlHasMigrationsTable:
+            return []string{"exists"}, [][]string{{"t"}}
+        case sqlListMigrations:
+            if len(args) == 0 {
+                return []string{"version", "applied_at"}, nil
+            }
+            return []string{"version", "applied_at"}, [][]string{{"2", "2020-09-13 12:00:00+00"}, {"9", "2020-09-14 12:00:00+00"}}
+        }
+        return nil, nil
+    }}
+    s := &migrationsSchema{fakeSchema: &fakeSchema{}, list: []migration{tableMigration(1), tableMigration(2)}}
+    c := newFakeClient(t, "test", s, queries)
+    c.cfg.table = "metrics"
+
+    n, err := c.pendingMigrations(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if n != 1 {
+        t.Errorf("got %d pending migrations, want 1", n)
+    }
+
+    statuses, err := c.migrationStatus(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    applied := make([]bool, len(statuses))
+    for i, s := range statuses {
+        applied[i] = s.Applied
+    }
+    if !reflect.DeepEqual(applied, []bool{false, true}) {
+        t.Errorf("got applied %v, want [false true]", applied)
+    }
+    if at := statuses[1].AppliedAt.UTC().Format("2006-01-02 15:04"); at != "2020-09-13 12:00" {
+        t.Errorf("got applied at %s", at)
+    }
+}
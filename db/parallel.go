@@ -0,0 +1,84 @@
+package pgdb
+
+import (
+    "fmt"
+    "sync"
+    "context"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+    "github.com/arslanm/kafka-timescaledb-adapter/log"
+)
+
+// Fewest samples worth a transaction of their own
+const minSubBatchSize = 500
+
+// Splits a batch into at most PG_COPY_PARALLELISM sub-batches by a hash of
+// the series, so the samples of a series stay together and concurrent
+// transactions never upsert the same series
+func (c *Client) splitBatch(samples []format.Sample) [][]format.Sample {
+    n := c.cfg.copyParallelism
+    if max := len(samples) / minSubBatchSize; n > max {
+        n = max
+    }
+    if n <= 1 {
+        return [][]format.Sample{samples}
+    }
+
+    var labels []byte
+    var keys []string
+
+    parts := make([][]format.Sample, n)
+    for i := range samples {
+        s := &samples[i]
+        labels, keys = appendLabelsJSON(labels[:0], keys[:0], s.Labels)
+        part := hashString(seriesKey(s.Name, labels)) % uint32(n)
+        parts[part] = append(parts[part], *s)
+    }
+
+    split := parts[:0]
+    for _, part := range parts {
+        if len(part) > 0 {
+            split = append(split, part)
+        }
+    }
+    return split
+}
+
+// Writes the sub-batches concurrently, each in its own transaction on its
+// own connection. Sub-batches that commit stay written when others fail,
+// their samples are counted as written and only the samples of the
+// failed ones are returned.
+func (c *Client) insertParallel(ctx context.Context, parts [][]format.Sample) (int, []format.Sample, error) {
+    errs := make([]error, len(parts))
+    counts := make([]int, len(parts))
+    fails := make([][]format.Sample, len(parts))
+
+    var wg sync.WaitGroup
+    for i := range parts {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            counts[i], fails[i], errs[i] = c.insertRejecting(ctx, parts[i])
+        }(i)
+    }
+    wg.Wait()
+
+    written := 0
+    failedParts := 0
+    var failed []format.Sample
+    var err error
+    for i := range parts {
+        written += counts[i]
+        if errs[i] != nil {
+            failed = append(failed, fails[i]...)
+            failedParts++
+            err = errs[i]
+        }
+    }
+
+    if err != nil {
+        log.Debug("msg", "Sub-batches failed", "remote", c.Name(), "failed", failedParts, "sub-batches", len(parts), "samples", len(failed))
+        return written, failed, fmt.Errorf("%d of %d sub-batches failed: %v", failedParts, len(parts), err)
+    }
+    return written, nil, nil
+}
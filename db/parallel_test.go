@@ -0,0 +1,74 @@
+package pgdb
+
+import (
+    "fmt"
+    "testing"
+    "time"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+)
+
+func parallelSamples(n int, series int) []format.Sample {
+    ts := time.Unix(1600000000, 0).UTC()
+    samples := make([]format.Sample, n)
+    for i := range samples {
+        samples[i] = format.Sample{
+            Name      : "up",
+            Labels    : map[string]string{"instance": fmt.Sprintf("10.0.0.%d:9090", i%series)},
+            Value     : float64(i),
+            Timestamp : ts.Add(time.Duration(i) * time.Second),
+        }
+    }
+    return samples
+}
+
+func TestSplitBatch(t *testing.T) {
+    tests := []struct {
+        name         string
+        parallelism  int
+        samples      int
+        maxParts     int
+    }{
+        {"no parallelism", 1, 5000, 1},
+        {"small batch", 8, minSubBatchSize*2 - 1, 1},
+        {"capped by batch size", 8, minSubBatchSize * 4, 4},
+        {"capped by parallelism", 2, minSubBatchSize * 10, 2},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            c := &Client{cfg: &Config{copyParallelism: tt.parallelism}}
+            samples := parallelSamples(tt.samples, 100)
+            parts := c.splitBatch(samples)
+
+            if len(parts) > tt.maxParts || tt.maxParts > 1 && len(parts) < 2 {
+                t.Fatalf("got %d sub-batches, want at most %d", len(parts), tt.maxParts)
+            }
+
+            total := 0
+            partOf := make(map[string]int)
+            for i, part := range parts {
+                if len(part) == 0 {
+                    t.Errorf("sub-batch %d is empty", i)
+                }
+                total += len(part)
+
+                last := make(map[string]float64)
+                for _, s := range part {
+                    instance := s.Labels["instance"]
+                    if p, ok := partOf[instance]; ok && p != i {
+                        t.Errorf("series %s is in sub-batches %d and %d", instance, p, i)
+                    }
+                    partOf[instance] = i
+                    if v, ok := last[instance]; ok && v >= s.Value {
+                        t.Errorf("samples of %s are out of order", instance)
+                    }
+                    last[instance] = s.Value
+                }
+            }
+            if total != len(samples) {
+                t.Errorf("got %d samples, want %d", total, len(samples))
+            }
+        })
+    }
+}
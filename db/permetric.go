@@ -0,0 +1,336 @@
+package pgdb
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "strings"
+    "context"
+    "hash/fnv"
+    "database/sql"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+    "github.com/arslanm/kafka-timescaledb-adapter/log"
+)
+
+const (
+    sqlCreateTemplateTable = "CREATE TABLE IF NOT EXISTS %s_template (time TIMESTAMPTZ NOT NULL, value DOUBLE PRECISION, series_id BIGINT NOT NULL);"
+    sqlCreateTemplateIndex = "CREATE INDEX IF NOT EXISTS %s_template_series_id_time_idx ON %s_template (series_id, time DESC);"
+    sqlCreateCatalogTable  = "CREATE TABLE IF NOT EXISTS %s_metric_tables (metric_name TEXT PRIMARY KEY, table_name TEXT NOT NULL UNIQUE, created_at TIMESTAMPTZ NOT NULL DEFAULT now());"
+    sqlLockCatalog         = "SELECT pg_advisory_xact_lock(hashtext('%s_metric_tables'));"
+    sqlGetCatalogTable     = "SELECT table_name FROM %s_metric_tables WHERE metric_name = $1;"
+    sqlTableTaken          = "SELECT count(*) > 0 OR to_regclass($2) IS NOT NULL FROM %s_metric_tables WHERE table_name = $1;"
+    sqlCreateMetricTable   = "CREATE TABLE IF NOT EXISTS \"%s\" (LIKE %s INCLUDING ALL);"
+    sqlCreateMetricHyper   = "SELECT create_hypertable($1::regclass, 'time', chunk_time_interval => $2::interval, if_not_exists => true);"
+    sqlListCatalogTables   = "SELECT metric_name, table_name, false FROM %s_metric_tables ORDER BY table_name;"
+    sqlListCatalogHypers   = "SELECT m.metric_name, m.table_name, h.hypertable_name IS NOT NULL FROM %s_metric_tables m LEFT JOIN timescaledb_information.hypertables h ON h.hypertable_schema = current_schema() AND h.hypertable_name = m.table_name ORDER BY m.table_name;"
+    sqlInsertCatalogTable  = "INSERT INTO %s_metric_tables (metric_name, table_name) VALUES ($1, $2);"
+
+    // Longest identifier PostgreSQL keeps
+    maxIdentifierLength = 63
+)
+
+// perMetricSchema writes the samples of each metric into a table of its
+// own, created on first sight as a copy of a template table and made a
+// hypertable if TimescaleDB is available. Series are shared in
+// <table>_series like in the plain layout, and <table>_metric_tables
+// records which table holds which metric.
+type perMetricSchema struct {
+    *plainSchema
+
+    template  string
+    mtx       sync.RWMutex
+    tables    map[string]string
+}
+
+func newPerMetricSchema(c *Client) *perMetricSchema {
+    template := c.cfg.metricTableTemplate
+    if len(template) == 0 {
+        template = fmt.Sprintf("%s_template", c.cfg.table)
+    }
+    return &perMetricSchema{plainSchema: newPlainSchema(c), template: template, tables: make(map[string]string)}
+}
+
+func (c *perMetricSchema) setup() error {
+    var err error
+
+    c.timescaleDb, err = c.enableTimescaleDb()
+    if err != nil {
+        return err
+    }
+
+    log.Info("msg", "Writing into table per metric layout", "table", c.cfg.table, "template", c.template, "timescaledb", c.timescaleDb)
+    return nil
+}
+
+// A custom template is left to whoever created it
+func (c *perMetricSchema) migrations() []migration {
+    return []migration{
+        {version: 1, description: "Create series table", up: c.createSeriesTable},
+        {version: 2, description: "Create metric tables catalog", up: execMigration(func() []string {
+            return []string{fmt.Sprintf(sqlCreateCatalogTable, c.cfg.table)}
+        })},
+        {version: 3, description: "Create metric table template", up: execMigration(func() []string {
+            if len(c.cfg.metricTableTemplate) > 0 {
+                return nil
+            }
+            return []string{
+                fmt.Sprintf(sqlCreateTemplateTable, c.cfg.table),
+                fmt.Sprintf(sqlCreateTemplateIndex, c.cfg.table, c.cfg.table),
+            }
+        })},
+        c.metadataMigration(4),
+        c.stagingMigration(5, false),
+        c.backfillMigration(6),
+    }
+}
+
+// Tables of new metrics are created in transactions of their own, so
+// they are resolved before the connection of the batch is taken
+func (c *perMetricSchema) ensureTables(ctx context.Context, samples []format.Sample) error {
+    names := make([]string, 0)
+    seen := make(map[string]bool)
+    for i := range samples {
+        if !seen[samples[i].Name] {
+            seen[samples[i].Name] = true
+            names = append(names, samples[i].Name)
+        }
+    }
+    sort.Strings(names)
+
+    for _, name := range names {
+        _, err := c.metricTable(ctx, name)
+        if err != nil {
+            log.Error("msg", "Error resolving metric table", "metric", name, "error", err)
+            return err
+        }
+    }
+    return nil
+}
+
+func (c *perMetricSchema) insert(ctx context.Context, conn *sql.Conn, tx *sql.Tx, samples []format.Sample) (func(), error) {
+    metrics := make(map[string][]int)
+    for i := range samples {
+        metrics[samples[i].Name] = append(metrics[samples[i].Name], i)
+    }
+
+    names := make([]string, 0, len(metrics))
+    for name := range metrics {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    tables := make(map[string]string, len(names))
+    c.mtx.RLock()
+    for _, name := range names {
+        tables[name] = c.tables[name]
+    }
+    c.mtx.RUnlock()
+
+    for _, name := range names {
+        if len(tables[name]) == 0 {
+            return nil, fmt.Errorf("No table for metric %s", name)
+        }
+    }
+
+    ids, resolved, err := c.seriesIds(ctx, tx, samples)
+    if err != nil {
+        log.Error("msg", "Error resolving series ids", "error", err)
+        return nil, err
+    }
+
+    for _, name := range names {
+        batch := make([]format.Sample, 0, len(metrics[name]))
+        batchIds := make([]int64, 0, len(metrics[name]))
+        for _, i := range metrics[name] {
+            batch = append(batch, samples[i])
+            batchIds = append(batchIds, ids[i])
+        }
+
+        err = c.writeValues(ctx, conn, tx, []string{tables[name]}, "series_id", batch, batchIds)
+        if err != nil {
+            log.Error("msg", "Error executing COPY statement", "metric", name, "error", err)
+            return nil, err
+        }
+    }
+
+    return func() {
+        for key, id := range resolved {
+            c.cache.put(key, id)
+        }
+    }, nil
+}
+
+// Whether a table is a hypertable is taken from the catalog, tables
+// created before TimescaleDB was installed are plain tables
+func (c *perMetricSchema) valueTables(ctx context.Context) ([]valueTable, error) {
+    query := sqlListCatalogTables
+    if c.timescaleDb {
+        query = sqlListCatalogHypers
+    }
+
+    rows, err := c.DB.QueryContext(ctx, fmt.Sprintf(query, c.cfg.table))
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    tables := make([]valueTable, 0)
+    for rows.Next() {
+        var metric, table string
+        var hypertable bool
+        if err = rows.Scan(&metric, &table, &hypertable); err != nil {
+            return nil, err
+        }
+        tables = append(tables, valueTable{name: table, segmentBy: "series_id", metric: metric, hypertable: hypertable})
+    }
+    return tables, rows.Err()
+}
+
+// Returns the table of a metric, creating it if the metric is new. New
+// tables are created and recorded in their own transaction under an
+// advisory lock, so writers seeing a new metric at the same time agree
+// on its table and batches don't hold locks on the catalog.
+func (c *perMetricSchema) metricTable(ctx context.Context, name string) (string, error) {
+    c.mtx.RLock()
+    table, ok := c.tables[name]
+    c.mtx.RUnlock()
+    if ok {
+        return table, nil
+    }
+
+    tx, err := c.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return "", err
+    }
+
+    defer tx.Rollback()
+
+    _, err = tx.ExecContext(ctx, fmt.Sprintf(sqlLockCatalog, c.cfg.table))
+    if err != nil {
+        return "", err
+    }
+
+    created := false
+    err = tx.QueryRowContext(ctx, fmt.Sprintf(sqlGetCatalogTable, c.cfg.table), name).Scan(&table)
+    if err == sql.ErrNoRows {
+        table, err = c.createMetricTable(ctx, tx, name)
+        created = true
+    }
+    if err != nil {
+        return "", err
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return "", err
+    }
+
+    // A new table is better written to without policies and rollups
+    // than not at all
+    if created && c.timescaleDb {
+        ht := valueTable{name: table, segmentBy: "series_id", metric: name, hypertable: true}
+        err = c.applyTablePolicies(ctx, c.DB, ht)
+        if err != nil {
+            log.Error("msg", "Error applying policies", "table", table, "error", err)
+        }
+
+        c.applyRollups(ctx, []valueTable{ht})
+        c.trackRollups([]valueTable{ht})
+    }
+
+    c.mtx.Lock()
+    c.tables[name] = table
+    c.mtx.Unlock()
+    return table, nil
+}
+
+// The name derived from the metric name may be taken by another metric
+// or by any other relation, such as the adapter's own <table>_series,
+// in which case the hashed name is used
+func (c *perMetricSchema) createMetricTable(ctx context.Context, tx *sql.Tx, name string) (string, error) {
+    table := metricTableName(c.cfg.table, name, false)
+
+    taken, err := c.tableTaken(ctx, tx, table)
+    if err != nil {
+        return "", err
+    }
+    if taken {
+        table = metricTableName(c.cfg.table, name, true)
+        taken, err = c.tableTaken(ctx, tx, table)
+        if err != nil {
+            return "", err
+        }
+        if taken {
+            return "", fmt.Errorf("Table %s for metric %s exists already", table, name)
+        }
+    }
+
+    _, err = tx.ExecContext(ctx, fmt.Sprintf(sqlCreateMetricTable, table, c.template))
+    if err != nil {
+        return "", err
+    }
+
+    if c.cfg.dedupe != DEDUPE_OFF {
+        err = c.createUniqueIndex(ctx, tx, valueTable{name: table, segmentBy: "series_id"})
+        if err != nil {
+            return "", err
+        }
+    }
+
+    if c.timescaleDb {
+        _, err = tx.ExecContext(ctx, sqlCreateMetricHyper, quoteIdent(table), c.cfg.pgPrometheusChunkInterval.String())
+        if err != nil {
+            return "", err
+        }
+    }
+
+    _, err = tx.ExecContext(ctx, fmt.Sprintf(sqlInsertCatalogTable, c.cfg.table), name, table)
+    if err != nil {
+        return "", err
+    }
+
+    log.Info("msg", "Created metric table", "metric", name, "table", table)
+    return table, nil
+}
+
+func (c *perMetricSchema) tableTaken(ctx context.Context, tx *sql.Tx, table string) (bool, error) {
+    var taken bool
+    err := tx.QueryRowContext(ctx, fmt.Sprintf(sqlTableTaken, c.cfg.table), table, quoteIdent(table)).Scan(&taken)
+    return taken, err
+}
+
+// Derives a table name from the metric name: lower case letters, digits
+// and underscores, prefixed with the table name. Names that are too long,
+// or taken by a metric that sanitizes to the same name or another table,
+// get a hash of the metric name as a suffix.
+func metricTableName(prefix string, name string, unique bool) string {
+    var b strings.Builder
+    b.WriteString(prefix)
+    b.WriteByte('_')
+    for _, r := range strings.ToLower(name) {
+        if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+            b.WriteRune(r)
+        } else {
+            b.WriteByte('_')
+        }
+    }
+
+    table := b.String()
+    if !unique && len(table) <= maxIdentifierLength {
+        return table
+    }
+    return hashedIdentifier(table, name)
+}
+
+// Appends a hash of key to an identifier, cutting the identifier short
+// so the result fits into the length PostgreSQL keeps
+func hashedIdentifier(ident string, key string) string {
+    h := fnv.New32a()
+    h.Write([]byte(key))
+    suffix := fmt.Sprintf("_%08x", h.Sum32())
+    if len(ident) > maxIdentifierLength-len(suffix) {
+        ident = ident[:maxIdentifierLength-len(suffix)]
+    }
+    return ident + suffix
+}
@@ -0,0 +1,52 @@
+package pgdb
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestMetricTableName(t *testing.T) {
+    long := strings.Repeat("a", 70)
+
+    tests := []struct {
+        name    string
+        metric  string
+        unique  bool
+        want    string
+    }{
+        {"plain", "http_requests_total", false, "metrics_http_requests_total"},
+        {"lower case", "HTTP_Requests", false, "metrics_http_requests"},
+        {"sanitized", "node:cpu.seconds-total", false, "metrics_node_cpu_seconds_total"},
+        {"unique", "http_requests_total", true, "metrics_http_requests_total_0fbcc9a5"},
+        {"too long", long, false, "metrics_" + strings.Repeat("a", 46) + "_5904740b"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := metricTableName("metrics", tt.metric, tt.unique)
+            if got != tt.want {
+                t.Errorf("got %s, want %s", got, tt.want)
+            }
+            if len(got) > maxIdentifierLength {
+                t.Errorf("%s is longer than %d characters", got, maxIdentifierLength)
+            }
+        })
+    }
+}
+
+func TestMetricTableNameCollisions(t *testing.T) {
+    // Metrics sanitizing to the same name, or to the adapter's own
+    // tables, tell apart by their hashed names
+    pairs := [][2]string{
+        {"a.b", "a-b"},
+        {"series", "Series"},
+    }
+    for _, p := range pairs {
+        if metricTableName("metrics", p[0], false) != metricTableName("metrics", p[1], false) {
+            t.Errorf("expected %s and %s to sanitize to the same name", p[0], p[1])
+        }
+        if metricTableName("metrics", p[0], true) == metricTableName("metrics", p[1], true) {
+            t.Errorf("expected different hashed names for %s and %s", p[0], p[1])
+        }
+    }
+}
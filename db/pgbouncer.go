@@ -0,0 +1,123 @@
+package pgdb
+
+import (
+    "fmt"
+    "strings"
+    "context"
+    "database/sql"
+)
+
+const (
+    // Rows are staged with the id of the transaction that staged them, so
+    // transactions on the same unlogged table see only their own rows
+    sqlCreateStagingTable  = "CREATE UNLOGGED TABLE IF NOT EXISTS %s_staging (batch_id BIGINT NOT NULL DEFAULT txid_current(), time TIMESTAMPTZ, value DOUBLE PRECISION, name TEXT, labels JSONB);"
+    sqlCreateStagingValues = "CREATE UNLOGGED TABLE IF NOT EXISTS %s_staging_values (batch_id BIGINT NOT NULL DEFAULT txid_current(), time TIMESTAMPTZ, value DOUBLE PRECISION, id BIGINT);"
+    sqlCreateStagingIndex  = "CREATE INDEX IF NOT EXISTS %s_batch_id_idx ON %s (batch_id);"
+    sqlStagedRows          = "(SELECT * FROM %s WHERE batch_id = txid_current())"
+    sqlClearStaged         = "DELETE FROM %s WHERE batch_id = txid_current();"
+)
+
+// A statement run several times within a transaction
+type txStmt interface {
+    ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error)
+    QueryRowContext(ctx context.Context, args ...interface{}) *sql.Row
+    Close() error
+}
+
+// Runs the query of a statement on its own each time, for poolers that
+// don't keep prepared statements
+type unpreparedStmt struct {
+    tx     *sql.Tx
+    query  string
+}
+
+func (s *unpreparedStmt) ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error) {
+    return s.tx.ExecContext(ctx, s.query, args...)
+}
+
+func (s *unpreparedStmt) QueryRowContext(ctx context.Context, args ...interface{}) *sql.Row {
+    return s.tx.QueryRowContext(ctx, s.query, args...)
+}
+
+func (s *unpreparedStmt) Close() error {
+    return nil
+}
+
+// Prepares a statement on the server unless PG_PGBOUNCER is set. A
+// pooler in transaction mode hands the server connection to another
+// client after the transaction, leaving the statement behind for it.
+func (c *Client) prepareTx(ctx context.Context, tx *sql.Tx, query string) (txStmt, error) {
+    if c.cfg.pgbouncer {
+        return &unpreparedStmt{tx: tx, query: query}, nil
+    }
+    return tx.PrepareContext(ctx, query)
+}
+
+// Connection parameters that keep the drivers from needing the same
+// server connection for consecutive messages: pq sends a query and its
+// parameters at once and pgx doesn't prepare statements
+func pgbouncerParams(driver string) []string {
+    if driver == DRIVER_PGX {
+        return []string{"prefer_simple_protocol", "true"}
+    }
+    return []string{"binary_parameters", "yes"}
+}
+
+// Adds a parameter to a DSN in the key/value or the URL form
+func appendConnParam(dsn string, key string, value string) string {
+    if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+        sep := "?"
+        if strings.Contains(dsn, "?") {
+            sep = "&"
+        }
+        return dsn + sep + key + "=" + value
+    }
+    return dsn + " " + key + "=" + quoteConnValue(value)
+}
+
+// The table values are staged in before they are inserted with a
+// conflict clause. Without a pooler it's a temporary table of the
+// session.
+func (c *Client) valuesStaging() string {
+    if c.cfg.pgbouncer {
+        return fmt.Sprintf("%s_staging_values", c.cfg.table)
+    }
+    return "dedupe_values"
+}
+
+// The rows of a staging table this transaction staged
+func (c *Client) stagedRows(table string) string {
+    if c.cfg.pgbouncer {
+        return fmt.Sprintf(sqlStagedRows, table)
+    }
+    return table
+}
+
+// Removes the rows this transaction staged, temporary tables are emptied
+// entirely
+func (c *Client) clearStaged(ctx context.Context, tx *sql.Tx, table string) error {
+    query := fmt.Sprintf("TRUNCATE %s;", table)
+    if c.cfg.pgbouncer {
+        query = fmt.Sprintf(sqlClearStaged, table)
+    }
+    _, err := tx.ExecContext(ctx, query)
+    return err
+}
+
+// Creates the unlogged tables staging replaces temporary tables with
+func (c *Client) stagingMigration(version int, samples bool) migration {
+    return migration{version: version, description: "Create staging tables", up: execMigration(func() []string {
+        values := fmt.Sprintf("%s_staging_values", c.cfg.table)
+        stmts := []string{
+            fmt.Sprintf(sqlCreateStagingValues, c.cfg.table),
+            fmt.Sprintf(sqlCreateStagingIndex, values, values),
+        }
+        if samples {
+            staging := fmt.Sprintf("%s_staging", c.cfg.table)
+            stmts = append(stmts,
+                fmt.Sprintf(sqlCreateStagingTable, c.cfg.table),
+                fmt.Sprintf(sqlCreateStagingIndex, staging, staging))
+        }
+        return stmts
+    })}
+}
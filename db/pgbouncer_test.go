@@ -0,0 +1,162 @@
+package pgdb
+
+import (
+    "fmt"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+    "context"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+)
+
+func TestStagingQueries(t *testing.T) {
+    tests := []struct {
+        name       string
+        pgbouncer  bool
+        staging    string
+        staged     string
+        clear      string
+    }{
+        {"temporary table", false, "dedupe_values", "dedupe_values", "TRUNCATE dedupe_values;"},
+        {"pgbouncer", true, "metrics_staging_values",
+            "(SELECT * FROM metrics_staging_values WHERE batch_id = txid_current())",
+            "DELETE FROM metrics_staging_values WHERE batch_id = txid_current();"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            queries := &fakeLog{}
+            c := newFakeClient(t, "test", nil, queries)
+            c.cfg.table = "metrics"
+            c.cfg.pgbouncer = tt.pgbouncer
+
+            staging := c.valuesStaging()
+            if staging != tt.staging {
+                t.Errorf("got staging table %s, want %s", staging, tt.staging)
+            }
+            if got := c.stagedRows(staging); got != tt.staged {
+                t.Errorf("got staged rows %s, want %s", got, tt.staged)
+            }
+
+            tx, err := c.DB.Begin()
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer tx.Rollback()
+            if err = c.clearStaged(context.Background(), tx, staging); err != nil {
+                t.Fatal(err)
+            }
+            if got := queries.matching(staging); !reflect.DeepEqual(got, []string{tt.clear}) {
+                t.Errorf("got %v, want %s", got, tt.clear)
+            }
+        })
+    }
+}
+
+func TestStagingMigration(t *testing.T) {
+    values := []string{
+        "CREATE UNLOGGED TABLE IF NOT EXISTS metrics_staging_values (batch_id BIGINT NOT NULL DEFAULT txid_current(), time TIMESTAMPTZ, value DOUBLE PRECISION, id BIGINT);",
+        "CREATE INDEX IF NOT EXISTS metrics_staging_values_batch_id_idx ON metrics_staging_values (batch_id);",
+    }
+    samples := append(values[:len(values):len(values)],
+        "CREATE UNLOGGED TABLE IF NOT EXISTS metrics_staging (batch_id BIGINT NOT NULL DEFAULT txid_current(), time TIMESTAMPTZ, value DOUBLE PRECISION, name TEXT, labels JSONB);",
+        "CREATE INDEX IF NOT EXISTS metrics_staging_batch_id_idx ON metrics_staging (batch_id);",
+    )
+
+    tests := []struct {
+        name     string
+        samples  bool
+        want     []string
+    }{
+        {"values", false, values},
+        {"values and samples", true, samples},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            queries := &fakeLog{}
+            c := newFakeClient(t, "test", nil, queries)
+            c.cfg.table = "metrics"
+
+            tx, err := c.DB.Begin()
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer tx.Rollback()
+            if err = c.stagingMigration(1, tt.samples).up(context.Background(), tx); err != nil {
+                t.Fatal(err)
+            }
+            if got := queries.matching("_staging"); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+            }
+        })
+    }
+}
+
+// Writes a batch of new series with dedupe through the plain layout and
+// returns what the fake server saw
+func writeDeduped(t *testing.T, pgbouncer bool) *fakeLog {
+    next := 0
+    queries := &fakeLog{answer: func(query string, args []string) ([]string, [][]string) {
+        switch {
+        case strings.Contains(query, "_series (metric_name, labels)"):
+            if len(args) == 0 {
+                return []string{"id"}, nil
+            }
+            next++
+            return []string{"id"}, [][]string{{fmt.Sprint(next)}}
+        case strings.HasPrefix(query, "WITH w AS"):
+            return []string{"count", "count"}, [][]string{{"2", "0"}}
+        }
+        return nil, nil
+    }}
+
+    var params []string
+    if pgbouncer {
+        params = pgbouncerParams(DRIVER_PQ)
+    }
+    cfg := &Config{name: "test", table: "metrics", dedupe: DEDUPE_IGNORE, pgbouncer: pgbouncer}
+    c := &Client{DB: openFakeDB(t, queries, params...), cfg: cfg, copier: &pqCopier{}}
+    c.schema = newPlainSchema(c)
+
+    samples := []format.Sample{
+        {Name: "up", Labels: map[string]string{"job": "a"}, Value: 1, Timestamp: time.Unix(1600000000, 0)},
+        {Name: "up", Labels: map[string]string{"job": "b"}, Value: 1, Timestamp: time.Unix(1600000000, 0)},
+    }
+    if err := c.insertBatch(context.Background(), samples); err != nil {
+        t.Fatal(err)
+    }
+    return queries
+}
+
+func TestPgbouncerWrite(t *testing.T) {
+    queries := writeDeduped(t, true)
+
+    if len(queries.prepared) > 0 {
+        t.Errorf("got prepared statements %v, want none", queries.prepared)
+    }
+    if n := queries.count("TEMPORARY"); n > 0 {
+        t.Errorf("got %d temporary tables, want none", n)
+    }
+    if n := queries.count(`COPY "metrics_staging_values"`); n != 1 {
+        t.Errorf("got %d copies into the staging table, want 1", n)
+    }
+    if n := queries.count("FROM (SELECT * FROM metrics_staging_values WHERE batch_id = txid_current()) staged"); n != 1 {
+        t.Errorf("got %d inserts of the staged rows of the transaction, want 1", n)
+    }
+    if n := queries.count("DELETE FROM metrics_staging_values WHERE batch_id = txid_current();"); n != 1 {
+        t.Errorf("got %d deletes of the staged rows, want 1", n)
+    }
+    if n := queries.count("_series (metric_name, labels)"); n != 2 {
+        t.Errorf("got %d series lookups, want 2", n)
+    }
+
+    // Without pgbouncer the series are looked up by a prepared statement
+    // in a temporary table
+    queries = writeDeduped(t, false)
+    if len(queries.prepared) != 1 || queries.count("TEMPORARY") != 1 || queries.count("TRUNCATE dedupe_values;") != 1 {
+        t.Errorf("got prepared statements %v and queries %v", queries.prepared, queries.queries)
+    }
+}
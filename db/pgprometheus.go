@@ -0,0 +1,279 @@
+package pgdb
+
+import (
+    "fmt"
+    "time"
+    "context"
+    "database/sql"
+    "encoding/json"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+    "github.com/arslanm/kafka-timescaledb-adapter/log"
+)
+
+const (
+    sqlCreateTmpTable = "CREATE TEMPORARY TABLE IF NOT EXISTS %s_tmp_%d(time TIMESTAMPTZ, value DOUBLE PRECISION, name TEXT, labels JSONB) ON COMMIT DELETE ROWS;"
+    sqlCopyTable      = "COPY \"%s\" FROM STDIN"
+    sqlInsertLabels   = "INSERT INTO %s_labels (metric_name, labels) SELECT tmp.name, tmp.labels FROM %s tmp LEFT JOIN %s_labels l ON tmp.name=l.metric_name AND tmp.labels=l.labels WHERE l.metric_name IS NULL ON CONFLICT (metric_name, labels) DO NOTHING;"
+    sqlInsertValues   = "INSERT INTO %s_values SELECT tmp.time, tmp.value, l.id FROM %s tmp INNER JOIN %s_labels l on tmp.name=l.metric_name AND tmp.labels=l.labels"
+    sqlUpsertLabels   = "INSERT INTO %s_labels (metric_name, labels) SELECT DISTINCT name, labels FROM %s tmp ON CONFLICT (metric_name, labels) DO UPDATE SET metric_name = EXCLUDED.metric_name RETURNING id, metric_name, labels;"
+)
+
+// pgPrometheusSchema writes into the tables of the pg_prometheus
+// extension, either normalized into <table>_labels and <table>_values or
+// as prom_sample rows of <table>_samples
+type pgPrometheusSchema struct {
+    *Client
+
+    createTmpTableStmt  *sql.Stmt
+    copyTableUniqId     int64
+}
+
+func (c *pgPrometheusSchema) setup() error {
+    _, err := c.DB.Exec("CREATE EXTENSION IF NOT EXISTS pg_prometheus")
+    if err != nil {
+        return err
+    }
+
+    if c.cfg.useTimescaleDb {
+        _, err = c.DB.Exec("CREATE EXTENSION IF NOT EXISTS timescaledb CASCADE")
+        if err != nil {
+            log.Info("msg", "Could not enable TimescaleDB extension", "error", err)
+        }
+    }
+    if c.cfg.pgbouncer {
+        return nil
+    }
+    return c.prepare()
+}
+
+func (c *pgPrometheusSchema) migrations() []migration {
+    return []migration{
+        {version: 1, description: "Create pg_prometheus tables", up: c.createTables},
+        c.metadataMigration(2),
+        c.stagingMigration(3, true),
+        c.backfillMigration(4),
+    }
+}
+
+// Tables created before migrations were tracked are taken as they are
+func (c *pgPrometheusSchema) createTables(ctx context.Context, tx *sql.Tx) error {
+    var exists bool
+    err := tx.QueryRowContext(ctx, sqlTableExists, c.cfg.table).Scan(&exists)
+    if err != nil || exists {
+        return err
+    }
+
+    _, err = tx.ExecContext(ctx, "SELECT create_prometheus_table($1, normalized_tables => $2, chunk_time_interval => $3,  use_timescaledb=> $4)",
+        c.cfg.table, c.cfg.pgPrometheusNormalize, c.cfg.pgPrometheusChunkInterval.String(), c.cfg.useTimescaleDb)
+    if err != nil {
+        return err
+    }
+
+    log.Info("msg", "Initialized pg_prometheus extension")
+    return nil
+}
+
+// Samples are staged in a tmp table unique to this process
+func (c *pgPrometheusSchema) prepare() error {
+    var err error
+
+    c.copyTableUniqId = time.Now().UnixNano() / int64(time.Millisecond)
+    c.createTmpTableStmt, err = c.DB.Prepare(fmt.Sprintf(sqlCreateTmpTable, c.cfg.table, c.copyTableUniqId))
+    if err != nil {
+        log.Error("msg", "Error on preparing create tmp table statement", "error", err)
+    }
+    return err
+}
+
+// The tables of pg_prometheus are created by its migrations
+func (c *pgPrometheusSchema) ensureTables(ctx context.Context, samples []format.Sample) error {
+    return nil
+}
+
+func (c *pgPrometheusSchema) insert(ctx context.Context, conn *sql.Conn, tx *sql.Tx, samples []format.Sample) (func(), error) {
+    var err error
+    if !c.cfg.pgbouncer {
+        _, err = tx.Stmt(c.createTmpTableStmt).Exec()
+        if err != nil {
+            log.Error("msg", "Error executing create tmp table", "error", err)
+            return nil, err
+        }
+    }
+
+    // Normalized samples are staged in the tmp table with the timestamp
+    // kept at full precision, everything else is copied in the text
+    // format of pg_prometheus which only carries milliseconds
+    staged := c.normalized()
+
+    var resolved map[string]int64
+    if staged && c.cache != nil {
+        resolved, err = c.insertSeries(ctx, conn, tx, samples)
+    } else if staged {
+        err = c.insertStaged(ctx, conn, tx, samples)
+    } else {
+        table := c.cfg.copyTable
+        if len(table) == 0 {
+            table = fmt.Sprintf("%s_samples", c.cfg.table)
+        }
+        err = c.copier.copyLines(ctx, conn, tx, table, samples)
+        if err != nil {
+            log.Error("msg", "Error executing COPY statement", "error", err)
+        }
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    // Staged rows of other transactions share the staging table
+    if staged && c.cfg.pgbouncer {
+        err = c.clearStaged(ctx, tx, c.staging())
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    // Label sets inserted by a rolled back transaction are gone, so new
+    // ids are only cached once they are committed
+    return func() {
+        for key, id := range resolved {
+            c.cache.put(key, id)
+        }
+    }, nil
+}
+
+// Only the normalized tables have a values table, the samples table has
+// no time or series column
+func (c *pgPrometheusSchema) valueTables(ctx context.Context) ([]valueTable, error) {
+    if !c.normalized() {
+        return nil, nil
+    }
+    return []valueTable{{name: fmt.Sprintf("%s_values", c.cfg.table), segmentBy: "labels_id", hypertable: c.cfg.useTimescaleDb}}, nil
+}
+
+// Lists the series of the labels table, the samples table has none
+func (c *pgPrometheusSchema) seriesQuery() string {
+    if !c.normalized() {
+        return ""
+    }
+    return fmt.Sprintf("SELECT metric_name, labels FROM %s_labels;", c.cfg.table)
+}
+
+func (c *pgPrometheusSchema) normalized() bool {
+    return len(c.cfg.copyTable) == 0 && c.cfg.pgPrometheusNormalize
+}
+
+// The table samples are staged in, a temporary table unique to this
+// process or with PG_PGBOUNCER an unlogged table shared by all
+func (c *pgPrometheusSchema) staging() string {
+    if c.cfg.pgbouncer {
+        return fmt.Sprintf("%s_staging", c.cfg.table)
+    }
+    return fmt.Sprintf("%s_tmp_%d", c.cfg.table, c.copyTableUniqId)
+}
+
+// Stages the samples in the tmp table, inserts the label sets that are
+// not known yet and the values through a join with the labels table
+func (c *pgPrometheusSchema) insertStaged(ctx context.Context, conn *sql.Conn, tx *sql.Tx, samples []format.Sample) error {
+    err := c.copier.copySamples(ctx, conn, tx, c.staging(), samples)
+    if err != nil {
+        log.Error("msg", "Error executing COPY statement", "error", err)
+        return err
+    }
+
+    staged := c.stagedRows(c.staging())
+    _, err = tx.ExecContext(ctx, fmt.Sprintf(sqlInsertLabels, c.cfg.table, staged, c.cfg.table))
+    if err != nil {
+        log.Error("msg", "Error executing labels statement", "error", err)
+        return err
+    }
+
+    err = c.insertDeduped(ctx, tx, fmt.Sprintf(sqlInsertValues, c.cfg.table, staged, c.cfg.table), "labels_id", len(samples))
+    if err != nil {
+        log.Error("msg", "Error executing values statement", "error", err)
+        return err
+    }
+    return nil
+}
+
+// Copies the samples of series whose id is cached straight into the
+// values table. The other samples are staged, their label sets upserted
+// and their values inserted through a join with the labels table. The
+// ids of the upserted label sets are returned to be cached.
+func (c *pgPrometheusSchema) insertSeries(ctx context.Context, conn *sql.Conn, tx *sql.Tx, samples []format.Sample) (map[string]int64, error) {
+    var labels []byte
+    var keys []string
+
+    known := make([]format.Sample, 0, len(samples))
+    ids := make([]int64, 0, len(samples))
+    missed := make([]format.Sample, 0)
+    for i := range samples {
+        s := &samples[i]
+        labels, keys = appendLabelsJSON(labels[:0], keys[:0], s.Labels)
+        if id, ok := c.cache.get(seriesKey(s.Name, labels)); ok {
+            known = append(known, *s)
+            ids = append(ids, id)
+            continue
+        }
+        missed = append(missed, *s)
+    }
+
+    seriesCacheHits.WithLabelValues(c.Name()).Add(float64(len(known)))
+    seriesCacheMisses.WithLabelValues(c.Name()).Add(float64(len(missed)))
+
+    if len(known) > 0 {
+        err := c.writeValues(ctx, conn, tx, []string{fmt.Sprintf("%s_values", c.cfg.table)}, "labels_id", known, ids)
+        if err != nil {
+            log.Error("msg", "Error executing COPY statement", "error", err)
+            return nil, err
+        }
+    }
+
+    if len(missed) == 0 {
+        return nil, nil
+    }
+
+    err := c.copier.copySamples(ctx, conn, tx, c.staging(), missed)
+    if err != nil {
+        log.Error("msg", "Error executing COPY statement", "error", err)
+        return nil, err
+    }
+
+    staged := c.stagedRows(c.staging())
+    rows, err := tx.QueryContext(ctx, fmt.Sprintf(sqlUpsertLabels, c.cfg.table, staged))
+    if err != nil {
+        log.Error("msg", "Error executing labels statement", "error", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    resolved := make(map[string]int64)
+    for rows.Next() {
+        var id int64
+        var name string
+        var raw []byte
+        if err = rows.Scan(&id, &name, &raw); err != nil {
+            log.Error("msg", "Error reading series ids", "error", err)
+            return nil, err
+        }
+
+        var m map[string]string
+        if err = json.Unmarshal(raw, &m); err != nil {
+            log.Error("msg", "Error reading series labels", "error", err)
+            return nil, err
+        }
+        labels, keys = appendLabelsJSON(labels[:0], keys[:0], m)
+        resolved[seriesKey(name, labels)] = id
+    }
+    if err = rows.Err(); err != nil {
+        log.Error("msg", "Error reading series ids", "error", err)
+        return nil, err
+    }
+
+    err = c.insertDeduped(ctx, tx, fmt.Sprintf(sqlInsertValues, c.cfg.table, staged, c.cfg.table), "labels_id", len(missed))
+    if err != nil {
+        log.Error("msg", "Error executing values statement", "error", err)
+        return nil, err
+    }
+    return resolved, nil
+}
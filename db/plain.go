@@ -0,0 +1,332 @@
+package pgdb
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "context"
+    "database/sql"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+    "github.com/arslanm/kafka-timescaledb-adapter/log"
+)
+
+const (
+    sqlCreateSeriesTable = "CREATE TABLE IF NOT EXISTS %s_series (id BIGSERIAL PRIMARY KEY, metric_name TEXT NOT NULL, labels JSONB NOT NULL, UNIQUE (metric_name, labels));"
+    sqlCreateSeriesIndex = "CREATE INDEX IF NOT EXISTS %s_series_labels_idx ON %s_series USING GIN (labels);"
+    sqlCreateValuesTable = "CREATE TABLE IF NOT EXISTS %s_values (time TIMESTAMPTZ NOT NULL, value DOUBLE PRECISION, series_id BIGINT NOT NULL)%s;"
+    sqlCreateValuesIndex = "CREATE INDEX IF NOT EXISTS %s_values_series_id_time_idx ON %s_values (series_id, time DESC);"
+    sqlCreateHypertable  = "SELECT create_hypertable('%s_values', 'time', chunk_time_interval => $1::interval, if_not_exists => true);"
+    sqlHasTimescaleDb    = "SELECT count(*) FROM pg_extension WHERE extname = 'timescaledb';"
+    sqlCreatePartition   = "CREATE TABLE IF NOT EXISTS %s_values_p%s PARTITION OF %s_values FOR VALUES FROM ('%s') TO ('%s');"
+    sqlIsPartitioned     = "SELECT count(*) FROM pg_partitioned_table WHERE partrelid = to_regclass($1);"
+    sqlIsHypertable      = "SELECT count(*) FROM timescaledb_information.hypertables WHERE hypertable_schema = current_schema() AND hypertable_name = $1;"
+    sqlLockPartitions    = "SELECT pg_advisory_xact_lock(hashtext('%s_values'));"
+    sqlGetSeries         = "INSERT INTO %s_series (metric_name, labels) VALUES ($1, $2::jsonb) ON CONFLICT (metric_name, labels) DO UPDATE SET metric_name = EXCLUDED.metric_name RETURNING id;"
+)
+
+// plainSchema writes into plain tables which need no extension: a
+// <table>_series table of label sets and a <table>_values table of
+// samples. The values table is created as a hypertable if TimescaleDB
+// is available, otherwise it is partitioned by time and partitions are
+// created as samples arrive. What the table turned out to be is looked
+// up once it exists.
+type plainSchema struct {
+    *Client
+
+    timescaleDb  bool
+    mtx          sync.RWMutex
+    hypertable   bool
+    partitioned  bool
+    partitions   map[int64]bool
+}
+
+func newPlainSchema(c *Client) *plainSchema {
+    return &plainSchema{Client: c, partitions: make(map[int64]bool)}
+}
+
+// Enables TimescaleDB if it is to be used and tells if it is available
+func (c *plainSchema) enableTimescaleDb() (bool, error) {
+    if !c.cfg.useTimescaleDb {
+        return false, nil
+    }
+
+    _, err := c.DB.Exec("CREATE EXTENSION IF NOT EXISTS timescaledb CASCADE")
+    if err != nil {
+        log.Info("msg", "Could not enable TimescaleDB extension", "error", err)
+    }
+
+    var n int
+    err = c.DB.QueryRow(sqlHasTimescaleDb).Scan(&n)
+    return n > 0, err
+}
+
+func (c *plainSchema) setup() error {
+    var err error
+
+    c.timescaleDb, err = c.enableTimescaleDb()
+    if err != nil {
+        return err
+    }
+
+    log.Info("msg", "Writing into plain tables", "table", c.cfg.table, "timescaledb", c.timescaleDb)
+    return nil
+}
+
+// Looks up whether a table is a hypertable or partitioned. The table
+// may predate the extension or have been created by hand, so this is
+// taken from the catalog rather than from the extension.
+func (c *plainSchema) tableKind(ctx context.Context, table string) (hypertable bool, partitioned bool, err error) {
+    var n int
+    if c.timescaleDb {
+        err = c.DB.QueryRowContext(ctx, sqlIsHypertable, table).Scan(&n)
+        if err != nil {
+            return false, false, err
+        }
+        hypertable = n > 0
+    }
+
+    err = c.DB.QueryRowContext(ctx, sqlIsPartitioned, table).Scan(&n)
+    if err != nil {
+        return false, false, err
+    }
+    return hypertable, n > 0, nil
+}
+
+func (c *plainSchema) migrations() []migration {
+    return []migration{
+        {version: 1, description: "Create series table", up: c.createSeriesTable},
+        {version: 2, description: "Create values table", up: c.createValuesTable},
+        c.metadataMigration(3),
+        c.stagingMigration(4, false),
+        c.backfillMigration(5),
+    }
+}
+
+func (c *plainSchema) createSeriesTable(ctx context.Context, tx *sql.Tx) error {
+    return execMigration(func() []string {
+        return []string{
+            fmt.Sprintf(sqlCreateSeriesTable, c.cfg.table),
+            fmt.Sprintf(sqlCreateSeriesIndex, c.cfg.table, c.cfg.table),
+        }
+    })(ctx, tx)
+}
+
+// The values table is a hypertable if TimescaleDB is available when it is
+// created, otherwise it is partitioned by time
+func (c *plainSchema) createValuesTable(ctx context.Context, tx *sql.Tx) error {
+    partitioning := ""
+    if !c.timescaleDb {
+        partitioning = " PARTITION BY RANGE (time)"
+    }
+
+    stmts := []string{
+        fmt.Sprintf(sqlCreateValuesTable, c.cfg.table, partitioning),
+        fmt.Sprintf(sqlCreateValuesIndex, c.cfg.table, c.cfg.table),
+    }
+    for _, stmt := range stmts {
+        _, err := tx.ExecContext(ctx, stmt)
+        if err != nil {
+            return err
+        }
+    }
+
+    if c.timescaleDb {
+        _, err := tx.ExecContext(ctx, fmt.Sprintf(sqlCreateHypertable, c.cfg.table), c.cfg.pgPrometheusChunkInterval.String())
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (c *plainSchema) ensureTables(ctx context.Context, samples []format.Sample) error {
+    c.mtx.RLock()
+    partitioned := c.partitioned
+    c.mtx.RUnlock()
+
+    if !partitioned {
+        return nil
+    }
+
+    err := c.createPartitions(ctx, samples)
+    if err != nil {
+        log.Error("msg", "Error creating partitions", "error", err)
+    }
+    return err
+}
+
+func (c *plainSchema) insert(ctx context.Context, conn *sql.Conn, tx *sql.Tx, samples []format.Sample) (func(), error) {
+    ids, resolved, err := c.seriesIds(ctx, tx, samples)
+    if err != nil {
+        log.Error("msg", "Error resolving series ids", "error", err)
+        return nil, err
+    }
+
+    err = c.writeValues(ctx, conn, tx, []string{fmt.Sprintf("%s_values", c.cfg.table)}, "series_id", samples, ids)
+    if err != nil {
+        log.Error("msg", "Error executing COPY statement", "error", err)
+        return nil, err
+    }
+
+    // Series inserted by a rolled back transaction are gone, so new ids
+    // are only cached once they are committed
+    return func() {
+        for key, id := range resolved {
+            c.cache.put(key, id)
+        }
+    }, nil
+}
+
+func (c *plainSchema) valueTables(ctx context.Context) ([]valueTable, error) {
+    table := fmt.Sprintf("%s_values", c.cfg.table)
+    hypertable, partitioned, err := c.tableKind(ctx, table)
+    if err != nil {
+        return nil, err
+    }
+
+    c.mtx.Lock()
+    c.hypertable, c.partitioned = hypertable, partitioned
+    c.mtx.Unlock()
+
+    return []valueTable{{name: table, segmentBy: "series_id", hypertable: hypertable}}, nil
+}
+
+// Lists the series of the series table
+func (c *plainSchema) seriesQuery() string {
+    return fmt.Sprintf("SELECT metric_name, labels FROM %s_series;", c.cfg.table)
+}
+
+// Returns the series id of each sample and the ids that were not cached
+func (c *plainSchema) seriesIds(ctx context.Context, tx *sql.Tx, samples []format.Sample) ([]int64, map[string]int64, error) {
+    var labels []byte
+    var keys []string
+
+    seriesKeys := make([]string, len(samples))
+    ids := make([]int64, len(samples))
+    missed := make(map[string]*format.Sample)
+    hits := 0
+    for i := range samples {
+        s := &samples[i]
+        labels, keys = appendLabelsJSON(labels[:0], keys[:0], s.Labels)
+        seriesKeys[i] = seriesKey(s.Name, labels)
+
+        id, ok := c.cache.get(seriesKeys[i])
+        if ok {
+            ids[i] = id
+            hits++
+            continue
+        }
+        missed[seriesKeys[i]] = s
+    }
+
+    seriesCacheHits.WithLabelValues(c.Name()).Add(float64(hits))
+    seriesCacheMisses.WithLabelValues(c.Name()).Add(float64(len(samples) - hits))
+
+    resolved, err := c.upsertSeries(ctx, tx, missed)
+    if err != nil {
+        return nil, nil, err
+    }
+    for i := range samples {
+        if id, ok := resolved[seriesKeys[i]]; ok {
+            ids[i] = id
+        }
+    }
+    return ids, resolved, nil
+}
+
+// Inserts the series that are not cached, or finds them if they exist,
+// in the order of their keys so concurrent batches don't deadlock
+func (c *plainSchema) upsertSeries(ctx context.Context, tx *sql.Tx, missed map[string]*format.Sample) (map[string]int64, error) {
+    resolved := make(map[string]int64, len(missed))
+    if len(missed) == 0 {
+        return resolved, nil
+    }
+
+    keys := make([]string, 0, len(missed))
+    for key := range missed {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    stmt, err := c.prepareTx(ctx, tx, fmt.Sprintf(sqlGetSeries, c.cfg.table))
+    if err != nil {
+        return nil, err
+    }
+    defer stmt.Close()
+
+    for _, key := range keys {
+        s := missed[key]
+
+        var id int64
+        err = stmt.QueryRowContext(ctx, s.Name, formatLabels(s.Labels)).Scan(&id)
+        if err != nil {
+            return nil, err
+        }
+        resolved[key] = id
+    }
+    return resolved, nil
+}
+
+// Creates the partitions the samples fall into. Partitions are created
+// in their own transaction under an advisory lock, so writers racing
+// for the same partition don't fail or block each other's batches.
+func (c *plainSchema) createPartitions(ctx context.Context, samples []format.Sample) error {
+    interval := c.cfg.pgPrometheusChunkInterval
+
+    missing := make(map[int64]time.Time)
+    c.mtx.RLock()
+    for i := range samples {
+        start := samples[i].Timestamp.UTC().Truncate(interval)
+        if !c.partitions[start.Unix()] {
+            missing[start.Unix()] = start
+        }
+    }
+    c.mtx.RUnlock()
+
+    if len(missing) == 0 {
+        return nil
+    }
+
+    tx, err := c.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+
+    defer tx.Rollback()
+
+    _, err = tx.ExecContext(ctx, fmt.Sprintf(sqlLockPartitions, c.cfg.table))
+    if err != nil {
+        return err
+    }
+
+    for _, start := range missing {
+        _, err = tx.ExecContext(ctx, fmt.Sprintf(sqlCreatePartition, c.cfg.table, partitionSuffix(start, interval), c.cfg.table,
+            start.Format(time.RFC3339Nano), start.Add(interval).Format(time.RFC3339Nano)))
+        if err != nil {
+            return err
+        }
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return err
+    }
+
+    c.mtx.Lock()
+    for id := range missing {
+        c.partitions[id] = true
+    }
+    c.mtx.Unlock()
+    return nil
+}
+
+// Names a partition after the UTC date it starts at, with the time of
+// day unless partitions span whole days
+func partitionSuffix(start time.Time, interval time.Duration) string {
+    if interval % (24 * time.Hour) == 0 {
+        return start.UTC().Format("20060102")
+    }
+    return start.UTC().Format("20060102_150405")
+}
@@ -0,0 +1,29 @@
+package pgdb
+
+import (
+    "testing"
+    "time"
+)
+
+func TestPartitionSuffix(t *testing.T) {
+    tests := []struct {
+        name      string
+        start     time.Time
+        interval  time.Duration
+        want      string
+    }{
+        {"hours", time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC), 12 * time.Hour, "20200913_120000"},
+        {"days", time.Date(2020, 9, 13, 0, 0, 0, 0, time.UTC), 24 * time.Hour, "20200913"},
+        {"weeks", time.Date(2020, 9, 10, 0, 0, 0, 0, time.UTC), 7 * 24 * time.Hour, "20200910"},
+        {"before 1970", time.Date(1969, 12, 31, 12, 0, 0, 0, time.UTC), 12 * time.Hour, "19691231_120000"},
+        {"other zone", time.Date(2020, 9, 13, 14, 0, 0, 0, time.FixedZone("CEST", 2*3600)), time.Hour, "20200913_120000"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := partitionSuffix(tt.start, tt.interval); got != tt.want {
+                t.Errorf("got %s, want %s", got, tt.want)
+            }
+        })
+    }
+}
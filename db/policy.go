@@ -0,0 +1,196 @@
+package pgdb
+
+import (
+    "fmt"
+    "time"
+    "context"
+    "database/sql"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/log"
+)
+
+const (
+    sqlGetPolicy = "SELECT job_id, COALESCE(%s, false) FROM timescaledb_information.jobs WHERE proc_name = $1 AND hypertable_schema = current_schema() AND hypertable_name = $2;"
+
+    sqlCompressionEnabled  = "SELECT compression_enabled FROM timescaledb_information.hypertables WHERE hypertable_schema = current_schema() AND hypertable_name = $1;"
+    sqlCompressionSegment  = "SELECT count(*) FROM timescaledb_information.compression_settings WHERE hypertable_schema = current_schema() AND hypertable_name = $1 AND attname = $2 AND segmentby_column_index IS NOT NULL;"
+    sqlEnableCompression   = "ALTER TABLE \"%s\" SET (timescaledb.compress, timescaledb.compress_segmentby = '%s', timescaledb.compress_orderby = 'time DESC');"
+    sqlReorderIndex        = "SELECT i.relname FROM pg_index x JOIN pg_class i ON i.oid = x.indexrelid JOIN pg_attribute a ON a.attrelid = x.indrelid AND a.attnum = x.indkey[0] WHERE x.indrelid = $1::regclass AND a.attname = $2 ORDER BY i.relname LIMIT 1;"
+
+    policyCompression = "policy_compression"
+    policyRetention   = "policy_retention"
+    policyReorder     = "policy_reorder"
+)
+
+// A table of a schema that holds samples with the column that
+// identifies their series and, if it holds a single metric, the name of
+// the metric. Lifecycle policies and rollups apply to the tables that
+// are hypertables.
+type valueTable struct {
+    name        string
+    segmentBy   string
+    metric      string
+    hypertable  bool
+}
+
+// How a policy is found, added and removed
+type policy struct {
+    proc     string
+    matches  string
+    add      string
+    remove   string
+}
+
+var policies = map[string]policy{
+    policyCompression: {
+        proc    : policyCompression,
+        matches : "(config->>'compress_after')::interval = NULLIF($3, '')::interval",
+        add     : "SELECT add_compression_policy($1::regclass, $2::interval);",
+        remove  : "SELECT remove_compression_policy($1::regclass, if_exists => true);",
+    },
+    policyRetention: {
+        proc    : policyRetention,
+        matches : "(config->>'drop_after')::interval = NULLIF($3, '')::interval",
+        add     : "SELECT add_retention_policy($1::regclass, $2::interval);",
+        remove  : "SELECT remove_retention_policy($1::regclass, if_exists => true);",
+    },
+    policyReorder: {
+        proc    : policyReorder,
+        matches : "config->>'index_name' = $3",
+        add     : "SELECT add_reorder_policy($1::regclass, $2);",
+        remove  : "SELECT remove_reorder_policy($1::regclass, if_exists => true);",
+    },
+}
+
+// What *sql.DB and *sql.Tx have in common
+type querier interface {
+    ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+    QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+    QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Applies the compression, retention and reorder policies to the
+// hypertables of the schema. Policies are compared with the jobs
+// TimescaleDB has for a hypertable: missing ones are added, ones whose
+// settings drifted from the config are replaced and ones that are
+// disabled in the config are removed.
+func (c *Client) applyPolicies(ctx context.Context, tables []valueTable) {
+    if !c.cfg.managePolicies {
+        return
+    }
+
+    for _, ht := range tables {
+        if !ht.hypertable {
+            continue
+        }
+
+        err := c.applyTablePolicies(ctx, c.DB, ht)
+        if err != nil {
+            log.Error("msg", "Error applying policies", "table", ht.name, "error", err)
+        }
+    }
+}
+
+func (c *Client) applyTablePolicies(ctx context.Context, q querier, ht valueTable) error {
+    if !c.cfg.managePolicies {
+        return nil
+    }
+
+    if c.cfg.compressAfter > 0 {
+        err := c.enableCompression(ctx, q, ht)
+        if err != nil {
+            return err
+        }
+    }
+
+    err := c.reconcilePolicy(ctx, q, ht, policies[policyCompression], interval(c.cfg.compressAfter))
+    if err != nil {
+        return err
+    }
+
+    err = c.reconcilePolicy(ctx, q, ht, policies[policyRetention], interval(c.cfg.retention))
+    if err != nil {
+        return err
+    }
+
+    index := ""
+    if c.cfg.reorder {
+        err = q.QueryRowContext(ctx, sqlReorderIndex, quoteIdent(ht.name), ht.segmentBy).Scan(&index)
+        if err == sql.ErrNoRows {
+            log.Info("msg", "No index to reorder chunks by", "table", ht.name, "column", ht.segmentBy)
+        } else if err != nil {
+            return err
+        }
+    }
+    return c.reconcilePolicy(ctx, q, ht, policies[policyReorder], index)
+}
+
+// Compression has to be enabled with the series column as segment-by
+// before a compression policy can be added
+func (c *Client) enableCompression(ctx context.Context, q querier, ht valueTable) error {
+    var enabled bool
+    err := q.QueryRowContext(ctx, sqlCompressionEnabled, ht.name).Scan(&enabled)
+    if err != nil {
+        return err
+    }
+
+    if enabled {
+        var segmented int
+        err = q.QueryRowContext(ctx, sqlCompressionSegment, ht.name, ht.segmentBy).Scan(&segmented)
+        if err != nil || segmented > 0 {
+            return err
+        }
+    }
+
+    _, err = q.ExecContext(ctx, fmt.Sprintf(sqlEnableCompression, ht.name, ht.segmentBy))
+    if err == nil {
+        log.Info("msg", "Enabled compression", "table", ht.name, "segmentby", ht.segmentBy)
+    }
+    return err
+}
+
+// Makes the policy of the hypertable match the setting, an empty setting
+// means there should be no policy
+func (c *Client) reconcilePolicy(ctx context.Context, q querier, ht valueTable, p policy, setting string) error {
+    var job int
+    var matches bool
+    err := q.QueryRowContext(ctx, fmt.Sprintf(sqlGetPolicy, p.matches), p.proc, ht.name, setting).Scan(&job, &matches)
+    if err != nil && err != sql.ErrNoRows {
+        return err
+    }
+    exists := err == nil
+
+    if exists && len(setting) > 0 && matches {
+        return nil
+    }
+
+    if exists {
+        _, err = q.ExecContext(ctx, p.remove, quoteIdent(ht.name))
+        if err != nil {
+            return err
+        }
+        log.Info("msg", "Removed policy", "table", ht.name, "policy", p.proc, "job", job)
+    }
+
+    if len(setting) > 0 {
+        _, err = q.ExecContext(ctx, p.add, quoteIdent(ht.name), setting)
+        if err != nil {
+            return err
+        }
+        log.Info("msg", "Added policy", "table", ht.name, "policy", p.proc, "setting", setting)
+    }
+    return nil
+}
+
+// Durations are passed to TimescaleDB as intervals, no duration means no
+// policy
+func interval(d time.Duration) string {
+    if d <= 0 {
+        return ""
+    }
+    return d.String()
+}
+
+func quoteIdent(name string) string {
+    return fmt.Sprintf("\"%s\"", name)
+}
@@ -0,0 +1,183 @@
+package pgdb
+
+import (
+    "os"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+    "context"
+)
+
+func TestGetConfigPolicies(t *testing.T) {
+    tests := []struct {
+        name           string
+        target         string
+        env            map[string]string
+        manage         bool
+        compressAfter  string
+        retention      string
+        reorder        bool
+    }{
+        {"defaults", "", nil, false, "", "", false},
+        {"all policies", "", map[string]string{
+            "PG_MANAGE_POLICIES" : "true",
+            "PG_COMPRESS_AFTER"  : "24h",
+            "PG_RETENTION"       : "720h",
+            "PG_REORDER"         : "true",
+        }, true, "24h0m0s", "720h0m0s", true},
+        {"zero durations", "", map[string]string{
+            "PG_MANAGE_POLICIES" : "true",
+            "PG_COMPRESS_AFTER"  : "0s",
+            "PG_RETENTION"       : "0s",
+        }, true, "", "", false},
+        {"target overrides", "new", map[string]string{
+            "PG_MANAGE_POLICIES"    : "true",
+            "PG_COMPRESS_AFTER"     : "24h",
+            "PG_NEW_COMPRESS_AFTER" : "1h",
+            "PG_RETENTION"          : "720h",
+        }, true, "1h0m0s", "720h0m0s", false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            for k, v := range tt.env {
+                os.Setenv(k, v)
+                defer os.Unsetenv(k)
+            }
+
+            cfg := GetConfig(&Config{}, tt.target)
+            if cfg.managePolicies != tt.manage {
+                t.Errorf("got managePolicies %v, want %v", cfg.managePolicies, tt.manage)
+            }
+            if got := interval(cfg.compressAfter); got != tt.compressAfter {
+                t.Errorf("got compression interval %q, want %q", got, tt.compressAfter)
+            }
+            if got := interval(cfg.retention); got != tt.retention {
+                t.Errorf("got retention interval %q, want %q", got, tt.retention)
+            }
+            if cfg.reorder != tt.reorder {
+                t.Errorf("got reorder %v, want %v", cfg.reorder, tt.reorder)
+            }
+        })
+    }
+}
+
+// Answers the job of a policy, if there is one, and whether it matches
+// the setting
+func policyAnswers(job []string) func(query string, args []string) ([]string, [][]string) {
+    return func(query string, args []string) ([]string, [][]string) {
+        if !strings.Contains(query, "timescaledb_information.jobs") {
+            return nil, nil
+        }
+        if job == nil || len(args) == 0 {
+            return []string{"job_id", "coalesce"}, nil
+        }
+        return []string{"job_id", "coalesce"}, [][]string{job}
+    }
+}
+
+// The statements adding and removing policies
+func policyStatements(queries *fakeLog) []string {
+    return queries.matching("_policy(")
+}
+
+func TestReconcilePolicy(t *testing.T) {
+    ht := valueTable{name: "metrics_values", segmentBy: "series_id", hypertable: true}
+
+    tests := []struct {
+        name     string
+        policy   string
+        job      []string
+        setting  string
+        want     []string
+    }{
+        {"missing", policyCompression, nil, "24h0m0s", []string{
+            `SELECT add_compression_policy($1::regclass, $2::interval); -- "metrics_values", 24h0m0s`,
+        }},
+        {"matching", policyCompression, []string{"1000", "t"}, "24h0m0s", nil},
+        {"drifted", policyRetention, []string{"1000", "f"}, "720h0m0s", []string{
+            `SELECT remove_retention_policy($1::regclass, if_exists => true); -- "metrics_values"`,
+            `SELECT add_retention_policy($1::regclass, $2::interval); -- "metrics_values", 720h0m0s`,
+        }},
+        {"disabled", policyRetention, []string{"1000", "f"}, "", []string{
+            `SELECT remove_retention_policy($1::regclass, if_exists => true); -- "metrics_values"`,
+        }},
+        {"disabled and missing", policyCompression, nil, "", nil},
+        {"reorder index changed", policyReorder, []string{"1000", "f"}, "metrics_values_series_id_time_idx", []string{
+            `SELECT remove_reorder_policy($1::regclass, if_exists => true); -- "metrics_values"`,
+            `SELECT add_reorder_policy($1::regclass, $2); -- "metrics_values", metrics_values_series_id_time_idx`,
+        }},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            queries := &fakeLog{answer: policyAnswers(tt.job)}
+            c := newFakeClient(t, "test", nil, queries)
+
+            err := c.reconcilePolicy(context.Background(), c.DB, ht, policies[tt.policy], tt.setting)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            lookups := queries.matching("timescaledb_information.jobs")
+            if len(lookups) != 1 || !strings.HasSuffix(lookups[0], " -- "+tt.policy+", metrics_values, "+tt.setting) {
+                t.Errorf("got policy lookups %v", lookups)
+            }
+            if got := policyStatements(queries); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("got statements %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestApplyTablePolicies(t *testing.T) {
+    ht := valueTable{name: "metrics_values", segmentBy: "series_id", hypertable: true}
+
+    tests := []struct {
+        name       string
+        enabled    string
+        segmented  string
+        alter      bool
+    }{
+        {"compression disabled", "f", "0", true},
+        {"segmented by another column", "t", "0", true},
+        {"segmented by the series", "t", "1", false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            queries := &fakeLog{answer: func(query string, args []string) ([]string, [][]string) {
+                switch {
+                case strings.Contains(query, "compression_enabled"):
+                    return []string{"compression_enabled"}, [][]string{{tt.enabled}}
+                case strings.Contains(query, "compression_settings"):
+                    return []string{"count"}, [][]string{{tt.segmented}}
+                }
+                return policyAnswers(nil)(query, args)
+            }}
+            c := newFakeClient(t, "test", nil, queries)
+            c.cfg.managePolicies = true
+            c.cfg.compressAfter = 24 * time.Hour
+
+            err := c.applyTablePolicies(context.Background(), c.DB, ht)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            alters := queries.matching("ALTER TABLE")
+            if tt.alter && (len(alters) != 1 || alters[0] != `ALTER TABLE "metrics_values" SET (timescaledb.compress, timescaledb.compress_segmentby = 'series_id', timescaledb.compress_orderby = 'time DESC');`) {
+                t.Errorf("got %v, want compression enabled by series_id", alters)
+            }
+            if !tt.alter && len(alters) > 0 {
+                t.Errorf("got %v, want compression left alone", alters)
+            }
+
+            // Only the compression policy is configured
+            want := []string{`SELECT add_compression_policy($1::regclass, $2::interval); -- "metrics_values", 24h0m0s`}
+            if got := policyStatements(queries); !reflect.DeepEqual(got, want) {
+                t.Errorf("got statements %v, want %v", got, want)
+            }
+        })
+    }
+}
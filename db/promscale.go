@@ -0,0 +1,215 @@
+package pgdb
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "context"
+    "database/sql"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+    "github.com/arslanm/kafka-timescaledb-adapter/log"
+)
+
+const (
+    sqlPromscaleSeries   = "SELECT m.metric_name, prom_api.jsonb(s.labels) - '__name__' FROM _prom_catalog.series s JOIN _prom_catalog.metric m ON m.id = s.metric_id;"
+    sqlPromscaleCatalog  = "SELECT count(*) FROM pg_namespace WHERE nspname = '_prom_catalog';"
+    sqlGetMetricTable    = "SELECT table_name FROM _prom_catalog.get_or_create_metric_table_name($1);"
+    sqlGetSeriesId       = "SELECT _prom_catalog.get_or_create_series_id($1::jsonb);"
+
+    promscaleDataSchema  = "prom_data"
+)
+
+// Columns of the metric tables of Promscale
+var promscaleColumns = []string{"time", "value", "series_id"}
+
+// promscaleSchema writes into a database set up by Promscale. The
+// table of a metric and the ids of series are resolved, and created if
+// needed, through the functions of _prom_catalog. Samples are copied
+// into the metric tables in prom_data.
+type promscaleSchema struct {
+    *Client
+
+    mtx     sync.RWMutex
+    tables  map[string]string
+}
+
+func newPromscaleSchema(c *Client) *promscaleSchema {
+    return &promscaleSchema{Client: c, tables: make(map[string]string)}
+}
+
+func (c *promscaleSchema) setup() error {
+    var n int
+    err := c.DB.QueryRow(sqlPromscaleCatalog).Scan(&n)
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return fmt.Errorf("Database %s has no Promscale catalog", c.cfg.database)
+    }
+
+    log.Info("msg", "Writing into Promscale schema")
+    return nil
+}
+
+// Lists the series of the series tables of Promscale
+func (c *promscaleSchema) seriesQuery() string {
+    return sqlPromscaleSeries
+}
+
+// Promscale owns its schema, only the metadata and backfill tables are
+// the adapter's
+func (c *promscaleSchema) migrations() []migration {
+    return []migration{c.metadataMigration(1), c.backfillMigration(2)}
+}
+
+// Promscale creates the table of a new metric within the transaction
+// of the batch
+func (c *promscaleSchema) ensureTables(ctx context.Context, samples []format.Sample) error {
+    return nil
+}
+
+func (c *promscaleSchema) insert(ctx context.Context, conn *sql.Conn, tx *sql.Tx, samples []format.Sample) (func(), error) {
+    metrics := make(map[string][]int)
+    for i := range samples {
+        metrics[samples[i].Name] = append(metrics[samples[i].Name], i)
+    }
+
+    // Metrics, and the series of each metric, are created in the same
+    // order by every writer so concurrent batches don't deadlock
+    names := make([]string, 0, len(metrics))
+    for name := range metrics {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var stmtSeries txStmt
+    var labels []byte
+    var keys []string
+
+    tables := make(map[string]string)
+    resolved := make(map[string]int64)
+    hits, misses := 0, 0
+
+    for _, name := range names {
+        table, err := c.metricTable(ctx, tx, name, tables)
+        if err != nil {
+            log.Error("msg", "Error resolving metric table", "metric", name, "error", err)
+            return nil, err
+        }
+
+        // The series of the metric that are not cached, resolved in the
+        // order of their keys
+        batch := make([]format.Sample, len(metrics[name]))
+        ids := make([]int64, len(metrics[name]))
+        seriesKeys := make([]string, len(metrics[name]))
+        missed := make(map[string]*format.Sample)
+        var missedAt []int
+        for j, i := range metrics[name] {
+            s := &samples[i]
+            batch[j] = *s
+            labels, keys = appendLabelsJSON(labels[:0], keys[:0], s.Labels)
+            seriesKeys[j] = seriesKey(s.Name, labels)
+
+            if id, ok := c.cache.get(seriesKeys[j]); ok {
+                ids[j] = id
+                hits++
+                continue
+            }
+            misses++
+            missedAt = append(missedAt, j)
+            if _, ok := resolved[seriesKeys[j]]; !ok {
+                missed[seriesKeys[j]] = s
+            }
+        }
+
+        pending := make([]string, 0, len(missed))
+        for key := range missed {
+            pending = append(pending, key)
+        }
+        sort.Strings(pending)
+
+        for _, key := range pending {
+            if stmtSeries == nil {
+                stmtSeries, err = c.prepareTx(ctx, tx, sqlGetSeriesId)
+                if err != nil {
+                    log.Error("msg", "Error on preparing series statement", "error", err)
+                    return nil, err
+                }
+                defer stmtSeries.Close()
+            }
+
+            var id int64
+            err = stmtSeries.QueryRowContext(ctx, seriesLabels(missed[key])).Scan(&id)
+            if err != nil {
+                log.Error("msg", "Error resolving series id", "metric", name, "error", err)
+                return nil, err
+            }
+            resolved[key] = id
+        }
+
+        for _, j := range missedAt {
+            ids[j] = resolved[seriesKeys[j]]
+        }
+
+        err = c.copier.copyValues(ctx, conn, tx, []string{promscaleDataSchema, table}, promscaleColumns, batch, ids)
+        if err != nil {
+            log.Error("msg", "Error executing COPY statement", "metric", name, "error", err)
+            return nil, err
+        }
+    }
+
+    seriesCacheHits.WithLabelValues(c.Name()).Add(float64(hits))
+    seriesCacheMisses.WithLabelValues(c.Name()).Add(float64(misses))
+
+    // Tables and series created by a rolled back transaction are gone,
+    // so they are only cached once they are committed
+    return func() {
+        c.mtx.Lock()
+        for name, table := range tables {
+            c.tables[name] = table
+        }
+        c.mtx.Unlock()
+
+        for key, id := range resolved {
+            c.cache.put(key, id)
+        }
+    }, nil
+}
+
+// Promscale manages the policies and constraints of its tables itself
+func (c *promscaleSchema) valueTables(ctx context.Context) ([]valueTable, error) {
+    return nil, nil
+}
+
+// Returns the table of a metric, from the tables known or resolved in
+// this batch or from the catalog
+func (c *promscaleSchema) metricTable(ctx context.Context, tx *sql.Tx, name string, tables map[string]string) (string, error) {
+    c.mtx.RLock()
+    table, ok := c.tables[name]
+    c.mtx.RUnlock()
+    if ok {
+        return table, nil
+    }
+
+    if table, ok = tables[name]; ok {
+        return table, nil
+    }
+
+    err := tx.QueryRowContext(ctx, sqlGetMetricTable, name).Scan(&table)
+    if err != nil {
+        return "", err
+    }
+    tables[name] = table
+    return table, nil
+}
+
+// Promscale keeps the metric name of a series as its __name__ label
+func seriesLabels(s *format.Sample) string {
+    labels := make(map[string]string, len(s.Labels)+1)
+    for k, v := range s.Labels {
+        labels[k] = v
+    }
+    labels["__name__"] = s.Name
+    return formatLabels(labels)
+}
@@ -0,0 +1,146 @@
+package pgdb
+
+import (
+    "fmt"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+    "context"
+    "database/sql"
+    "encoding/json"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+)
+
+func TestSeriesLabels(t *testing.T) {
+    tests := []struct {
+        name    string
+        sample  format.Sample
+        want    map[string]string
+    }{
+        {"no labels", format.Sample{Name: "up"}, map[string]string{"__name__": "up"}},
+        {"labels", format.Sample{Name: "up", Labels: map[string]string{"job": "api"}}, map[string]string{"__name__": "up", "job": "api"}},
+        {"name label replaced", format.Sample{Name: "up", Labels: map[string]string{"__name__": "down"}}, map[string]string{"__name__": "up"}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            before := len(tt.sample.Labels)
+
+            var got map[string]string
+            if err := json.Unmarshal([]byte(seriesLabels(&tt.sample)), &got); err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("got %v, want %v", got, tt.want)
+            }
+            if len(tt.sample.Labels) != before {
+                t.Error("expected the labels of the sample to stay unchanged")
+            }
+        })
+    }
+}
+
+// Answers the catalog functions of Promscale, series ids count up from
+// 100 in the order they are asked for
+func promscaleAnswers() func(query string, args []string) ([]string, [][]string) {
+    next := 100
+    return func(query string, args []string) ([]string, [][]string) {
+        switch {
+        case strings.Contains(query, "get_or_create_metric_table_name"):
+            if len(args) == 0 {
+                return []string{"table_name"}, nil
+            }
+            return []string{"table_name"}, [][]string{{args[0]}}
+        case strings.Contains(query, "get_or_create_series_id"):
+            if len(args) == 0 {
+                return []string{"id"}, nil
+            }
+            next++
+            return []string{"id"}, [][]string{{fmt.Sprint(next)}}
+        }
+        return nil, nil
+    }
+}
+
+func TestPromscaleInsert(t *testing.T) {
+    ts := time.Unix(1600000000, 0).UTC()
+    sample := func(name string, instance string) format.Sample {
+        return format.Sample{Name: name, Labels: map[string]string{"instance": instance}, Value: 1, Timestamp: ts}
+    }
+
+    // Unsorted metrics and series, a series twice and one that is cached
+    samples := []format.Sample{
+        sample("up", "c"),
+        sample("load", "b"),
+        sample("up", "a"),
+        sample("up", "c"),
+        sample("load", "a"),
+        sample("up", "b"),
+    }
+
+    queries := &fakeLog{answer: promscaleAnswers()}
+    c := &Client{
+        DB     : openFakeDB(t, queries),
+        cfg    : &Config{name: "test", dedupe: DEDUPE_OFF},
+        copier : &pqCopier{},
+        cache  : newSeriesCache(10, "test"),
+    }
+    s := newPromscaleSchema(c)
+    c.schema = s
+
+    labels, _ := appendLabelsJSON(nil, nil, map[string]string{"instance": "b"})
+    c.cache.put(seriesKey("up", labels), 7)
+
+    ctx := context.Background()
+    conn, err := c.DB.Conn(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    tx, err := conn.BeginTx(ctx, &sql.TxOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer tx.Rollback()
+
+    committed, err := s.insert(ctx, conn, tx, samples)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Metrics in the order of their names, the series of each in the
+    // order of their keys, each resolved once
+    var got []string
+    for _, q := range queries.matching("_prom_catalog.get_or_create") {
+        got = append(got, q[strings.Index(q, " -- ")+4:])
+    }
+    want := []string{
+        "load",
+        `{"__name__":"load","instance":"a"}`,
+        `{"__name__":"load","instance":"b"}`,
+        "up",
+        `{"__name__":"up","instance":"a"}`,
+        `{"__name__":"up","instance":"c"}`,
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("got catalog calls %v, want %v", got, want)
+    }
+    if n := queries.count("COPY"); n != 2 {
+        t.Errorf("got %d COPY statements, want 2", n)
+    }
+
+    // Tables and series are cached once the transaction is committed
+    if _, ok := s.tables["up"]; ok {
+        t.Error("expected the tables not to be cached before the commit")
+    }
+    committed()
+    if s.tables["up"] != "up" || s.tables["load"] != "load" {
+        t.Errorf("got tables %v", s.tables)
+    }
+    labels, _ = appendLabelsJSON(nil, nil, map[string]string{"instance": "c"})
+    if id, ok := c.cache.get(seriesKey("up", labels)); !ok || id != 104 {
+        t.Errorf("got cached id %d, %v for up{instance=c}, want 104", id, ok)
+    }
+}
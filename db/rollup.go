@@ -0,0 +1,280 @@
+package pgdb
+
+import (
+    "os"
+    "fmt"
+    "time"
+    "bufio"
+    "regexp"
+    "strings"
+    "context"
+    "database/sql"
+
+    "github.com/prometheus/client_golang/prometheus"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/log"
+)
+
+const (
+    sqlCreateRollup    = "CREATE MATERIALIZED VIEW IF NOT EXISTS \"%s\" WITH (timescaledb.continuous) AS SELECT time_bucket('%s', time) AS bucket, %s, %s FROM \"%s\" GROUP BY bucket, %s WITH NO DATA;"
+    sqlGetRollupPolicy = "SELECT j.job_id, (j.config->>'start_offset')::interval = $2::interval AND (j.config->>'end_offset')::interval = $3::interval AND j.schedule_interval = $4::interval FROM timescaledb_information.continuous_aggregates ca JOIN timescaledb_information.jobs j ON j.hypertable_schema = ca.materialization_hypertable_schema AND j.hypertable_name = ca.materialization_hypertable_name WHERE j.proc_name = 'policy_refresh_continuous_aggregate' AND ca.view_schema = current_schema() AND ca.view_name = $1;"
+    sqlAddRollupPolicy = "SELECT add_continuous_aggregate_policy($1::regclass, start_offset => $2::interval, end_offset => $3::interval, schedule_interval => $4::interval);"
+    sqlRemoveRollupPolicy = "SELECT remove_continuous_aggregate_policy($1::regclass, if_exists => true);"
+    sqlRollupStatus    = "SELECT COALESCE(EXTRACT(EPOCH FROM js.last_successful_finish), 0), js.total_failures FROM timescaledb_information.continuous_aggregates ca JOIN timescaledb_information.jobs j ON j.hypertable_schema = ca.materialization_hypertable_schema AND j.hypertable_name = ca.materialization_hypertable_name JOIN timescaledb_information.job_stats js ON js.job_id = j.job_id WHERE j.proc_name = 'policy_refresh_continuous_aggregate' AND ca.view_schema = current_schema() AND ca.view_name = $1;"
+)
+
+var (
+    rollupLastSuccess = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace : "kafka_timescale_adapter",
+            Name      : "rollup_last_refresh_timestamp_seconds",
+            Help      : "Time of the last successful refresh of a rollup.",
+        },
+        []string{"remote", "rollup"},
+    )
+
+    rollupFailures = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace : "kafka_timescale_adapter",
+            Name      : "rollup_refresh_failures",
+            Help      : "Number of failed refreshes of a rollup.",
+        },
+        []string{"remote", "rollup"},
+    )
+)
+
+// Aggregates a rollup can keep of the values in a bucket
+var rollupAggregates = map[string]string{
+    "avg"   : "avg(value)",
+    "min"   : "min(value)",
+    "max"   : "max(value)",
+    "sum"   : "sum(value)",
+    "count" : "count(value)",
+    "first" : "first(value, time)",
+    "last"  : "last(value, time)",
+}
+
+// A rollup is a continuous aggregate of the values of a hypertable in
+// buckets of a width, refreshed by a policy. It is configured as
+//
+//   name bucket aggregates start_offset end_offset schedule [metrics]
+//
+// e.g. "5m 5m avg,min,max,last 2h 5m 5m". Without a regular expression
+// of metric names the rollup is created on the hypertables shared by all
+// metrics, with one it is created on the tables of the matching metrics
+// of the per_metric layout.
+type rollup struct {
+    name         string
+    bucket       time.Duration
+    aggregates   []string
+    startOffset  time.Duration
+    endOffset    time.Duration
+    schedule     time.Duration
+    metrics      *regexp.Regexp
+}
+
+// Rollups are read from PG_ROLLUPS, separated by semicolons, and from
+// the lines of PG_ROLLUPS_FILE
+func parseRollups(entries string, filename string) ([]rollup, error) {
+    lines := strings.Split(entries, ";")
+
+    if len(filename) > 0 {
+        file, err := os.Open(filename)
+        if err != nil {
+            return nil, err
+        }
+        defer file.Close()
+
+        scanner := bufio.NewScanner(file)
+        for scanner.Scan() {
+            lines = append(lines, scanner.Text())
+        }
+        if err = scanner.Err(); err != nil {
+            return nil, err
+        }
+    }
+
+    rollups := make([]rollup, 0)
+    for _, line := range lines {
+        line = strings.TrimSpace(line)
+        if len(line) == 0 || line[0] == '#' {
+            continue
+        }
+
+        r, err := parseRollup(line)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid rollup %q: %v", line, err)
+        }
+        rollups = append(rollups, r)
+    }
+    return rollups, nil
+}
+
+func parseRollup(line string) (rollup, error) {
+    var r rollup
+
+    fields := strings.Fields(line)
+    if len(fields) < 6 || len(fields) > 7 {
+        return r, fmt.Errorf("Expected name, bucket, aggregates, start offset, end offset, schedule and optionally metrics")
+    }
+
+    r.name = fields[0]
+    if !regexp.MustCompile(`^[a-z0-9_]+$`).MatchString(r.name) {
+        return r, fmt.Errorf("Name can only have lower case letters, digits and underscores")
+    }
+
+    durations := []*time.Duration{&r.bucket, nil, &r.startOffset, &r.endOffset, &r.schedule}
+    for i, d := range durations {
+        if d == nil {
+            continue
+        }
+        var err error
+        *d, err = time.ParseDuration(fields[i+1])
+        if err != nil {
+            return r, err
+        }
+    }
+
+    for _, agg := range strings.Split(fields[2], ",") {
+        if _, ok := rollupAggregates[agg]; !ok {
+            return r, fmt.Errorf("Unknown aggregate %q", agg)
+        }
+        r.aggregates = append(r.aggregates, agg)
+    }
+
+    if len(fields) == 7 {
+        var err error
+        r.metrics, err = regexp.Compile(fields[6])
+        if err != nil {
+            return r, err
+        }
+    }
+    return r, nil
+}
+
+// Whether the rollup belongs on the hypertable
+func (r *rollup) applies(ht valueTable) bool {
+    if !ht.hypertable {
+        return false
+    }
+    if r.metrics == nil {
+        return len(ht.metric) == 0
+    }
+    return len(ht.metric) > 0 && r.metrics.MatchString(ht.metric)
+}
+
+// Views are named <table>_<rollup>. PostgreSQL would cut names that are
+// too long, so those are shortened the way metric tables are.
+func (r *rollup) view(ht valueTable) string {
+    view := fmt.Sprintf("%s_%s", ht.name, r.name)
+    if len(view) <= maxIdentifierLength {
+        return view
+    }
+    return hashedIdentifier(view, view)
+}
+
+// Creates the rollups of the hypertables that don't have them yet and
+// reconciles their refresh policies. A rollup that exists is not
+// redefined, changing its bucket or aggregates needs dropping its view.
+func (c *Client) applyRollups(ctx context.Context, tables []valueTable) {
+    for _, ht := range tables {
+        for i := range c.rollups {
+            r := &c.rollups[i]
+            if !r.applies(ht) {
+                continue
+            }
+
+            err := c.createRollup(ctx, r, ht)
+            if err != nil {
+                log.Error("msg", "Error creating rollup", "table", ht.name, "rollup", r.name, "error", err)
+            }
+        }
+    }
+}
+
+func (c *Client) createRollup(ctx context.Context, r *rollup, ht valueTable) error {
+    view := r.view(ht)
+
+    columns := make([]string, 0, len(r.aggregates))
+    for _, agg := range r.aggregates {
+        columns = append(columns, fmt.Sprintf("%s AS %s", rollupAggregates[agg], agg))
+    }
+
+    // Continuous aggregates can't be created in a transaction
+    _, err := c.DB.ExecContext(ctx, fmt.Sprintf(sqlCreateRollup, view, interval(r.bucket), ht.segmentBy,
+        strings.Join(columns, ", "), ht.name, ht.segmentBy))
+    if err != nil {
+        return err
+    }
+
+    var job int
+    var matches sql.NullBool
+    err = c.DB.QueryRowContext(ctx, sqlGetRollupPolicy, view, r.startOffset.String(), r.endOffset.String(),
+        r.schedule.String()).Scan(&job, &matches)
+    if err != nil && err != sql.ErrNoRows {
+        return err
+    }
+    if err == nil && matches.Valid && matches.Bool {
+        return nil
+    }
+
+    if err == nil {
+        _, err = c.DB.ExecContext(ctx, sqlRemoveRollupPolicy, quoteIdent(view))
+        if err != nil {
+            return err
+        }
+        log.Info("msg", "Removed rollup policy", "rollup", view, "job", job)
+    }
+
+    _, err = c.DB.ExecContext(ctx, sqlAddRollupPolicy, quoteIdent(view), r.startOffset.String(), r.endOffset.String(), r.schedule.String())
+    if err != nil {
+        return err
+    }
+    log.Info("msg", "Added rollup policy", "rollup", view, "bucket", r.bucket, "aggregates", strings.Join(r.aggregates, ","))
+    return nil
+}
+
+// Adds the rollups of the hypertables to the ones whose status is
+// reported
+func (c *Client) trackRollups(tables []valueTable) {
+    views := make([]string, 0)
+    for _, ht := range tables {
+        for i := range c.rollups {
+            if c.rollups[i].applies(ht) {
+                views = append(views, c.rollups[i].view(ht))
+            }
+        }
+    }
+
+    c.mtx.Lock()
+    c.rollupViews = append(c.rollupViews, views...)
+    c.mtx.Unlock()
+}
+
+// Reports the status of the refresh jobs of the rollups every interval
+func (c *Client) runRollupStatus() {
+    ticker := time.NewTicker(c.cfg.rollupStatusInterval)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        c.mtx.Lock()
+        views := append([]string(nil), c.rollupViews...)
+        c.mtx.Unlock()
+
+        for _, view := range views {
+            var last float64
+            var failures int64
+            err := c.DB.QueryRow(sqlRollupStatus, view).Scan(&last, &failures)
+            if err == sql.ErrNoRows {
+                continue
+            }
+            if err != nil {
+                log.Error("msg", "Error reading rollup status", "rollup", view, "error", err)
+                continue
+            }
+
+            rollupLastSuccess.WithLabelValues(c.Name(), view).Set(last)
+            rollupFailures.WithLabelValues(c.Name(), view).Set(float64(failures))
+        }
+    }
+}
@@ -0,0 +1,142 @@
+package pgdb
+
+import (
+    "os"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+    "path/filepath"
+)
+
+func TestParseRollup(t *testing.T) {
+    tests := []struct {
+        name  string
+        line  string
+        want  rollup
+        err   bool
+    }{
+        {"shared hypertable", "5m 5m avg,min,max,last 2h 5m 5m", rollup{name: "5m", bucket: 5 * time.Minute,
+            aggregates: []string{"avg", "min", "max", "last"}, startOffset: 2 * time.Hour, endOffset: 5 * time.Minute, schedule: 5 * time.Minute}, false},
+        {"tabs and spaces", "hourly\t1h  sum 24h 1h 30m", rollup{name: "hourly", bucket: time.Hour,
+            aggregates: []string{"sum"}, startOffset: 24 * time.Hour, endOffset: time.Hour, schedule: 30 * time.Minute}, false},
+        {"too few fields", "5m 5m avg 2h 5m", rollup{}, true},
+        {"too many fields", "5m 5m avg 2h 5m 5m ^node_ extra", rollup{}, true},
+        {"invalid name", "Five-Min 5m avg 2h 5m 5m", rollup{}, true},
+        {"invalid bucket", "5m five avg 2h 5m 5m", rollup{}, true},
+        {"invalid offset", "5m 5m avg 2 5m 5m", rollup{}, true},
+        {"unknown aggregate", "5m 5m avg,median 2h 5m 5m", rollup{}, true},
+        {"invalid regexp", "5m 5m avg 2h 5m 5m ^node_(", rollup{}, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := parseRollup(tt.line)
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("expected an error, got %v", got)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("got %+v, want %+v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestParseRollups(t *testing.T) {
+    filename := filepath.Join(t.TempDir(), "rollups")
+    err := os.WriteFile(filename, []byte("# Hourly buckets of the node metrics\nnode_1h 1h avg 24h 1h 1h ^node_\n\n"), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    rollups, err := parseRollups("5m 5m avg 2h 5m 5m; ;daily 24h max 168h 24h 1h", filename)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    names := make([]string, 0, len(rollups))
+    for _, r := range rollups {
+        names = append(names, r.name)
+    }
+    if !reflect.DeepEqual(names, []string{"5m", "daily", "node_1h"}) {
+        t.Errorf("got rollups %v", names)
+    }
+    if rollups[2].metrics == nil || !rollups[2].metrics.MatchString("node_load1") {
+        t.Errorf("expected the rollup of the file to match node metrics")
+    }
+
+    if _, err = parseRollups("5m 5m avg", ""); err == nil {
+        t.Error("expected an error for an invalid rollup")
+    }
+    if _, err = parseRollups("", filepath.Join(t.TempDir(), "missing")); err == nil {
+        t.Error("expected an error for a missing file")
+    }
+}
+
+func TestRollupApplies(t *testing.T) {
+    shared, err := parseRollup("5m 5m avg 2h 5m 5m")
+    if err != nil {
+        t.Fatal(err)
+    }
+    node, err := parseRollup("5m 5m avg 2h 5m 5m ^node_")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    values := valueTable{name: "metrics_values", hypertable: true}
+    nodeLoad := valueTable{name: "metrics_node_load1", metric: "node_load1", hypertable: true}
+    up := valueTable{name: "metrics_up", metric: "up", hypertable: true}
+    plain := valueTable{name: "metrics_node_cpu", metric: "node_cpu"}
+
+    tests := []struct {
+        name  string
+        r     rollup
+        ht    valueTable
+        want  bool
+    }{
+        {"shared on shared table", shared, values, true},
+        {"shared on metric table", shared, nodeLoad, false},
+        {"metrics on matching table", node, nodeLoad, true},
+        {"metrics on other table", node, up, false},
+        {"metrics on shared table", node, values, false},
+        {"not a hypertable", node, plain, false},
+    }
+    for _, tt := range tests {
+        if got := tt.r.applies(tt.ht); got != tt.want {
+            t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+        }
+    }
+
+    if v := node.view(nodeLoad); v != "metrics_node_load1_5m" {
+        t.Errorf("unexpected view name %s", v)
+    }
+}
+
+func TestRollupViewLength(t *testing.T) {
+    r, err := parseRollup("5m 5m avg 2h 5m 5m")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // A metric table name of the maximum length, and another one that
+    // only differs past the length a view keeps of it
+    long := valueTable{name: strings.Repeat("a", maxIdentifierLength), hypertable: true}
+    other := valueTable{name: strings.Repeat("a", maxIdentifierLength-1) + "b", hypertable: true}
+
+    v := r.view(long)
+    if len(v) != maxIdentifierLength {
+        t.Errorf("got view %s of %d bytes, want %d", v, len(v), maxIdentifierLength)
+    }
+    if v != r.view(long) {
+        t.Error("expected the view name to be stable")
+    }
+    if v == r.view(other) {
+        t.Errorf("expected views of different tables to differ, both are %s", v)
+    }
+}
@@ -0,0 +1,58 @@
+package pgdb
+
+import (
+    "fmt"
+    "context"
+    "database/sql"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+)
+
+const (
+    SCHEMA_PG_PROMETHEUS = "pg_prometheus"
+    SCHEMA_PROMSCALE     = "promscale"
+    SCHEMA_PLAIN         = "plain"
+    SCHEMA_PER_METRIC    = "per_metric"
+)
+
+// A schema lays out samples in the database
+type schema interface {
+    // Checks the extensions the layout needs at startup, before its
+    // migrations are applied
+    setup() error
+
+    // Steps creating and evolving the tables of the layout, in the order
+    // of their versions
+    migrations() []migration
+
+    // Creates the tables or partitions the samples go to that don't
+    // exist yet. Runs before the connection of the batch is taken, as
+    // DDL in a transaction of its own needs a connection of the pool.
+    ensureTables(ctx context.Context, samples []format.Sample) error
+
+    // Writes samples within tx, which was started on conn. The function
+    // returned, if any, is called once tx is committed.
+    insert(ctx context.Context, conn *sql.Conn, tx *sql.Tx, samples []format.Sample) (func(), error)
+
+    // Lists the tables samples are written to with the column of the
+    // ids of their series
+    valueTables(ctx context.Context) ([]valueTable, error)
+
+    // Query listing the metric name and labels of each series, empty if
+    // the layout has no table of series
+    seriesQuery() string
+}
+
+func newSchema(mode string, c *Client) (schema, error) {
+    switch mode {
+    case SCHEMA_PG_PROMETHEUS:
+        return &pgPrometheusSchema{Client: c}, nil
+    case SCHEMA_PROMSCALE:
+        return newPromscaleSchema(c), nil
+    case SCHEMA_PLAIN:
+        return newPlainSchema(c), nil
+    case SCHEMA_PER_METRIC:
+        return newPerMetricSchema(c), nil
+    }
+    return nil, fmt.Errorf("Unknown schema mode %q", mode)
+}
@@ -0,0 +1,121 @@
+package pgdb
+
+import (
+    "fmt"
+    "sort"
+    "regexp"
+    "strings"
+    "hash/fnv"
+
+    "github.com/prometheus/client_golang/prometheus"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+)
+
+const (
+    ROUTING_FANOUT = "fanout"
+    ROUTING_SHARD  = "shard"
+
+    DEFAULT_PG_ROUTING     = ROUTING_FANOUT
+    DEFAULT_PG_SHARD_RULES = ""
+
+    // Points each shard has on the hash ring
+    shardVirtualNodes = 128
+)
+
+var routedSamples = prometheus.NewCounterVec(
+    prometheus.CounterOpts{
+        Namespace : "kafka_timescale_adapter",
+        Name      : "routed_samples_total",
+        Help      : "Total number of samples routed to a shard, by a rule or by the hash of their series.",
+    },
+    []string{"remote", "route"},
+)
+
+// shardRouter picks the shard of a sample. The first rule whose regular
+// expression matches the metric name decides, otherwise the series is
+// placed on a consistent hash ring of the shard names so that adding or
+// removing a shard only moves the series of its part of the ring.
+type shardRouter struct {
+    rules  []shardRule
+    ring   []ringPoint
+}
+
+type shardRule struct {
+    re     *regexp.Regexp
+    shard  int
+}
+
+type ringPoint struct {
+    hash   uint32
+    shard  int
+}
+
+// Rules are given as regexp=shard entries separated by semicolons
+func newShardRouter(names []string, rules string) (*shardRouter, error) {
+    shards := make(map[string]int, len(names))
+    for i, name := range names {
+        shards[name] = i
+    }
+
+    r := &shardRouter{}
+    for _, rule := range strings.Split(rules, ";") {
+        rule = strings.TrimSpace(rule)
+        if len(rule) == 0 {
+            continue
+        }
+
+        i := strings.LastIndex(rule, "=")
+        if i <= 0 {
+            return nil, fmt.Errorf("Invalid shard rule %q", rule)
+        }
+        shard, ok := shards[strings.TrimSpace(rule[i+1:])]
+        if !ok {
+            return nil, fmt.Errorf("Shard rule %q names a target that is not in PG_TARGETS", rule)
+        }
+        // Rules match whole metric names
+        re, err := regexp.Compile("^(?:" + strings.TrimSpace(rule[:i]) + ")$")
+        if err != nil {
+            return nil, fmt.Errorf("Invalid shard rule %q: %v", rule, err)
+        }
+        r.rules = append(r.rules, shardRule{re: re, shard: shard})
+    }
+
+    for i, name := range names {
+        for n := 0; n < shardVirtualNodes; n++ {
+            r.ring = append(r.ring, ringPoint{hash: hashString(fmt.Sprintf("%s#%d", name, n)), shard: i})
+        }
+    }
+    sort.Slice(r.ring, func(i, j int) bool {
+        return r.ring[i].hash < r.ring[j].hash
+    })
+
+    return r, nil
+}
+
+// Returns the shard of the sample and whether a rule picked it. labels
+// and keys are scratch space for the series key and returned for reuse.
+func (r *shardRouter) route(s *format.Sample, labels []byte, keys []string) (int, bool, []byte, []string) {
+    for _, rule := range r.rules {
+        if rule.re.MatchString(s.Name) {
+            return rule.shard, true, labels, keys
+        }
+    }
+
+    labels, keys = appendLabelsJSON(labels[:0], keys[:0], s.Labels)
+    h := hashString(seriesKey(s.Name, labels))
+
+    i := sort.Search(len(r.ring), func(i int) bool {
+        return r.ring[i].hash >= h
+    })
+    if i == len(r.ring) {
+        i = 0
+    }
+    return r.ring[i].shard, false, labels, keys
+}
+
+func hashString(s string) uint32 {
+    h := fnv.New32a()
+    h.Write([]byte(s))
+    return h.Sum32()
+}
@@ -0,0 +1,127 @@
+package pgdb
+
+import (
+    "fmt"
+    "testing"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+)
+
+func TestNewShardRouter(t *testing.T) {
+    names := []string{"a", "b"}
+
+    tests := []struct {
+        name   string
+        rules  string
+        n      int
+        err    bool
+    }{
+        {"no rules", "", 0, false},
+        {"rules", "node_.*=a; http_.*=b ;", 2, false},
+        {"equal sign in regexp", "a=b=b", 1, false},
+        {"no shard", "node_.*", 0, true},
+        {"unknown shard", "node_.*=c", 0, true},
+        {"invalid regexp", "node_(=a", 0, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r, err := newShardRouter(names, tt.rules)
+            if tt.err {
+                if err == nil {
+                    t.Fatal("expected an error")
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(r.rules) != tt.n {
+                t.Errorf("got %d rules, want %d", len(r.rules), tt.n)
+            }
+            if len(r.ring) != len(names)*shardVirtualNodes {
+                t.Errorf("got %d ring points, want %d", len(r.ring), len(names)*shardVirtualNodes)
+            }
+        })
+    }
+}
+
+func TestShardRouterRoute(t *testing.T) {
+    r, err := newShardRouter([]string{"a", "b", "c"}, "node_.*=b;node_cpu.*=c;http_requests=c")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name    string
+        metric  string
+        shard   int
+        rule    bool
+    }{
+        {"first matching rule", "node_cpu_seconds_total", 1, true},
+        {"rule", "node_load1", 1, true},
+        {"whole name", "http_requests", 2, true},
+        {"prefix of the name", "http_requests_total", -1, false},
+        {"suffix of the name", "my_http_requests", -1, false},
+    }
+    for _, tt := range tests {
+        shard, rule, _, _ := r.route(&format.Sample{Name: tt.metric}, nil, nil)
+        if rule != tt.rule || tt.rule && shard != tt.shard {
+            t.Errorf("%s: got shard %d, rule %v, want %d, %v", tt.name, shard, rule, tt.shard, tt.rule)
+        }
+    }
+
+    // A series always goes to the same shard whatever the order of its
+    // labels
+    s := &format.Sample{Name: "up", Labels: map[string]string{"job": "api", "instance": "a:9090"}}
+    first, rule, labels, keys := r.route(s, nil, nil)
+    if rule {
+        t.Error("expected the series to be hashed")
+    }
+    for i := 0; i < 10; i++ {
+        again := &format.Sample{Name: "up", Labels: map[string]string{"instance": "a:9090", "job": "api"}}
+        var shard int
+        shard, _, labels, keys = r.route(again, labels, keys)
+        if shard != first {
+            t.Fatalf("series moved from shard %d to %d", first, shard)
+        }
+    }
+}
+
+func TestShardRouterRing(t *testing.T) {
+    three, err := newShardRouter([]string{"a", "b", "c"}, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    four, err := newShardRouter([]string{"a", "b", "c", "d"}, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    const series = 10000
+    counts := make([]int, 3)
+    moved := 0
+    for i := 0; i < series; i++ {
+        s := &format.Sample{Name: "up", Labels: map[string]string{"instance": fmt.Sprintf("10.0.%d.%d:9090", i/256, i%256)}}
+        before, _, _, _ := three.route(s, nil, nil)
+        after, _, _, _ := four.route(s, nil, nil)
+        counts[before]++
+        if before != after {
+            if after != 3 {
+                t.Fatalf("series moved from shard %d to %d instead of to the new shard", before, after)
+            }
+            moved++
+        }
+    }
+
+    // Roughly a third of the series per shard and a quarter moving to
+    // the new one
+    for i, n := range counts {
+        if n < series/5 || n > series/2 {
+            t.Errorf("shard %d has %d of %d series", i, n, series)
+        }
+    }
+    if moved < series/8 || moved > series/2 {
+        t.Errorf("%d of %d series moved to the new shard", moved, series)
+    }
+}
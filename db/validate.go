@@ -0,0 +1,41 @@
+package pgdb
+
+import (
+    "regexp"
+    "strings"
+    "unicode/utf8"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
+)
+
+var (
+    metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+    labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+func validString(s string) bool {
+    return utf8.ValidString(s) && strings.IndexByte(s, 0) < 0
+}
+
+// PostgreSQL refuses rows with invalid UTF-8 or NUL characters and
+// pg_prometheus refuses names it can't parse, either of which fails the
+// COPY of the whole batch. Such samples are caught here and the reason
+// is returned so they can be counted and skipped. An empty string means
+// the sample is fine.
+func validateSample(s *format.Sample) string {
+    if !metricNameRE.MatchString(s.Name) {
+        return "invalid_name"
+    }
+    for l, v := range s.Labels {
+        if !labelNameRE.MatchString(l) {
+            return "invalid_label_name"
+        }
+        if !validString(v) {
+            return "invalid_label_value"
+        }
+    }
+    if s.Timestamp.IsZero() {
+        return "invalid_timestamp"
+    }
+    return ""
+}
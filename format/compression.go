@@ -0,0 +1,78 @@
+package format
+
+import (
+    "io"
+    "fmt"
+    "bytes"
+    "compress/gzip"
+
+    "github.com/golang/snappy"
+    "github.com/klauspost/compress/zstd"
+    "github.com/pierrec/lz4/v4"
+)
+
+// Magic bytes of the payload compressions that are recognized
+var (
+    gzipMagic   = []byte{0x1f, 0x8b}
+    zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+    snappyMagic = []byte{0xff, 0x06, 0x00, 0x00, 0x73, 0x4e, 0x61, 0x50, 0x70, 0x59}
+    lz4Magic    = []byte{0x04, 0x22, 0x4d, 0x18}
+)
+
+// Returns the name of the compression of the payload and a reader that
+// decompresses it, or an empty name if the payload isn't compressed
+func sniffCompression(payload []byte) (string, io.Reader, error) {
+    r := bytes.NewReader(payload)
+
+    switch {
+    case bytes.HasPrefix(payload, gzipMagic):
+        gz, err := gzip.NewReader(r)
+        return "gzip", gz, err
+    case bytes.HasPrefix(payload, zstdMagic):
+        zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+        if err != nil {
+            return "zstd", nil, err
+        }
+        return "zstd", zr.IOReadCloser(), nil
+    case bytes.HasPrefix(payload, snappyMagic):
+        return "snappy", snappy.NewReader(r), nil
+    case bytes.HasPrefix(payload, lz4Magic):
+        return "lz4", lz4.NewReader(r), nil
+    }
+    return "", nil, nil
+}
+
+// Decompresses the payload of a message, if it is compressed, before
+// handing it over to another decoder. Payloads that decompress to more
+// than maxSize bytes are refused to guard against decompression bombs.
+type decompressingDecoder struct {
+    decoder  Decoder
+    maxSize  int64
+}
+
+func (d *decompressingDecoder) Decode(msg *Message) ([]Sample, error) {
+    codec, r, err := sniffCompression(msg.Value)
+    if err != nil {
+        return nil, fmt.Errorf("Can't decompress %s payload: %v", codec, err)
+    }
+    if r == nil {
+        return d.decoder.Decode(msg)
+    }
+    if c, ok := r.(io.Closer); ok {
+        defer c.Close()
+    }
+
+    value, err := io.ReadAll(io.LimitReader(r, d.maxSize + 1))
+    if err != nil {
+        return nil, fmt.Errorf("Can't decompress %s payload: %v", codec, err)
+    }
+    if int64(len(value)) > d.maxSize {
+        return nil, fmt.Errorf("Decompressed %s payload exceeds %d bytes", codec, d.maxSize)
+    }
+
+    decompressedMessages.WithLabelValues(codec).Inc()
+
+    decompressed := *msg
+    decompressed.Value = value
+    return d.decoder.Decode(&decompressed)
+}
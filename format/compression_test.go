@@ -0,0 +1,96 @@
+package format
+
+import (
+    "bytes"
+    "testing"
+    "compress/gzip"
+
+    "github.com/golang/snappy"
+    "github.com/klauspost/compress/zstd"
+    "github.com/pierrec/lz4/v4"
+)
+
+// Keeps the payload it was handed
+type recordingDecoder struct {
+    value  []byte
+}
+
+func (d *recordingDecoder) Decode(msg *Message) ([]Sample, error) {
+    d.value = msg.Value
+    return nil, nil
+}
+
+func compressed(t *testing.T, codec string, payload []byte) []byte {
+    var buf bytes.Buffer
+    var err error
+    switch codec {
+    case "gzip":
+        w := gzip.NewWriter(&buf)
+        if _, err = w.Write(payload); err == nil {
+            err = w.Close()
+        }
+    case "zstd":
+        var w *zstd.Encoder
+        if w, err = zstd.NewWriter(&buf); err == nil {
+            if _, err = w.Write(payload); err == nil {
+                err = w.Close()
+            }
+        }
+    case "snappy":
+        w := snappy.NewBufferedWriter(&buf)
+        if _, err = w.Write(payload); err == nil {
+            err = w.Close()
+        }
+    case "lz4":
+        w := lz4.NewWriter(&buf)
+        if _, err = w.Write(payload); err == nil {
+            err = w.Close()
+        }
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    return buf.Bytes()
+}
+
+func TestDecompressingDecoder(t *testing.T) {
+    payload := []byte(`{"name":"up","value":"1","labels":{}}`)
+
+    tests := []struct {
+        name     string
+        value    []byte
+        maxSize  int64
+        want     []byte
+        err      bool
+    }{
+        {"uncompressed", payload, 1024, payload, false},
+        {"gzip", compressed(t, "gzip", payload), 1024, payload, false},
+        {"zstd", compressed(t, "zstd", payload), 1024, payload, false},
+        {"snappy", compressed(t, "snappy", payload), 1024, payload, false},
+        {"lz4", compressed(t, "lz4", payload), 1024, payload, false},
+        {"exact size", compressed(t, "gzip", payload), int64(len(payload)), payload, false},
+        {"too large", compressed(t, "gzip", payload), int64(len(payload)) - 1, nil, true},
+        {"corrupt", append([]byte{0x1f, 0x8b}, payload...), 1024, nil, true},
+        {"truncated", compressed(t, "zstd", payload)[:10], 1024, nil, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rec := &recordingDecoder{}
+            d := &decompressingDecoder{decoder: rec, maxSize: tt.maxSize}
+            _, err := d.Decode(&Message{Value: tt.value})
+            if tt.err {
+                if err == nil {
+                    t.Fatal("expected an error")
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !bytes.Equal(rec.value, tt.want) {
+                t.Errorf("got %q, want %q", rec.value, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,168 @@
+package format
+
+import (
+    "fmt"
+    "bytes"
+    "strings"
+
+    "github.com/golang/snappy"
+)
+
+// DetectingDecoder picks the decoder of every message on its own so
+// that producers using different formats can share a topic. The format
+// is taken from a message header if there is one, otherwise it is
+// sniffed from the first bytes of the payload. Detections and decode
+// failures are counted per format.
+type DetectingDecoder struct {
+    decoders    map[string]Decoder
+    header      string
+    jsonFormat  string
+}
+
+// Content types that map to a format when they are found in the header
+var contentTypes = map[string]string{
+    "application/json"              : FORMAT_JSON,
+    "application/x-protobuf"        : FORMAT_REMOTE_WRITE,
+    "application/openmetrics-text"  : FORMAT_OPENMETRICS,
+    "text/plain"                    : FORMAT_PROMETHEUS,
+    "application/x-influx"          : FORMAT_INFLUX,
+    "text/x-statsd"                 : FORMAT_STATSD,
+}
+
+func NewDetectingDecoder(decoders map[string]Decoder, header string, jsonFormat string) (*DetectingDecoder, error) {
+    if _, ok := decoders[jsonFormat]; !ok {
+        return nil, fmt.Errorf("Unknown format %q for JSON messages", jsonFormat)
+    }
+    return &DetectingDecoder{decoders: decoders, header: strings.ToLower(header), jsonFormat: jsonFormat}, nil
+}
+
+func (d *DetectingDecoder) Decode(msg *Message) ([]Sample, error) {
+    f := d.detect(msg)
+    detectedMessages.WithLabelValues(f).Inc()
+
+    dec, ok := d.decoders[f]
+    if !ok {
+        decodeFailures.WithLabelValues(f).Inc()
+        return nil, fmt.Errorf("Can't detect the format of the message")
+    }
+
+    samples, err := dec.Decode(msg)
+    if err != nil {
+        decodeFailures.WithLabelValues(f).Inc()
+        return nil, fmt.Errorf("Can't decode %s message: %v", f, err)
+    }
+    return samples, nil
+}
+
+func (d *DetectingDecoder) detect(msg *Message) string {
+    if h, ok := msg.Headers[d.header]; ok {
+        h = strings.ToLower(strings.TrimSpace(h))
+        if _, ok := d.decoders[h]; ok {
+            return h
+        }
+        ct := strings.TrimSpace(strings.SplitN(h, ";", 2)[0])
+        if f, ok := contentTypes[ct]; ok {
+            if f == FORMAT_JSON {
+                return d.sniffJSON(msg.Value)
+            }
+            return f
+        }
+    }
+    return d.sniff(msg.Value)
+}
+
+// A cheap look at the start of the payload. JSON and comments are
+// recognized by their first character, remote write requests by their
+// protobuf structure and the other text formats by their first line.
+func (d *DetectingDecoder) sniff(payload []byte) string {
+    b := bytes.TrimLeft(payload, " \t\r\n")
+    if len(b) == 0 {
+        return "unknown"
+    }
+
+    switch {
+    case b[0] == '{' || b[0] == '[':
+        return d.sniffJSON(b)
+    case isRemoteWrite(payload):
+        return FORMAT_REMOTE_WRITE
+    case b[0] == '#':
+        if bytes.Contains(b, []byte("# EOF")) {
+            return FORMAT_OPENMETRICS
+        }
+        return FORMAT_PROMETHEUS
+    }
+
+    line := b
+    if i := bytes.IndexByte(line, '\n'); i >= 0 {
+        line = line[:i]
+    }
+
+    if c := bytes.IndexByte(line, ':'); c > 0 && bytes.IndexByte(line, '|') > c && bytes.IndexAny(line[:c], " \t{") < 0 {
+        return FORMAT_STATSD
+    }
+
+    end := bytes.IndexAny(line, "{ \t,")
+    if end <= 0 {
+        return "unknown"
+    }
+    switch line[end] {
+    case '{':
+        return FORMAT_PROMETHEUS
+    case ',':
+        return FORMAT_INFLUX
+    }
+
+    fields := strings.Fields(string(line[end:]))
+    if len(fields) > 0 && strings.ContainsRune(fields[0], '=') {
+        return FORMAT_INFLUX
+    }
+    if len(fields) > 0 && len(fields) <= 2 {
+        if _, err := ParseValue(fields[0]); err == nil {
+            return FORMAT_PROMETHEUS
+        }
+    }
+    return "unknown"
+}
+
+// Remote write requests are protobuf, usually snappy compressed, whose
+// first field is a time series
+func isRemoteWrite(payload []byte) bool {
+    if b, err := snappy.Decode(nil, payload); err == nil {
+        payload = b
+    }
+    if len(payload) == 0 || payload[0] != 0x0a {
+        return false
+    }
+    return walkProto(payload, func(int, []byte, uint64) error { return nil }) == nil
+}
+
+// Telegraf's JSON has fields and optionally batches its metrics, any
+// other JSON goes to the configured JSON format
+func (d *DetectingDecoder) sniffJSON(payload []byte) string {
+    if bytes.Contains(payload, []byte(`"fields"`)) {
+        return FORMAT_TELEGRAF
+    }
+    return d.jsonFormat
+}
+
+// StatsD messages are aggregated even when they share the topic
+func (d *DetectingDecoder) Flushed() <-chan []Sample {
+    if f, ok := d.decoders[FORMAT_STATSD].(Flusher); ok {
+        return f.Flushed()
+    }
+    return nil
+}
+
+func (d *DetectingDecoder) Flush() []Sample {
+    if f, ok := d.decoders[FORMAT_STATSD].(Flusher); ok {
+        return f.Flush()
+    }
+    return nil
+}
+
+func (d *DetectingDecoder) Close() []Sample {
+    if f, ok := d.decoders[FORMAT_STATSD].(Flusher); ok {
+        return f.Close()
+    }
+    return nil
+}
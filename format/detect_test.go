@@ -0,0 +1,81 @@
+package format
+
+import (
+    "testing"
+
+    "github.com/golang/snappy"
+)
+
+type nopDecoder struct{}
+
+func (nopDecoder) Decode(msg *Message) ([]Sample, error) {
+    return nil, nil
+}
+
+func TestDetectingDecoderDetect(t *testing.T) {
+    decoders := make(map[string]Decoder)
+    for _, f := range []string{FORMAT_JSON, FORMAT_TELEGRAF, FORMAT_PROMETHEUS, FORMAT_OPENMETRICS,
+        FORMAT_INFLUX, FORMAT_REMOTE_WRITE, FORMAT_STATSD, FORMAT_MAPPED} {
+        decoders[f] = nopDecoder{}
+    }
+    d, err := NewDetectingDecoder(decoders, "Content-Type", FORMAT_MAPPED)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name    string
+        header  string
+        value   string
+        want    string
+    }{
+        {"header format name", "Influx", "anything", FORMAT_INFLUX},
+        {"header content type", "application/openmetrics-text; version=1.0.0", "up 1", FORMAT_OPENMETRICS},
+        {"header statsd", "text/x-statsd", "a:1|c", FORMAT_STATSD},
+        {"header json", "application/json", `{"name":"a","value":1}`, FORMAT_MAPPED},
+        {"header telegraf json", "application/json", `{"name":"cpu","fields":{"idle":1}}`, FORMAT_TELEGRAF},
+        {"unknown header", "application/octet-stream", "cpu,host=a idle=1", FORMAT_INFLUX},
+        {"json", "", ` {"name":"a","value":1}`, FORMAT_MAPPED},
+        {"json array", "", `[{"name":"a","value":1}]`, FORMAT_MAPPED},
+        {"telegraf", "", `{"metrics":[{"name":"cpu","fields":{"idle":1}}]}`, FORMAT_TELEGRAF},
+        {"remote write", "", string(snappy.Encode(nil, testWriteRequest())), FORMAT_REMOTE_WRITE},
+        {"uncompressed remote write", "", string(testWriteRequest()), FORMAT_REMOTE_WRITE},
+        {"openmetrics", "", "# TYPE up gauge\nup 1\n# EOF\n", FORMAT_OPENMETRICS},
+        {"prometheus comment", "", "# HELP up Whether the target is up\nup 1\n", FORMAT_PROMETHEUS},
+        {"prometheus labels", "", `up{job="api"} 1`, FORMAT_PROMETHEUS},
+        {"prometheus", "", "up 1 1600000000000", FORMAT_PROMETHEUS},
+        {"statsd", "", "page.views:1|c|#env:prod", FORMAT_STATSD},
+        {"influx tags", "", "cpu,host=a idle=1", FORMAT_INFLUX},
+        {"influx fields", "", "cpu idle=1,user=2 1600000000000000000", FORMAT_INFLUX},
+        {"empty", "", " \n", "unknown"},
+        {"text", "", "hello world and more", "unknown"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            msg := &Message{Value: []byte(tt.value), Headers: map[string]string{}}
+            if len(tt.header) > 0 {
+                msg.Headers["content-type"] = tt.header
+            }
+            if f := d.detect(msg); f != tt.want {
+                t.Errorf("got %s, want %s", f, tt.want)
+            }
+        })
+    }
+}
+
+func TestNewDetectingDecoderUnknownJSONFormat(t *testing.T) {
+    if _, err := NewDetectingDecoder(map[string]Decoder{}, "content-type", FORMAT_JSON); err == nil {
+        t.Error("expected an error for a JSON format without decoder")
+    }
+}
+
+func TestDetectingDecoderDecodeUnknown(t *testing.T) {
+    d, err := NewDetectingDecoder(map[string]Decoder{FORMAT_JSON: nopDecoder{}}, "content-type", FORMAT_JSON)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := d.Decode(&Message{Value: []byte("hello world and more")}); err == nil {
+        t.Error("expected an error for a message of unknown format")
+    }
+}
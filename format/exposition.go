@@ -0,0 +1,266 @@
+package format
+
+import (
+    "fmt"
+    "math"
+    "time"
+    "strings"
+    "strconv"
+)
+
+// ExpositionDecoder decodes scrape bodies in the Prometheus text
+// exposition format or, if openMetrics is set, in OpenMetrics. Every
+// sample line becomes a sample, histogram and summary series such as
+// _bucket, _sum and _count included. Samples without a timestamp get
+// the timestamp of the Kafka message. Exemplars are validated and
+// dropped since there is nowhere to store them. TYPE, HELP and UNIT
+// comments are kept as metadata.
+type ExpositionDecoder struct {
+    openMetrics  bool
+    metadata     *metadataStore
+}
+
+var metricTypes = map[string]bool{
+    "counter"        : true,
+    "gauge"          : true,
+    "histogram"      : true,
+    "gaugehistogram" : true,
+    "summary"        : true,
+    "info"           : true,
+    "stateset"       : true,
+    "unknown"        : true,
+    "untyped"        : true,
+}
+
+func (d *ExpositionDecoder) Decode(msg *Message) ([]Sample, error) {
+    defaultTs := msg.Timestamp.UTC()
+    if msg.Timestamp.IsZero() {
+        defaultTs = time.Now().UTC()
+    }
+
+    samples := make([]Sample, 0)
+    for n, line := range strings.Split(string(msg.Value), "\n") {
+        line = strings.TrimSpace(line)
+        if len(line) == 0 {
+            continue
+        }
+
+        if line[0] == '#' {
+            eof, err := d.parseComment(line)
+            if err != nil {
+                return nil, fmt.Errorf("Line %d: %v", n+1, err)
+            }
+            if eof {
+                break
+            }
+            continue
+        }
+
+        s, err := d.parseSample(line, defaultTs)
+        if err != nil {
+            return nil, fmt.Errorf("Line %d: %v", n+1, err)
+        }
+        samples = append(samples, s)
+    }
+    return samples, nil
+}
+
+// Records # HELP, # TYPE and # UNIT lines as metadata, other comments
+// are ignored. Returns true on the # EOF line of OpenMetrics.
+func (d *ExpositionDecoder) parseComment(line string) (bool, error) {
+    fields := strings.SplitN(strings.TrimSpace(line[1:]), " ", 3)
+    if len(fields) == 0 {
+        return false, nil
+    }
+
+    switch fields[0] {
+    case "EOF":
+        return d.openMetrics, nil
+    case "TYPE":
+        if len(fields) != 3 {
+            return false, fmt.Errorf("Invalid TYPE line")
+        }
+        if !metricTypes[fields[2]] {
+            return false, fmt.Errorf("Unknown metric type %q", fields[2])
+        }
+        d.metadata.observe(Metadata{Name: fields[1], Type: fields[2]})
+    case "HELP":
+        if len(fields) < 2 {
+            return false, fmt.Errorf("Invalid HELP line")
+        }
+        if len(fields) == 3 {
+            d.metadata.observe(Metadata{Name: fields[1], Help: unescapeHelp(fields[2])})
+        }
+    case "UNIT":
+        if len(fields) < 2 {
+            return false, fmt.Errorf("Invalid UNIT line")
+        }
+        if len(fields) == 3 {
+            d.metadata.observe(Metadata{Name: fields[1], Unit: fields[2]})
+        }
+    }
+    return false, nil
+}
+
+func unescapeHelp(s string) string {
+    return strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\"`, `"`).Replace(s)
+}
+
+// Parses name{label="value",...} value [timestamp] [# {label="value"} value [timestamp]]
+func (d *ExpositionDecoder) parseSample(line string, defaultTs time.Time) (Sample, error) {
+    var s Sample
+    var err error
+
+    end := strings.IndexAny(line, "{ \t")
+    if end <= 0 {
+        return s, fmt.Errorf("Invalid sample %q", line)
+    }
+    s.Name = line[:end]
+    rest := line[end:]
+
+    s.Labels = make(map[string]string)
+    if rest[0] == '{' {
+        rest, err = parseLabels(rest, s.Labels)
+        if err != nil {
+            return s, err
+        }
+    }
+
+    if i := strings.IndexByte(rest, '#'); i >= 0 {
+        err = d.parseExemplar(rest[i+1:])
+        if err != nil {
+            return s, err
+        }
+        rest = rest[:i]
+    }
+
+    fields := strings.Fields(rest)
+    if len(fields) < 1 || len(fields) > 2 {
+        return s, fmt.Errorf("Invalid sample %q", line)
+    }
+
+    s.Value, err = ParseValue(fields[0])
+    if err != nil {
+        return s, err
+    }
+
+    s.Timestamp = defaultTs
+    if len(fields) == 2 {
+        s.Timestamp, err = d.parseTimestamp(fields[1])
+        if err != nil {
+            return s, err
+        }
+    }
+    return s, nil
+}
+
+// Prometheus timestamps are milliseconds, OpenMetrics timestamps are
+// seconds with an optional fraction
+func (d *ExpositionDecoder) parseTimestamp(s string) (time.Time, error) {
+    if d.openMetrics {
+        f, err := strconv.ParseFloat(s, 64)
+        if err != nil {
+            return time.Time{}, err
+        }
+        ns := f * float64(time.Second)
+        if math.IsNaN(ns) || ns >= math.MaxInt64 || ns <= math.MinInt64 {
+            return time.Time{}, fmt.Errorf("Timestamp %q out of range", s)
+        }
+        return time.Unix(0, int64(ns)).UTC(), nil
+    }
+
+    ms, err := strconv.ParseInt(s, 10, 64)
+    if err != nil {
+        return time.Time{}, err
+    }
+    return unixMilli(ms)
+}
+
+// Millisecond timestamps that don't fit into int64 nanoseconds are
+// refused instead of wrapping around
+func unixMilli(ms int64) (time.Time, error) {
+    if ms > math.MaxInt64 / int64(time.Millisecond) || ms < math.MinInt64 / int64(time.Millisecond) {
+        return time.Time{}, fmt.Errorf("Timestamp %d out of range", ms)
+    }
+    return time.Unix(0, ms * int64(time.Millisecond)).UTC(), nil
+}
+
+// An exemplar is a label set followed by a value and an optional
+// timestamp
+func (d *ExpositionDecoder) parseExemplar(s string) error {
+    s = strings.TrimSpace(s)
+    if len(s) == 0 || s[0] != '{' {
+        return fmt.Errorf("Invalid exemplar %q", s)
+    }
+
+    rest, err := parseLabels(s, make(map[string]string))
+    if err != nil {
+        return err
+    }
+
+    fields := strings.Fields(rest)
+    if len(fields) < 1 || len(fields) > 2 {
+        return fmt.Errorf("Invalid exemplar %q", s)
+    }
+    if _, err := ParseValue(fields[0]); err != nil {
+        return err
+    }
+    if len(fields) == 2 {
+        if _, err := strconv.ParseFloat(fields[1], 64); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Parses a {label="value",...} set at the start of s into labels and
+// returns what follows it
+func parseLabels(s string, labels map[string]string) (string, error) {
+    i := 1
+    for {
+        for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == ',') {
+            i++
+        }
+        if i >= len(s) {
+            return "", fmt.Errorf("Unterminated label set")
+        }
+        if s[i] == '}' {
+            return s[i+1:], nil
+        }
+
+        eq := strings.IndexByte(s[i:], '=')
+        if eq < 0 {
+            return "", fmt.Errorf("Invalid label set %q", s)
+        }
+        name := strings.TrimSpace(s[i:i+eq])
+        i += eq + 1
+        for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+            i++
+        }
+        if i >= len(s) || s[i] != '"' {
+            return "", fmt.Errorf("Label %s has no quoted value", name)
+        }
+        i++
+
+        var value strings.Builder
+        for ; i < len(s) && s[i] != '"'; i++ {
+            c := s[i]
+            if c == '\\' && i+1 < len(s) {
+                i++
+                switch s[i] {
+                case 'n':
+                    c = '\n'
+                default:
+                    c = s[i]
+                }
+            }
+            value.WriteByte(c)
+        }
+        if i >= len(s) {
+            return "", fmt.Errorf("Unterminated value of label %s", name)
+        }
+        i++
+
+        labels[name] = value.String()
+    }
+}
@@ -0,0 +1,99 @@
+package format
+
+import (
+    "math"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestExpositionDecoder(t *testing.T) {
+    msgTs := time.Unix(1500000000, 0).UTC()
+    ts := time.Unix(1600000000, 0).UTC()
+    none := map[string]string{}
+
+    tests := []struct {
+        name         string
+        openMetrics  bool
+        value        string
+        want         []Sample
+        err          bool
+    }{
+        {"prometheus", false, "# HELP up Whether the target is up\n# TYPE up gauge\nup 1\nhttp_requests_total{code=\"200\",method=\"get\"} 1027 1600000000000\n", []Sample{
+            {Name: "up", Labels: none, Value: 1, Timestamp: msgTs},
+            {Name: "http_requests_total", Labels: map[string]string{"code": "200", "method": "get"}, Value: 1027, Timestamp: ts},
+        }, false},
+        {"escaped label values", false, `msg{text="a \"quoted\" \\ line\nbreak",empty=""} 1`, []Sample{
+            {Name: "msg", Labels: map[string]string{"text": "a \"quoted\" \\ line\nbreak", "empty": ""}, Value: 1, Timestamp: msgTs},
+        }, false},
+        {"trailing comma and spaces", false, `x{ a="1", } 2`, []Sample{
+            {Name: "x", Labels: map[string]string{"a": "1"}, Value: 2, Timestamp: msgTs},
+        }, false},
+        {"histogram", false, "# TYPE d histogram\nd_bucket{le=\"+Inf\"} 3\nd_sum 1.5\nd_count 3\n", []Sample{
+            {Name: "d_bucket", Labels: map[string]string{"le": "+Inf"}, Value: 3, Timestamp: msgTs},
+            {Name: "d_sum", Labels: none, Value: 1.5, Timestamp: msgTs},
+            {Name: "d_count", Labels: none, Value: 3, Timestamp: msgTs},
+        }, false},
+        {"openmetrics", true, "# TYPE c counter\n# UNIT c seconds\nc_total 5 1600000000.5 \n# EOF\nignored 1\n", []Sample{
+            {Name: "c_total", Labels: none, Value: 5, Timestamp: ts.Add(500 * time.Millisecond)},
+        }, false},
+        {"exemplar", true, "c_total{a=\"b\"} 5 # {trace_id=\"abc\"} 1 1600000000\n# EOF\n", []Sample{
+            {Name: "c_total", Labels: map[string]string{"a": "b"}, Value: 5, Timestamp: msgTs},
+        }, false},
+        {"unknown type", false, "# TYPE up rate\nup 1\n", nil, true},
+        {"invalid TYPE", false, "# TYPE up\n", nil, true},
+        {"no value", false, "up\n", nil, true},
+        {"invalid value", false, "up high\n", nil, true},
+        {"too many fields", false, "up 1 2 3\n", nil, true},
+        {"unterminated labels", false, `up{a="1" 1`, nil, true},
+        {"unquoted label", false, `up{a=1} 1`, nil, true},
+        {"invalid timestamp", false, "up 1 yesterday\n", nil, true},
+        {"timestamp out of range", false, "up 1 9223372036854775\n", nil, true},
+        {"negative timestamp out of range", false, "up 1 -9223372036854775\n", nil, true},
+        {"openmetrics timestamp out of range", true, "up 1 1e19\n# EOF\n", nil, true},
+        {"invalid exemplar", true, "c_total 5 # trace 1\n", nil, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            d := &ExpositionDecoder{openMetrics: tt.openMetrics, metadata: newMetadataStore(0)}
+            samples, err := d.Decode(&Message{Value: []byte(tt.value), Timestamp: msgTs})
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("expected an error, got %v", samples)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(samples, tt.want) {
+                t.Errorf("got %v, want %v", samples, tt.want)
+            }
+        })
+    }
+}
+
+func TestExpositionDecoderSpecialValues(t *testing.T) {
+    d := &ExpositionDecoder{}
+    samples, err := d.Decode(&Message{Value: []byte("a NaN\nb +Inf\nc -Inf\n")})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(samples) != 3 || !math.IsNaN(samples[0].Value) || !math.IsInf(samples[1].Value, 1) || !math.IsInf(samples[2].Value, -1) {
+        t.Errorf("unexpected samples %v", samples)
+    }
+}
+
+func TestExpositionDecoderMetadata(t *testing.T) {
+    d := &ExpositionDecoder{openMetrics: true, metadata: newMetadataStore(0)}
+    body := "# TYPE http_duration_seconds histogram\n# HELP http_duration_seconds Request \\\"duration\\\"\n# UNIT http_duration_seconds seconds\n# EOF\n"
+    if _, err := d.Decode(&Message{Value: []byte(body)}); err != nil {
+        t.Fatal(err)
+    }
+
+    want := []Metadata{{Name: "http_duration_seconds", Type: "histogram", Help: `Request "duration"`, Unit: "seconds"}}
+    if md, _ := d.metadata.Metadata(); !reflect.DeepEqual(md, want) {
+        t.Errorf("got %v, want %v", md, want)
+    }
+}
@@ -0,0 +1,339 @@
+package format
+
+import (
+    "os"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/log"
+    "github.com/arslanm/kafka-timescaledb-adapter/util"
+)
+
+// Sample is a single metric value decoded from a Kafka message
+type Sample struct {
+    Name       string
+    Labels     map[string]string
+    Value      float64
+    Timestamp  time.Time
+}
+
+// Message is a Kafka message as handed over to the decoders. Samples
+// that were decoded already, e.g. by an aggregating decoder, travel in
+// a message of their own with Samples set and no Value.
+type Message struct {
+    Value      []byte
+    Timestamp  time.Time
+    Headers    map[string]string
+    Samples    []Sample
+}
+
+// A decoder turns a Kafka message into samples. A single message may
+// carry any number of samples.
+type Decoder interface {
+    Decode(msg *Message) ([]Sample, error)
+}
+
+// Decoders that aggregate messages instead of returning samples right
+// away hand the aggregated samples over on a channel once per interval.
+// Close stops the flushes at shutdown and returns the samples that were
+// not handed over yet.
+type Flusher interface {
+    Flushed() <-chan []Sample
+    Flush() []Sample
+    Close() []Sample
+}
+
+// Config for the input format
+type Config struct {
+    inputFormat             string
+    formatHeader            string
+    autoJSONFormat          string
+    decompress              bool
+    maxDecompressedSize     int
+    timestampFormat         string
+    timestampFallback       string
+    telegrafTimestampUnits  string
+    mappingName             string
+    mappingValue            string
+    mappingTimestamp        string
+    mappingLabels           string
+    mappingConstLabels      string
+    mappingLabelSeparator   string
+    mappingTimestampUnits   string
+    nanPolicy               string
+    infPolicy               string
+    stalePolicy             string
+    statsdFlushInterval     time.Duration
+    statsdQuantiles         string
+    statsdMaxIdleFlushes    int
+    metadataInterval        time.Duration
+}
+
+const (
+    FORMAT_JSON         = "json"
+    FORMAT_TELEGRAF     = "telegraf"
+    FORMAT_MAPPED       = "mapped"
+    FORMAT_PROMETHEUS   = "prometheus"
+    FORMAT_OPENMETRICS  = "openmetrics"
+    FORMAT_STATSD       = "statsd"
+    FORMAT_INFLUX       = "influx"
+    FORMAT_REMOTE_WRITE = "remote_write"
+    FORMAT_AUTO         = "auto"
+)
+
+var (
+    DEFAULT_INPUT_FORMAT             = FORMAT_JSON
+    DEFAULT_FORMAT_HEADER            = "content-type"
+    DEFAULT_AUTO_JSON_FORMAT         = FORMAT_JSON
+    DEFAULT_DECOMPRESS               = true
+    DEFAULT_MAX_DECOMPRESSED_SIZE    = 64 * 1024 * 1024
+    DEFAULT_TIMESTAMP_FORMAT         = TIMESTAMP_FORMAT_AUTO
+    DEFAULT_TIMESTAMP_FALLBACK       = TIMESTAMP_FALLBACK_NONE
+    DEFAULT_TELEGRAF_TIMESTAMP_UNITS = ""
+    DEFAULT_MAPPING_NAME             = "$.name"
+    DEFAULT_MAPPING_VALUE            = "$.value"
+    DEFAULT_MAPPING_TIMESTAMP        = "$.timestamp"
+    DEFAULT_MAPPING_LABELS           = "$.labels"
+    DEFAULT_MAPPING_CONST_LABELS     = ""
+    DEFAULT_MAPPING_LABEL_SEPARATOR  = "_"
+    DEFAULT_MAPPING_TIMESTAMP_UNITS  = ""
+    DEFAULT_VALUE_NAN_POLICY         = VALUE_POLICY_KEEP
+    DEFAULT_VALUE_INF_POLICY         = VALUE_POLICY_KEEP
+    DEFAULT_VALUE_STALE_POLICY       = VALUE_POLICY_KEEP
+    DEFAULT_STATSD_FLUSH_INTERVAL    = "10s"
+    DEFAULT_STATSD_QUANTILES         = "0.5,0.9,0.99"
+    DEFAULT_STATSD_MAX_IDLE_FLUSHES  = 60
+    DEFAULT_METADATA_INTERVAL        = "1h"
+)
+
+var (
+    droppedMetrics = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace : "kafka_timescale_adapter",
+            Name      : "dropped_metrics_total",
+            Help      : "Total number of metrics dropped because of their value.",
+        },
+        []string{"reason"},
+    )
+
+    decompressedMessages = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace : "kafka_timescale_adapter",
+            Name      : "decompressed_messages_total",
+            Help      : "Total number of message payloads which were decompressed.",
+        },
+        []string{"codec"},
+    )
+
+    detectedMessages = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace : "kafka_timescale_adapter",
+            Name      : "detected_messages_total",
+            Help      : "Total number of messages per detected input format.",
+        },
+        []string{"format"},
+    )
+
+    decodeFailures = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace : "kafka_timescale_adapter",
+            Name      : "decode_failures_total",
+            Help      : "Total number of messages per detected input format which could not be decoded.",
+        },
+        []string{"format"},
+    )
+)
+
+func GetConfig(cfg *Config) *Config {
+
+    cfg.inputFormat = util.GetEnvWithDefault("INPUT_FORMAT", DEFAULT_INPUT_FORMAT)
+    cfg.formatHeader = util.GetEnvWithDefault("FORMAT_HEADER", DEFAULT_FORMAT_HEADER)
+    cfg.autoJSONFormat = util.GetEnvWithDefault("AUTO_JSON_FORMAT", DEFAULT_AUTO_JSON_FORMAT)
+    cfg.decompress = util.GetEnvWithDefaultBool("DECOMPRESS", DEFAULT_DECOMPRESS)
+    cfg.maxDecompressedSize = util.GetEnvWithDefaultInt("MAX_DECOMPRESSED_SIZE", DEFAULT_MAX_DECOMPRESSED_SIZE)
+    cfg.timestampFormat = util.GetEnvWithDefault("TIMESTAMP_FORMAT", DEFAULT_TIMESTAMP_FORMAT)
+    cfg.timestampFallback = util.GetEnvWithDefault("TIMESTAMP_FALLBACK", DEFAULT_TIMESTAMP_FALLBACK)
+    cfg.telegrafTimestampUnits = util.GetEnvWithDefault("TELEGRAF_TIMESTAMP_UNITS", DEFAULT_TELEGRAF_TIMESTAMP_UNITS)
+    cfg.mappingName = util.GetEnvWithDefault("MAPPING_NAME", DEFAULT_MAPPING_NAME)
+    cfg.mappingValue = util.GetEnvWithDefault("MAPPING_VALUE", DEFAULT_MAPPING_VALUE)
+    cfg.mappingTimestamp = util.GetEnvWithDefault("MAPPING_TIMESTAMP", DEFAULT_MAPPING_TIMESTAMP)
+    cfg.mappingLabels = util.GetEnvWithDefault("MAPPING_LABELS", DEFAULT_MAPPING_LABELS)
+    cfg.mappingConstLabels = util.GetEnvWithDefault("MAPPING_CONST_LABELS", DEFAULT_MAPPING_CONST_LABELS)
+    cfg.mappingLabelSeparator = util.GetEnvWithDefault("MAPPING_LABEL_SEPARATOR", DEFAULT_MAPPING_LABEL_SEPARATOR)
+    cfg.mappingTimestampUnits = util.GetEnvWithDefault("MAPPING_TIMESTAMP_UNITS", DEFAULT_MAPPING_TIMESTAMP_UNITS)
+    cfg.nanPolicy = util.GetEnvWithDefault("VALUE_NAN_POLICY", DEFAULT_VALUE_NAN_POLICY)
+    cfg.infPolicy = util.GetEnvWithDefault("VALUE_INF_POLICY", DEFAULT_VALUE_INF_POLICY)
+    cfg.stalePolicy = util.GetEnvWithDefault("VALUE_STALE_POLICY", DEFAULT_VALUE_STALE_POLICY)
+    cfg.statsdFlushInterval = util.GetEnvWithDefaultDuration("STATSD_FLUSH_INTERVAL", DEFAULT_STATSD_FLUSH_INTERVAL)
+    cfg.statsdQuantiles = util.GetEnvWithDefault("STATSD_QUANTILES", DEFAULT_STATSD_QUANTILES)
+    cfg.statsdMaxIdleFlushes = util.GetEnvWithDefaultInt("STATSD_MAX_IDLE_FLUSHES", DEFAULT_STATSD_MAX_IDLE_FLUSHES)
+    cfg.metadataInterval = util.GetEnvWithDefaultDuration("METADATA_INTERVAL", DEFAULT_METADATA_INTERVAL)
+
+    return cfg
+}
+
+var registerMetrics sync.Once
+
+// Registers the metrics of the package, calling it again does nothing
+func InitPromMetrics() {
+    registerMetrics.Do(func() {
+        prometheus.MustRegister(droppedMetrics)
+        prometheus.MustRegister(decompressedMessages)
+        prometheus.MustRegister(detectedMessages)
+        prometheus.MustRegister(decodeFailures)
+    })
+}
+
+func NewDecoder(cfg *Config) Decoder {
+    policy, err := NewValuePolicy(cfg.nanPolicy, cfg.infPolicy, cfg.stalePolicy)
+    if err != nil {
+        log.Error("msg", "Can't create value policy", "error", err)
+        os.Exit(1)
+    }
+
+    InitPromMetrics()
+
+    metadata := newMetadataStore(cfg.metadataInterval)
+
+    decoder := newFormatDecoder(cfg, cfg.inputFormat, metadata)
+    flusher, _ := decoder.(Flusher)
+
+    if cfg.decompress {
+        decoder = &decompressingDecoder{decoder: decoder, maxSize: int64(cfg.maxDecompressedSize)}
+    }
+    return &pipeline{decoder: decoder, policy: policy, flusher: flusher, metadata: metadata}
+}
+
+func newFormatDecoder(cfg *Config, inputFormat string, metadata *metadataStore) Decoder {
+    switch inputFormat {
+    case FORMAT_JSON:
+        return &JSONDecoder{timestamps: newTimestampParser(cfg, "")}
+    case FORMAT_TELEGRAF:
+        return &TelegrafDecoder{timestamps: newTimestampParser(cfg, cfg.telegrafTimestampUnits)}
+    case FORMAT_PROMETHEUS:
+        return &ExpositionDecoder{metadata: metadata}
+    case FORMAT_OPENMETRICS:
+        return &ExpositionDecoder{openMetrics: true, metadata: metadata}
+    case FORMAT_INFLUX:
+        return &InfluxDecoder{timestamps: newTimestampParser(cfg, "")}
+    case FORMAT_REMOTE_WRITE:
+        return &RemoteWriteDecoder{metadata: metadata}
+    case FORMAT_STATSD:
+        quantiles, err := parseQuantiles(cfg.statsdQuantiles)
+        if err != nil {
+            log.Error("msg", "Can't parse StatsD quantiles", "error", err)
+            os.Exit(1)
+        }
+        if cfg.statsdFlushInterval <= 0 {
+            log.Error("msg", "STATSD_FLUSH_INTERVAL must be positive", "interval", cfg.statsdFlushInterval)
+            os.Exit(1)
+        }
+        return NewStatsdDecoder(cfg.statsdFlushInterval, quantiles, cfg.statsdMaxIdleFlushes)
+    case FORMAT_MAPPED:
+        d, err := NewMappedDecoder(cfg, newTimestampParser(cfg, cfg.mappingTimestampUnits))
+        if err != nil {
+            log.Error("msg", "Can't create mapped decoder", "error", err)
+            os.Exit(1)
+        }
+        return d
+    case FORMAT_AUTO:
+        decoders := make(map[string]Decoder)
+        for _, f := range []string{FORMAT_JSON, FORMAT_TELEGRAF, FORMAT_PROMETHEUS, FORMAT_OPENMETRICS,
+            FORMAT_INFLUX, FORMAT_REMOTE_WRITE, FORMAT_STATSD, FORMAT_MAPPED} {
+            decoders[f] = newFormatDecoder(cfg, f, metadata)
+        }
+        d, err := NewDetectingDecoder(decoders, cfg.formatHeader, cfg.autoJSONFormat)
+        if err != nil {
+            log.Error("msg", "Can't create detecting decoder", "error", err)
+            os.Exit(1)
+        }
+        return d
+    }
+
+    log.Error("msg", "Unknown input format", "format", inputFormat)
+    os.Exit(1)
+    return nil
+}
+
+// The decoder handed out by NewDecoder. It runs the decoder of the
+// input format, passes samples that were decoded already through and
+// applies the value policy to all of them.
+type pipeline struct {
+    decoder   Decoder
+    policy    *ValuePolicy
+    flusher   Flusher
+    metadata  *metadataStore
+}
+
+func (p *pipeline) Decode(msg *Message) ([]Sample, error) {
+    samples := msg.Samples
+    if samples == nil {
+        var err error
+        samples, err = p.decoder.Decode(msg)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    kept := make([]Sample, 0, len(samples))
+    for i := range samples {
+        if p.policy.Apply(&samples[i]) {
+            kept = append(kept, samples[i])
+        }
+    }
+    return kept, nil
+}
+
+// A nil channel is returned when the input format doesn't aggregate,
+// receiving from it blocks forever
+func (p *pipeline) Flushed() <-chan []Sample {
+    if p.flusher == nil {
+        return nil
+    }
+    return p.flusher.Flushed()
+}
+
+func (p *pipeline) Flush() []Sample {
+    if p.flusher == nil {
+        return nil
+    }
+    return p.flusher.Flush()
+}
+
+func (p *pipeline) Close() []Sample {
+    if p.flusher == nil {
+        return nil
+    }
+    return p.flusher.Close()
+}
+
+func (p *pipeline) Metadata() ([]Metadata, func(written bool)) {
+    return p.metadata.Metadata()
+}
+
+func newTimestampParser(cfg *Config, units string) *TimestampParser {
+    p, err := NewTimestampParser(cfg.timestampFormat, units, cfg.timestampFallback)
+    if err != nil {
+        log.Error("msg", "Can't create timestamp parser", "error", err)
+        os.Exit(1)
+    }
+    return p
+}
+
+// Replaces the characters that are not allowed in Prometheus metric
+// and label names with underscores
+func sanitizeName(name string) string {
+    b := []byte(name)
+    for i, c := range b {
+        if c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+            continue
+        }
+        if c >= '0' && c <= '9' && i > 0 {
+            continue
+        }
+        b[i] = '_'
+    }
+    return string(b)
+}
@@ -0,0 +1,10 @@
+package format
+
+import (
+    "testing"
+)
+
+func TestInitPromMetricsTwice(t *testing.T) {
+    InitPromMetrics()
+    InitPromMetrics()
+}
@@ -0,0 +1,129 @@
+package format
+
+import (
+    "fmt"
+    "time"
+    "strconv"
+    "strings"
+)
+
+// InfluxDecoder decodes the InfluxDB line protocol, one metric per line:
+// cpu,host=a usage_idle=99.1,usage_user=0.5 1458229140000000000
+// Numeric fields are expanded into samples the same way as with the
+// Telegraf JSON format. Lines without a timestamp get the timestamp of
+// the Kafka message.
+type InfluxDecoder struct {
+    timestamps  *TimestampParser
+}
+
+func (d *InfluxDecoder) Decode(msg *Message) ([]Sample, error) {
+    defaultTs := msg.Timestamp.UTC()
+    if msg.Timestamp.IsZero() {
+        defaultTs = time.Now().UTC()
+    }
+
+    samples := make([]Sample, 0)
+    for n, line := range strings.Split(string(msg.Value), "\n") {
+        line = strings.TrimSpace(line)
+        if len(line) == 0 || line[0] == '#' {
+            continue
+        }
+
+        s, err := d.parseLine(line, defaultTs, msg)
+        if err != nil {
+            return nil, fmt.Errorf("Line %d: %v", n+1, err)
+        }
+        samples = append(samples, s...)
+    }
+    return samples, nil
+}
+
+func (d *InfluxDecoder) parseLine(line string, defaultTs time.Time, msg *Message) ([]Sample, error) {
+    parts := splitUnescaped(line, ' ')
+    if len(parts) < 2 || len(parts) > 3 {
+        return nil, fmt.Errorf("Invalid line %q", line)
+    }
+
+    keys := splitUnescaped(parts[0], ',')
+    measurement := unescapeInflux(keys[0])
+    labels := make(map[string]string, len(keys)-1)
+    for _, tag := range keys[1:] {
+        kv := splitUnescaped(tag, '=')
+        if len(kv) != 2 {
+            return nil, fmt.Errorf("Invalid tag %q", tag)
+        }
+        labels[sanitizeName(unescapeInflux(kv[0]))] = unescapeInflux(kv[1])
+    }
+
+    ts := defaultTs
+    if len(parts) == 3 {
+        var err error
+        ts, err = d.timestamps.Parse(parts[2], msg)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    samples := make([]Sample, 0)
+    for _, field := range splitUnescaped(parts[1], ',') {
+        kv := splitUnescaped(field, '=')
+        if len(kv) != 2 {
+            return nil, fmt.Errorf("Invalid field %q", field)
+        }
+
+        value, ok := parseInfluxValue(kv[1])
+        if !ok {
+            continue
+        }
+        name := fieldSampleName(measurement, unescapeInflux(kv[0]))
+        samples = append(samples, Sample{Name: name, Labels: copyLabels(labels), Value: value, Timestamp: ts})
+    }
+    return samples, nil
+}
+
+// Integers carry an i or u suffix, strings are quoted and booleans are
+// spelled out. Only numeric fields are returned.
+func parseInfluxValue(s string) (float64, bool) {
+    if len(s) == 0 || s[0] == '"' {
+        return 0, false
+    }
+    switch s[len(s)-1] {
+    case 'i', 'u':
+        s = s[:len(s)-1]
+    }
+    v, err := strconv.ParseFloat(s, 64)
+    return v, err == nil
+}
+
+// Splits s at sep characters that are neither escaped nor quoted
+func splitUnescaped(s string, sep byte) []string {
+    parts := make([]string, 0)
+    quoted := false
+    start := 0
+    for i := 0; i < len(s); i++ {
+        switch {
+        case s[i] == '\\':
+            i++
+        case s[i] == '"':
+            quoted = !quoted
+        case s[i] == sep && !quoted:
+            parts = append(parts, s[start:i])
+            start = i + 1
+        }
+    }
+    return append(parts, s[start:])
+}
+
+func unescapeInflux(s string) string {
+    if strings.IndexByte(s, '\\') < 0 {
+        return s
+    }
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        if s[i] == '\\' && i+1 < len(s) {
+            i++
+        }
+        b.WriteByte(s[i])
+    }
+    return b.String()
+}
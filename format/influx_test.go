@@ -0,0 +1,110 @@
+package format
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestInfluxDecoder(t *testing.T) {
+    timestamps, err := NewTimestampParser(TIMESTAMP_FORMAT_AUTO, "", TIMESTAMP_FALLBACK_NONE)
+    if err != nil {
+        t.Fatal(err)
+    }
+    d := &InfluxDecoder{timestamps: timestamps}
+    ts := time.Unix(1600000000, 0).UTC()
+    msgTs := time.Unix(1500000000, 0).UTC()
+
+    tests := []struct {
+        name   string
+        value  string
+        want   []Sample
+        err    bool
+    }{
+        {"fields and tags", "cpu,host=a,region=eu usage_idle=99.5,usage_user=0.5 1600000000000000000", []Sample{
+            {Name: "cpu_usage_idle", Labels: map[string]string{"host": "a", "region": "eu"}, Value: 99.5, Timestamp: ts},
+            {Name: "cpu_usage_user", Labels: map[string]string{"host": "a", "region": "eu"}, Value: 0.5, Timestamp: ts},
+        }, false},
+        {"value field", "load value=1.5 1600000000", []Sample{
+            {Name: "load", Labels: map[string]string{}, Value: 1.5, Timestamp: ts},
+        }, false},
+        {"integer suffixes", "mem free=10i,used=20u 1600000000000000000", []Sample{
+            {Name: "mem_free", Labels: map[string]string{}, Value: 10, Timestamp: ts},
+            {Name: "mem_used", Labels: map[string]string{}, Value: 20, Timestamp: ts},
+        }, false},
+        {"strings and booleans skipped", `svc,host=a state="up, running",ok=true,code=3i 1600000000000000000`, []Sample{
+            {Name: "svc_code", Labels: map[string]string{"host": "a"}, Value: 3, Timestamp: ts},
+        }, false},
+        {"escapes", `disk\ io,path=/var\ log,dev\,x=sda read\ bytes=5 1600000000000000000`, []Sample{
+            {Name: "disk_io_read_bytes", Labels: map[string]string{"path": "/var log", "dev_x": "sda"}, Value: 5, Timestamp: ts},
+        }, false},
+        {"message timestamp", "temp value=21", []Sample{
+            {Name: "temp", Labels: map[string]string{}, Value: 21, Timestamp: msgTs},
+        }, false},
+        {"several lines and comments", "# comment\n\na value=1 1600000000\nb value=2 1600000000\n", []Sample{
+            {Name: "a", Labels: map[string]string{}, Value: 1, Timestamp: ts},
+            {Name: "b", Labels: map[string]string{}, Value: 2, Timestamp: ts},
+        }, false},
+        {"missing fields", "cpu,host=a", nil, true},
+        {"invalid tag", "cpu,host value=1", nil, true},
+        {"invalid field", "cpu value 1600000000", nil, true},
+        {"invalid timestamp", "cpu value=1 yesterday", nil, true},
+        {"invalid second line", "a value=1\nb", nil, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            samples, err := d.Decode(&Message{Value: []byte(tt.value), Timestamp: msgTs})
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("expected an error, got %v", samples)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(samples, tt.want) {
+                t.Errorf("got %v, want %v", samples, tt.want)
+            }
+        })
+    }
+}
+
+func TestInfluxDecoderNoMessageTimestamp(t *testing.T) {
+    timestamps, err := NewTimestampParser(TIMESTAMP_FORMAT_AUTO, "", TIMESTAMP_FALLBACK_NONE)
+    if err != nil {
+        t.Fatal(err)
+    }
+    d := &InfluxDecoder{timestamps: timestamps}
+
+    before := time.Now()
+    samples, err := d.Decode(&Message{Value: []byte("temp value=21")})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(samples) != 1 || samples[0].Timestamp.Before(before) || samples[0].Timestamp.After(time.Now()) {
+        t.Errorf("expected the current time, got %v", samples)
+    }
+}
+
+func TestInfluxDecoderOwnLabels(t *testing.T) {
+    timestamps, err := NewTimestampParser(TIMESTAMP_FORMAT_AUTO, "", TIMESTAMP_FALLBACK_NONE)
+    if err != nil {
+        t.Fatal(err)
+    }
+    d := &InfluxDecoder{timestamps: timestamps}
+
+    samples, err := d.Decode(&Message{Value: []byte("cpu,host=a idle=1,user=2 1600000000")})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(samples) != 2 {
+        t.Fatalf("got %d samples, want 2", len(samples))
+    }
+
+    samples[0].Labels["cpu"] = "0"
+    if _, ok := samples[1].Labels["cpu"]; ok {
+        t.Error("expected the samples of the fields to have labels of their own")
+    }
+}
@@ -0,0 +1,60 @@
+package format
+
+import (
+    "fmt"
+    "bytes"
+    "encoding/json"
+)
+
+// JSONDecoder decodes the messages produced by prometheus-kafka-adapter
+// where each message holds a single sample:
+// {"timestamp": "...", "value": "...", "name": "...", "labels": {...}}
+type JSONDecoder struct {
+    timestamps  *TimestampParser
+}
+
+func (d *JSONDecoder) Decode(msg *Message) ([]Sample, error) {
+    var f interface{}
+
+    dec := json.NewDecoder(bytes.NewReader(msg.Value))
+    dec.UseNumber()
+    err := dec.Decode(&f)
+    if err != nil {
+        return nil, err
+    }
+
+    m, ok := f.(map[string]interface{})
+    if !ok {
+        return nil, fmt.Errorf("Can't find metric object")
+    }
+
+    name := fmt.Sprintf("%v", m["name"])
+
+    labelMap, ok := m["labels"].(map[string]interface{})
+    if !ok {
+        return nil, fmt.Errorf("Can't find labels of metric %s", name)
+    }
+
+    labels := make(map[string]string, len(labelMap))
+    for l, v := range labelMap {
+        if l == "__name__" {
+            name = fmt.Sprintf("%v", v)
+            continue
+        }
+        if l != name {
+            labels[l] = fmt.Sprintf("%v", v)
+        }
+    }
+
+    ts, err := d.timestamps.Parse(m["timestamp"], msg)
+    if err != nil {
+        return nil, err
+    }
+
+    value, err := ParseValue(m["value"])
+    if err != nil {
+        return nil, fmt.Errorf("Can't parse value of metric %s: %v", name, err)
+    }
+
+    return []Sample{{Name: name, Labels: labels, Value: value, Timestamp: ts}}, nil
+}
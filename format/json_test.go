@@ -0,0 +1,56 @@
+package format
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestJSONDecoder(t *testing.T) {
+    timestamps, err := NewTimestampParser(TIMESTAMP_FORMAT_AUTO, "", TIMESTAMP_FALLBACK_NONE)
+    if err != nil {
+        t.Fatal(err)
+    }
+    d := &JSONDecoder{timestamps: timestamps}
+    ts := time.Unix(1600000000, 0).UTC()
+
+    tests := []struct {
+        name   string
+        value  string
+        want   []Sample
+        err    bool
+    }{
+        {"sample", `{"timestamp":"2020-09-13T12:26:40Z","value":"1.5","name":"up","labels":{"__name__":"up","job":"api"}}`, []Sample{
+            {Name: "up", Labels: map[string]string{"job": "api"}, Value: 1.5, Timestamp: ts},
+        }, false},
+        {"name from labels", `{"timestamp":"2020-09-13T12:26:40Z","value":"2","name":"x","labels":{"__name__":"up"}}`, []Sample{
+            {Name: "up", Labels: map[string]string{}, Value: 2, Timestamp: ts},
+        }, false},
+        {"numeric value and timestamp", `{"timestamp":1600000000000,"value":3,"name":"up","labels":{}}`, []Sample{
+            {Name: "up", Labels: map[string]string{}, Value: 3, Timestamp: ts},
+        }, false},
+        {"invalid json", `{"timestamp":`, nil, true},
+        {"not an object", `[1, 2]`, nil, true},
+        {"no labels", `{"timestamp":"2020-09-13T12:26:40Z","value":"1","name":"up"}`, nil, true},
+        {"invalid value", `{"timestamp":"2020-09-13T12:26:40Z","value":"high","name":"up","labels":{}}`, nil, true},
+        {"invalid timestamp", `{"timestamp":"yesterday","value":"1","name":"up","labels":{}}`, nil, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            samples, err := d.Decode(&Message{Value: []byte(tt.value)})
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("expected an error, got %v", samples)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(samples, tt.want) {
+                t.Errorf("got %v, want %v", samples, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,79 @@
+package format
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// A compiled JSON path expression. Only the subset needed to locate
+// fields in a decoded JSON document is supported:
+// $.a.b, $.a[0].b, $['key.with.dots'] and the shorthand a.b
+type jsonPath []interface{}
+
+func compileJSONPath(expr string) (jsonPath, error) {
+    s := strings.TrimSpace(expr)
+    s = strings.TrimPrefix(s, "$")
+
+    path := make(jsonPath, 0)
+    for len(s) > 0 {
+        switch s[0] {
+        case '.':
+            s = s[1:]
+        case '[':
+            end := strings.IndexByte(s, ']')
+            if end < 0 {
+                return nil, fmt.Errorf("Unterminated '[' in JSON path %q", expr)
+            }
+            elem := s[1:end]
+            s = s[end+1:]
+            if len(elem) >= 2 && (elem[0] == '\'' || elem[0] == '"') && elem[len(elem)-1] == elem[0] {
+                path = append(path, elem[1:len(elem)-1])
+                continue
+            }
+            i, err := strconv.Atoi(elem)
+            if err != nil {
+                return nil, fmt.Errorf("Invalid index %q in JSON path %q", elem, expr)
+            }
+            path = append(path, i)
+            continue
+        }
+
+        end := strings.IndexAny(s, ".[")
+        if end < 0 {
+            end = len(s)
+        }
+        if end == 0 {
+            return nil, fmt.Errorf("Empty key in JSON path %q", expr)
+        }
+        path = append(path, s[:end])
+        s = s[end:]
+    }
+    return path, nil
+}
+
+// Returns the value at the path or false if the document doesn't
+// have one
+func (p jsonPath) lookup(doc interface{}) (interface{}, bool) {
+    v := doc
+    for _, elem := range p {
+        switch e := elem.(type) {
+        case string:
+            m, ok := v.(map[string]interface{})
+            if !ok {
+                return nil, false
+            }
+            v, ok = m[e]
+            if !ok {
+                return nil, false
+            }
+        case int:
+            a, ok := v.([]interface{})
+            if !ok || e < 0 || e >= len(a) {
+                return nil, false
+            }
+            v = a[e]
+        }
+    }
+    return v, true
+}
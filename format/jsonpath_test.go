@@ -0,0 +1,78 @@
+package format
+
+import (
+    "reflect"
+    "testing"
+    "encoding/json"
+)
+
+func TestCompileJSONPath(t *testing.T) {
+    tests := []struct {
+        expr  string
+        want  jsonPath
+        err   bool
+    }{
+        {"$.a.b", jsonPath{"a", "b"}, false},
+        {"a.b", jsonPath{"a", "b"}, false},
+        {"$.a[0].b", jsonPath{"a", 0, "b"}, false},
+        {"$['key.with.dots']", jsonPath{"key.with.dots"}, false},
+        {`$["quoted"].x`, jsonPath{"quoted", "x"}, false},
+        {"$", jsonPath{}, false},
+        {"$.a[", nil, true},
+        {"$.a[x]", nil, true},
+        {"$.a..b", nil, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.expr, func(t *testing.T) {
+            got, err := compileJSONPath(tt.expr)
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("expected an error, got %v", got)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("got %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestJSONPathLookup(t *testing.T) {
+    var doc interface{}
+    err := json.Unmarshal([]byte(`{"a": {"b": [10, {"c": "x"}]}, "key.with.dots": true}`), &doc)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        expr   string
+        want   interface{}
+        found  bool
+    }{
+        {"$.a.b[0]", float64(10), true},
+        {"$.a.b[1].c", "x", true},
+        {"$['key.with.dots']", true, true},
+        {"$.a.missing", nil, false},
+        {"$.a.b[5]", nil, false},
+        {"$.a.b.c", nil, false},
+        {"$.a[0]", nil, false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.expr, func(t *testing.T) {
+            p, err := compileJSONPath(tt.expr)
+            if err != nil {
+                t.Fatal(err)
+            }
+            got, found := p.lookup(doc)
+            if found != tt.found || !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("got %v, %v, want %v, %v", got, found, tt.want, tt.found)
+            }
+        })
+    }
+}
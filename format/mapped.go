@@ -0,0 +1,159 @@
+package format
+
+import (
+    "fmt"
+    "sort"
+    "bytes"
+    "strconv"
+    "strings"
+    "encoding/json"
+)
+
+// MappedDecoder decodes JSON messages of arbitrary shape by locating
+// the name, value, timestamp and labels of a sample with JSON path
+// expressions. A message may hold a single object or an array of them.
+type MappedDecoder struct {
+    name            jsonPath
+    value           jsonPath
+    timestamp       jsonPath
+    labels          jsonPath
+    constLabels     map[string]string
+    separator       string
+    timestamps      *TimestampParser
+}
+
+func NewMappedDecoder(cfg *Config, timestamps *TimestampParser) (*MappedDecoder, error) {
+    d := &MappedDecoder{
+        separator  : cfg.mappingLabelSeparator,
+        timestamps : timestamps,
+    }
+
+    var err error
+    for _, p := range []struct {
+        path  *jsonPath
+        expr  string
+    }{
+        {&d.name, cfg.mappingName},
+        {&d.value, cfg.mappingValue},
+        {&d.timestamp, cfg.mappingTimestamp},
+        {&d.labels, cfg.mappingLabels},
+    } {
+        *p.path, err = compileJSONPath(p.expr)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    d.constLabels, err = parseConstLabels(cfg.mappingConstLabels)
+    if err != nil {
+        return nil, err
+    }
+    return d, nil
+}
+
+// Parses constant labels given as name=value,name=value
+func parseConstLabels(s string) (map[string]string, error) {
+    labels := make(map[string]string)
+    for _, pair := range strings.Split(s, ",") {
+        pair = strings.TrimSpace(pair)
+        if len(pair) == 0 {
+            continue
+        }
+        kv := strings.SplitN(pair, "=", 2)
+        if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+            return nil, fmt.Errorf("Invalid constant label %q", pair)
+        }
+        labels[sanitizeName(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+    }
+    return labels, nil
+}
+
+func (d *MappedDecoder) Decode(msg *Message) ([]Sample, error) {
+    var doc interface{}
+
+    dec := json.NewDecoder(bytes.NewReader(msg.Value))
+    dec.UseNumber()
+    err := dec.Decode(&doc)
+    if err != nil {
+        return nil, err
+    }
+
+    objects, ok := doc.([]interface{})
+    if !ok {
+        objects = []interface{}{doc}
+    }
+
+    samples := make([]Sample, 0, len(objects))
+    for _, obj := range objects {
+        s, err := d.decodeObject(obj, msg)
+        if err != nil {
+            return nil, err
+        }
+        samples = append(samples, s)
+    }
+    return samples, nil
+}
+
+func (d *MappedDecoder) decodeObject(obj interface{}, msg *Message) (Sample, error) {
+    var s Sample
+
+    name, ok := d.name.lookup(obj)
+    if !ok {
+        return s, fmt.Errorf("Can't find metric name")
+    }
+    s.Name = sanitizeName(fmt.Sprintf("%v", name))
+
+    value, _ := d.value.lookup(obj)
+    v, err := ParseValue(value)
+    if err != nil {
+        return s, fmt.Errorf("Can't parse value of metric %s: %v", s.Name, err)
+    }
+    s.Value = v
+
+    ts, _ := d.timestamp.lookup(obj)
+    s.Timestamp, err = d.timestamps.Parse(ts, msg)
+    if err != nil {
+        return s, fmt.Errorf("Can't parse timestamp of metric %s: %v", s.Name, err)
+    }
+
+    s.Labels = make(map[string]string, len(d.constLabels))
+    for k, lv := range d.constLabels {
+        s.Labels[k] = lv
+    }
+    if labels, ok := d.labels.lookup(obj); ok {
+        d.flattenLabels(s.Labels, "", labels)
+    }
+    return s, nil
+}
+
+// Nested label objects and arrays are flattened by joining the keys
+// with the configured separator, {"k8s": {"pod": "x"}} becomes k8s_pod="x"
+func (d *MappedDecoder) flattenLabels(labels map[string]string, prefix string, v interface{}) {
+    join := func(key string) string {
+        if prefix == "" {
+            return key
+        }
+        return prefix + d.separator + key
+    }
+
+    switch t := v.(type) {
+    case map[string]interface{}:
+        keys := make([]string, 0, len(t))
+        for k := range t {
+            keys = append(keys, k)
+        }
+        sort.Strings(keys)
+        for _, k := range keys {
+            d.flattenLabels(labels, join(k), t[k])
+        }
+    case []interface{}:
+        for i, e := range t {
+            d.flattenLabels(labels, join(strconv.Itoa(i)), e)
+        }
+    case nil:
+    default:
+        if prefix != "" {
+            labels[sanitizeName(prefix)] = fmt.Sprintf("%v", t)
+        }
+    }
+}
@@ -0,0 +1,98 @@
+package format
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestMappedDecoder(t *testing.T) {
+    timestamps, err := NewTimestampParser(TIMESTAMP_FORMAT_AUTO, "", TIMESTAMP_FALLBACK_NONE)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cfg := &Config{
+        mappingName           : "$.metric",
+        mappingValue          : "$.data.value",
+        mappingTimestamp      : "$.data.ts",
+        mappingLabels         : "$.tags",
+        mappingConstLabels    : "source=kafka",
+        mappingLabelSeparator : "_",
+    }
+    d, err := NewMappedDecoder(cfg, timestamps)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ts := time.Unix(1600000000, 0).UTC()
+
+    tests := []struct {
+        name   string
+        value  string
+        want   []Sample
+        err    bool
+    }{
+        {"object", `{"metric":"temp","data":{"value":21.5,"ts":1600000000},"tags":{"room":"a"}}`, []Sample{
+            {Name: "temp", Labels: map[string]string{"source": "kafka", "room": "a"}, Value: 21.5, Timestamp: ts},
+        }, false},
+        {"array", `[{"metric":"a","data":{"value":1,"ts":1600000000}},{"metric":"b","data":{"value":"2","ts":1600000000}}]`, []Sample{
+            {Name: "a", Labels: map[string]string{"source": "kafka"}, Value: 1, Timestamp: ts},
+            {Name: "b", Labels: map[string]string{"source": "kafka"}, Value: 2, Timestamp: ts},
+        }, false},
+        {"nested labels", `{"metric":"cpu.usage","data":{"value":1,"ts":1600000000},"tags":{"k8s":{"pod":"x","ports":[80,443]},"zone":null}}`, []Sample{
+            {Name: "cpu_usage", Labels: map[string]string{"source": "kafka", "k8s_pod": "x", "k8s_ports_0": "80", "k8s_ports_1": "443"}, Value: 1, Timestamp: ts},
+        }, false},
+        {"labels override constant labels", `{"metric":"a","data":{"value":1,"ts":1600000000},"tags":{"source":"mqtt"}}`, []Sample{
+            {Name: "a", Labels: map[string]string{"source": "mqtt"}, Value: 1, Timestamp: ts},
+        }, false},
+        {"missing name", `{"data":{"value":1,"ts":1600000000}}`, nil, true},
+        {"missing value", `{"metric":"a","data":{"ts":1600000000}}`, nil, true},
+        {"missing timestamp", `{"metric":"a","data":{"value":1}}`, nil, true},
+        {"invalid json", `{"metric":`, nil, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            samples, err := d.Decode(&Message{Value: []byte(tt.value)})
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("expected an error, got %v", samples)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(samples, tt.want) {
+                t.Errorf("got %v, want %v", samples, tt.want)
+            }
+        })
+    }
+}
+
+func TestParseConstLabels(t *testing.T) {
+    tests := []struct {
+        value  string
+        want   map[string]string
+        err    bool
+    }{
+        {"", map[string]string{}, false},
+        {"env=prod, region = eu", map[string]string{"env": "prod", "region": "eu"}, false},
+        {"url=a=b", map[string]string{"url": "a=b"}, false},
+        {"dc-name=x", map[string]string{"dc_name": "x"}, false},
+        {"env", nil, true},
+        {"=prod", nil, true},
+    }
+
+    for _, tt := range tests {
+        got, err := parseConstLabels(tt.value)
+        if tt.err {
+            if err == nil {
+                t.Errorf("parseConstLabels(%q): expected an error", tt.value)
+            }
+            continue
+        }
+        if err != nil || !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("parseConstLabels(%q) = %v, %v, want %v", tt.value, got, err, tt.want)
+        }
+    }
+}
@@ -0,0 +1,100 @@
+package format
+
+import (
+    "sync"
+    "time"
+)
+
+// Metadata of a metric family as carried by some of the input formats
+type Metadata struct {
+    Name  string
+    Type  string
+    Help  string
+    Unit  string
+}
+
+// Decoders that keep metadata hand it out through this interface.
+// Metadata returns the entries that are due to be written and a function
+// to report whether they were. Entries that were not written are due
+// again with the next call.
+type MetadataSource interface {
+    Metadata() ([]Metadata, func(written bool))
+}
+
+// Keeps the latest metadata of every metric family seen by the decoders.
+// The same family usually comes with every scrape, so an entry is handed
+// out again at most once per interval and only if it was seen since.
+type metadataStore struct {
+    mutex     sync.Mutex
+    interval  time.Duration
+    entries   map[string]*metadataEntry
+}
+
+type metadataEntry struct {
+    md       Metadata
+    seen     bool
+    written  time.Time
+}
+
+func newMetadataStore(interval time.Duration) *metadataStore {
+    return &metadataStore{interval: interval, entries: make(map[string]*metadataEntry)}
+}
+
+// Records metadata of a family, fields that are empty keep what was
+// recorded before. Safe to call on a nil store.
+func (s *metadataStore) observe(md Metadata) {
+    if s == nil || len(md.Name) == 0 {
+        return
+    }
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    e, ok := s.entries[md.Name]
+    if !ok {
+        e = &metadataEntry{md: Metadata{Name: md.Name}}
+        s.entries[md.Name] = e
+    }
+    if len(md.Type) > 0 {
+        e.md.Type = md.Type
+    }
+    if len(md.Help) > 0 {
+        e.md.Help = md.Help
+    }
+    if len(md.Unit) > 0 {
+        e.md.Unit = md.Unit
+    }
+    e.seen = true
+}
+
+func (s *metadataStore) Metadata() ([]Metadata, func(written bool)) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    now := time.Now()
+    due := make([]Metadata, 0)
+    entries := make([]*metadataEntry, 0)
+    for _, e := range s.entries {
+        if !e.seen || now.Sub(e.written) < s.interval {
+            continue
+        }
+        due = append(due, e.md)
+        entries = append(entries, e)
+        // Not handed out to other batches while this one is written
+        e.seen = false
+    }
+
+    ack := func(written bool) {
+        s.mutex.Lock()
+        defer s.mutex.Unlock()
+
+        for _, e := range entries {
+            if written {
+                e.written = now
+            } else {
+                e.seen = true
+            }
+        }
+    }
+    return due, ack
+}
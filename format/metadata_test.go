@@ -0,0 +1,50 @@
+package format
+
+import (
+    "testing"
+    "time"
+)
+
+func TestMetadataStoreAck(t *testing.T) {
+    s := newMetadataStore(time.Hour)
+    s.observe(Metadata{Name: "up", Type: "gauge"})
+    s.observe(Metadata{Name: "up", Help: "Whether the target is up"})
+
+    md, ack := s.Metadata()
+    if len(md) != 1 || md[0] != (Metadata{Name: "up", Type: "gauge", Help: "Whether the target is up"}) {
+        t.Fatalf("unexpected metadata %v", md)
+    }
+    if again, _ := s.Metadata(); len(again) != 0 {
+        t.Errorf("metadata being written was handed out again: %v", again)
+    }
+
+    // Not written, due with the next batch
+    ack(false)
+    md, ack = s.Metadata()
+    if len(md) != 1 {
+        t.Fatalf("expected metadata that wasn't written to be due again, got %v", md)
+    }
+
+    // Written, not due again within the interval even if seen
+    ack(true)
+    s.observe(Metadata{Name: "up", Type: "gauge"})
+    if md, _ = s.Metadata(); len(md) != 0 {
+        t.Errorf("expected no metadata within the interval, got %v", md)
+    }
+}
+
+func TestMetadataStoreInterval(t *testing.T) {
+    s := newMetadataStore(0)
+    s.observe(Metadata{Name: "up", Type: "gauge"})
+
+    _, ack := s.Metadata()
+    ack(true)
+    if md, _ := s.Metadata(); len(md) != 0 {
+        t.Errorf("expected metadata that wasn't seen again to be skipped, got %v", md)
+    }
+
+    s.observe(Metadata{Name: "up"})
+    if md, _ := s.Metadata(); len(md) != 1 || md[0].Type != "gauge" {
+        t.Errorf("expected the recorded metadata once seen again, got %v", md)
+    }
+}
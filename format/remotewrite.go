@@ -0,0 +1,181 @@
+package format
+
+import (
+    "fmt"
+    "math"
+    "encoding/binary"
+
+    "github.com/golang/snappy"
+)
+
+// RemoteWriteDecoder decodes Prometheus remote write requests, the
+// protobuf WriteRequest message, compressed with snappy's block format
+// as Prometheus sends it or uncompressed. Sample values are raw floats
+// so staleness markers come through as such.
+//
+// Only the fields needed here are decoded:
+// WriteRequest   { repeated TimeSeries timeseries = 1; repeated MetricMetadata metadata = 3; }
+// TimeSeries     { repeated Label labels = 1; repeated Sample samples = 2; }
+// Label          { string name = 1; string value = 2; }
+// Sample         { double value = 1; int64 timestamp = 2; }
+// MetricMetadata { MetricType type = 1; string metric_family_name = 2; string help = 4; string unit = 5; }
+type RemoteWriteDecoder struct {
+    metadata  *metadataStore
+}
+
+// Names of the MetricType enum values
+var remoteWriteTypes = []string{"unknown", "counter", "gauge", "histogram", "gaugehistogram", "summary", "info", "stateset"}
+
+func (d *RemoteWriteDecoder) Decode(msg *Message) ([]Sample, error) {
+    buf := msg.Value
+    if decoded, err := snappy.Decode(nil, buf); err == nil {
+        buf = decoded
+    }
+
+    samples := make([]Sample, 0)
+    err := walkProto(buf, func(field int, b []byte, _ uint64) error {
+        switch field {
+        case 1:
+            s, err := decodeTimeSeries(b)
+            if err != nil {
+                return err
+            }
+            samples = append(samples, s...)
+        case 3:
+            md, err := decodeMetadata(b)
+            if err != nil {
+                return err
+            }
+            d.metadata.observe(md)
+        }
+        return nil
+    })
+    return samples, err
+}
+
+func decodeMetadata(buf []byte) (Metadata, error) {
+    var md Metadata
+    err := walkProto(buf, func(field int, b []byte, n uint64) error {
+        switch field {
+        case 1:
+            if n < uint64(len(remoteWriteTypes)) {
+                md.Type = remoteWriteTypes[n]
+            }
+        case 2:
+            md.Name = string(b)
+        case 4:
+            md.Help = string(b)
+        case 5:
+            md.Unit = string(b)
+        }
+        return nil
+    })
+    return md, err
+}
+
+func decodeTimeSeries(buf []byte) ([]Sample, error) {
+    var name string
+    labels := make(map[string]string)
+    samples := make([]Sample, 0, 1)
+
+    err := walkProto(buf, func(field int, b []byte, _ uint64) error {
+        switch field {
+        case 1:
+            var l, v string
+            err := walkProto(b, func(field int, b []byte, _ uint64) error {
+                switch field {
+                case 1:
+                    l = string(b)
+                case 2:
+                    v = string(b)
+                }
+                return nil
+            })
+            if err != nil {
+                return err
+            }
+            if l == "__name__" {
+                name = v
+            } else {
+                labels[l] = v
+            }
+        case 2:
+            var s Sample
+            err := walkProto(b, func(field int, _ []byte, n uint64) error {
+                var err error
+                switch field {
+                case 1:
+                    s.Value = math.Float64frombits(n)
+                case 2:
+                    s.Timestamp, err = unixMilli(int64(n))
+                }
+                return err
+            })
+            if err != nil {
+                return err
+            }
+            samples = append(samples, s)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    for i := range samples {
+        samples[i].Name = name
+        samples[i].Labels = copyLabels(labels)
+    }
+    return samples, nil
+}
+
+// Calls fn for every field of a protobuf message. Length delimited
+// fields are passed as b, varint and fixed size fields as n.
+func walkProto(buf []byte, fn func(field int, b []byte, n uint64) error) error {
+    for len(buf) > 0 {
+        tag, l := binary.Uvarint(buf)
+        if l <= 0 {
+            return fmt.Errorf("Invalid protobuf tag")
+        }
+        buf = buf[l:]
+
+        field := int(tag >> 3)
+        var b []byte
+        var n uint64
+
+        switch tag & 7 {
+        case 0:
+            n, l = binary.Uvarint(buf)
+            if l <= 0 {
+                return fmt.Errorf("Invalid protobuf varint")
+            }
+            buf = buf[l:]
+        case 1:
+            if len(buf) < 8 {
+                return fmt.Errorf("Truncated protobuf message")
+            }
+            n = binary.LittleEndian.Uint64(buf)
+            buf = buf[8:]
+        case 2:
+            size, l := binary.Uvarint(buf)
+            if l <= 0 || uint64(len(buf)-l) < size {
+                return fmt.Errorf("Truncated protobuf message")
+            }
+            b = buf[l:l+int(size)]
+            buf = buf[l+int(size):]
+        case 5:
+            if len(buf) < 4 {
+                return fmt.Errorf("Truncated protobuf message")
+            }
+            n = uint64(binary.LittleEndian.Uint32(buf))
+            buf = buf[4:]
+        default:
+            return fmt.Errorf("Unsupported protobuf wire type %d", tag & 7)
+        }
+
+        if err := fn(field, b, n); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,131 @@
+package format
+
+import (
+    "math"
+    "reflect"
+    "testing"
+    "time"
+    "encoding/binary"
+
+    "github.com/golang/snappy"
+)
+
+// Minimal protobuf encoding to build write requests
+func pbVarint(field int, n uint64) []byte {
+    return append(pbUvarint(uint64(field<<3)), pbUvarint(n)...)
+}
+
+func pbBytes(field int, b []byte) []byte {
+    buf := append(pbUvarint(uint64(field<<3|2)), pbUvarint(uint64(len(b)))...)
+    return append(buf, b...)
+}
+
+func pbFixed64(field int, n uint64) []byte {
+    buf := make([]byte, 8)
+    binary.LittleEndian.PutUint64(buf, n)
+    return append(pbUvarint(uint64(field<<3|1)), buf...)
+}
+
+func pbUvarint(n uint64) []byte {
+    buf := make([]byte, binary.MaxVarintLen64)
+    return buf[:binary.PutUvarint(buf, n)]
+}
+
+func pbJoin(parts ...[]byte) []byte {
+    buf := make([]byte, 0)
+    for _, p := range parts {
+        buf = append(buf, p...)
+    }
+    return buf
+}
+
+func pbLabel(name string, value string) []byte {
+    return pbBytes(1, pbJoin(pbBytes(1, []byte(name)), pbBytes(2, []byte(value))))
+}
+
+func pbSample(value float64, ms int64) []byte {
+    return pbBytes(2, pbJoin(pbFixed64(1, math.Float64bits(value)), pbVarint(2, uint64(ms))))
+}
+
+func testWriteRequest() []byte {
+    series := pbJoin(
+        pbLabel("__name__", "http_requests_total"),
+        pbLabel("job", "api"),
+        pbSample(1, 1600000000000),
+        pbSample(2, 1600000015000),
+    )
+    metadata := pbJoin(
+        pbVarint(1, 1),
+        pbBytes(2, []byte("http_requests_total")),
+        pbBytes(4, []byte("Requests served")),
+    )
+    return pbJoin(pbBytes(1, series), pbBytes(3, metadata))
+}
+
+func TestRemoteWriteDecoder(t *testing.T) {
+    labels := map[string]string{"job": "api"}
+    want := []Sample{
+        {Name: "http_requests_total", Labels: labels, Value: 1, Timestamp: time.Unix(1600000000, 0).UTC()},
+        {Name: "http_requests_total", Labels: labels, Value: 2, Timestamp: time.Unix(1600000015, 0).UTC()},
+    }
+
+    tests := []struct {
+        name   string
+        value  []byte
+        want   []Sample
+        err    bool
+    }{
+        {"snappy", snappy.Encode(nil, testWriteRequest()), want, false},
+        {"uncompressed", testWriteRequest(), want, false},
+        {"empty", []byte{}, []Sample{}, false},
+        {"truncated", testWriteRequest()[:10], nil, true},
+        {"invalid wire type", []byte{0x0f, 0x01}, nil, true},
+        {"timestamp out of range", pbBytes(1, pbJoin(pbLabel("__name__", "up"), pbSample(1, math.MaxInt64))), nil, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            d := &RemoteWriteDecoder{metadata: newMetadataStore(0)}
+            samples, err := d.Decode(&Message{Value: tt.value})
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("expected an error, got %v", samples)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(samples, tt.want) {
+                t.Errorf("got %v, want %v", samples, tt.want)
+            }
+        })
+    }
+}
+
+func TestRemoteWriteDecoderMetadata(t *testing.T) {
+    d := &RemoteWriteDecoder{metadata: newMetadataStore(0)}
+    _, err := d.Decode(&Message{Value: snappy.Encode(nil, testWriteRequest())})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    want := []Metadata{{Name: "http_requests_total", Type: "counter", Help: "Requests served"}}
+    if md, _ := d.metadata.Metadata(); !reflect.DeepEqual(md, want) {
+        t.Errorf("got %v, want %v", md, want)
+    }
+}
+
+func TestRemoteWriteDecoderStaleness(t *testing.T) {
+    stale := math.Float64frombits(0x7ff0000000000002)
+    req := pbBytes(1, pbJoin(pbLabel("__name__", "up"), pbSample(stale, 1600000000000)))
+
+    d := &RemoteWriteDecoder{}
+    samples, err := d.Decode(&Message{Value: req})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(samples) != 1 || math.Float64bits(samples[0].Value) != 0x7ff0000000000002 {
+        t.Errorf("expected the staleness marker to come through, got %v", samples)
+    }
+}
@@ -0,0 +1,327 @@
+package format
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "sync"
+    "time"
+    "strconv"
+    "strings"
+)
+
+// StatsdDecoder decodes StatsD and DogStatsD lines such as
+// page.views:1|c|@0.5|#env:prod,region:eu
+// Writing every StatsD event as a row would flood the database, so the
+// events are aggregated in memory and written once per flush interval:
+//
+// - counters (c) as a cumulative count
+// - gauges (g) as their last value, +n and -n adjust the previous value
+// - timers, histograms and distributions (ms, h, d) as quantiles of the
+//   values seen in the interval plus a cumulative _sum and _count
+// - sets (s) as the number of unique values seen in the interval
+//
+// Only series that received events in an interval are written. Series
+// without events for maxIdle flushes are forgotten, so counters and
+// gauges of series that come back start over. Events (_e) and service
+// checks (_sc) of DogStatsD are ignored.
+//
+// While the consumer of the flushed samples is busy the ticks in between
+// are skipped, so the next flush covers a longer interval and nothing is
+// lost. Close stops the flushes and returns what is left.
+type StatsdDecoder struct {
+    mutex      sync.Mutex
+    quantiles  []float64
+    maxIdle    int
+    series     map[string]*statsdSeries
+    flushed    chan []Sample
+    unsent     []Sample
+
+    ticker     *time.Ticker
+    stop       chan struct{}
+    done       chan struct{}
+}
+
+type statsdSeries struct {
+    name     string
+    labels   map[string]string
+    kind     string
+    updated  bool
+    idle     int
+    value    float64
+    sum      float64
+    count    float64
+    values   []float64
+    set      map[string]bool
+}
+
+// The flush interval must be positive
+func NewStatsdDecoder(flushInterval time.Duration, quantiles []float64, maxIdle int) *StatsdDecoder {
+    d := &StatsdDecoder{
+        quantiles : quantiles,
+        maxIdle   : maxIdle,
+        series    : make(map[string]*statsdSeries),
+        flushed   : make(chan []Sample, 1),
+        ticker    : time.NewTicker(flushInterval),
+        stop      : make(chan struct{}),
+        done      : make(chan struct{}),
+    }
+
+    go d.run()
+    return d
+}
+
+func (d *StatsdDecoder) run() {
+    defer close(d.done)
+    for {
+        select {
+        case <-d.stop:
+            return
+        case <-d.ticker.C:
+        }
+
+        samples := d.Flush()
+        if len(samples) == 0 {
+            continue
+        }
+        select {
+        case d.flushed <- samples:
+        case <-d.stop:
+            d.mutex.Lock()
+            d.unsent = samples
+            d.mutex.Unlock()
+            return
+        }
+    }
+}
+
+// Close stops the flushes and returns the samples of the interval that
+// is still open, preceded by any flush the consumer didn't take. It
+// must be called once.
+func (d *StatsdDecoder) Close() []Sample {
+    d.ticker.Stop()
+    close(d.stop)
+    <-d.done
+
+    var samples []Sample
+    select {
+    case samples = <-d.flushed:
+    default:
+    }
+
+    d.mutex.Lock()
+    samples = append(samples, d.unsent...)
+    d.unsent = nil
+    d.mutex.Unlock()
+
+    return append(samples, d.Flush()...)
+}
+
+// Parses a comma separated list of quantiles
+func parseQuantiles(s string) ([]float64, error) {
+    quantiles := make([]float64, 0)
+    for _, q := range strings.Split(s, ",") {
+        q = strings.TrimSpace(q)
+        if len(q) == 0 {
+            continue
+        }
+        f, err := strconv.ParseFloat(q, 64)
+        if err != nil || f < 0 || f > 1 {
+            return nil, fmt.Errorf("Invalid quantile %q", q)
+        }
+        quantiles = append(quantiles, f)
+    }
+    return quantiles, nil
+}
+
+// A parsed StatsD line
+type statsdEvent struct {
+    name    string
+    labels  map[string]string
+    kind    string
+    raw     string
+    value   float64
+    rate    float64
+}
+
+// Aggregates the lines of the message, no samples are returned until
+// the next flush. All lines are parsed before any is aggregated, so a
+// message with an invalid line changes nothing.
+func (d *StatsdDecoder) Decode(msg *Message) ([]Sample, error) {
+    invalid := 0
+    var lastErr error
+    events := make([]statsdEvent, 0)
+    for _, line := range strings.Split(string(msg.Value), "\n") {
+        line = strings.TrimSpace(line)
+        if len(line) == 0 || strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+            continue
+        }
+        ev, err := parseStatsdLine(line)
+        if err != nil {
+            invalid++
+            lastErr = err
+            continue
+        }
+        events = append(events, ev)
+    }
+
+    if invalid > 0 {
+        return nil, fmt.Errorf("%d invalid StatsD lines, last error: %v", invalid, lastErr)
+    }
+
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+
+    for i := range events {
+        d.apply(&events[i])
+    }
+    return nil, nil
+}
+
+func parseStatsdLine(line string) (statsdEvent, error) {
+    colon := strings.IndexByte(line, ':')
+    if colon <= 0 {
+        return statsdEvent{}, fmt.Errorf("Invalid StatsD line %q", line)
+    }
+    ev := statsdEvent{name: sanitizeName(line[:colon]), rate: 1.0, labels: make(map[string]string)}
+
+    parts := strings.Split(line[colon+1:], "|")
+    if len(parts) < 2 {
+        return statsdEvent{}, fmt.Errorf("Invalid StatsD line %q", line)
+    }
+    ev.raw, ev.kind = parts[0], parts[1]
+
+    for _, p := range parts[2:] {
+        switch {
+        case strings.HasPrefix(p, "@"):
+            r, err := strconv.ParseFloat(p[1:], 64)
+            if err != nil || r <= 0 || r > 1 {
+                return statsdEvent{}, fmt.Errorf("Invalid sample rate in StatsD line %q", line)
+            }
+            ev.rate = r
+        case strings.HasPrefix(p, "#"):
+            for _, tag := range strings.Split(p[1:], ",") {
+                kv := strings.SplitN(tag, ":", 2)
+                if len(kv) == 2 && len(kv[0]) > 0 && len(kv[1]) > 0 {
+                    ev.labels[sanitizeName(kv[0])] = kv[1]
+                }
+            }
+        }
+    }
+
+    switch ev.kind {
+    case "s":
+        return ev, nil
+    case "c", "g", "ms", "h", "d":
+    default:
+        return statsdEvent{}, fmt.Errorf("Unknown metric type in StatsD line %q", line)
+    }
+
+    v, err := strconv.ParseFloat(ev.raw, 64)
+    if err != nil || len(ev.raw) == 0 {
+        return statsdEvent{}, fmt.Errorf("Invalid value in StatsD line %q", line)
+    }
+    ev.value = v
+    return ev, nil
+}
+
+func (d *StatsdDecoder) apply(ev *statsdEvent) {
+    key := seriesKey(ev.name, ev.kind, ev.labels)
+    s, ok := d.series[key]
+    if !ok {
+        s = &statsdSeries{name: ev.name, labels: ev.labels, kind: ev.kind}
+        d.series[key] = s
+    }
+
+    switch ev.kind {
+    case "s":
+        if s.set == nil {
+            s.set = make(map[string]bool)
+        }
+        s.set[ev.raw] = true
+    case "c":
+        s.value += ev.value / ev.rate
+    case "g":
+        if ev.raw[0] == '+' || ev.raw[0] == '-' {
+            s.value += ev.value
+        } else {
+            s.value = ev.value
+        }
+    default:
+        s.values = append(s.values, ev.value)
+        s.sum += ev.value / ev.rate
+        s.count += 1 / ev.rate
+    }
+
+    s.updated = true
+    s.idle = 0
+}
+
+func seriesKey(name string, kind string, labels map[string]string) string {
+    pairs := make([]string, 0, len(labels))
+    for k, v := range labels {
+        pairs = append(pairs, k + "=" + v)
+    }
+    sort.Strings(pairs)
+    return name + "|" + kind + "|" + strings.Join(pairs, ",")
+}
+
+// Flushed returns the channel the aggregated samples are sent to at
+// the end of every flush interval
+func (d *StatsdDecoder) Flushed() <-chan []Sample {
+    return d.flushed
+}
+
+// Flush returns the samples of the series that were updated since the
+// last flush and starts a new interval
+func (d *StatsdDecoder) Flush() []Sample {
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+
+    now := time.Now().UTC()
+    samples := make([]Sample, 0)
+    for key, s := range d.series {
+        if !s.updated {
+            s.idle++
+            if d.maxIdle > 0 && s.idle >= d.maxIdle {
+                delete(d.series, key)
+            }
+            continue
+        }
+        s.updated = false
+
+        switch s.kind {
+        case "c", "g":
+            samples = append(samples, Sample{Name: s.name, Labels: s.labels, Value: s.value, Timestamp: now})
+        case "s":
+            samples = append(samples, Sample{Name: s.name, Labels: s.labels, Value: float64(len(s.set)), Timestamp: now})
+            s.set = nil
+        default:
+            sort.Float64s(s.values)
+            for _, q := range d.quantiles {
+                labels := make(map[string]string, len(s.labels)+1)
+                for k, v := range s.labels {
+                    labels[k] = v
+                }
+                labels["quantile"] = strconv.FormatFloat(q, 'f', -1, 64)
+                samples = append(samples, Sample{Name: s.name, Labels: labels, Value: quantile(s.values, q), Timestamp: now})
+            }
+            samples = append(samples, Sample{Name: s.name + "_sum", Labels: s.labels, Value: s.sum, Timestamp: now})
+            samples = append(samples, Sample{Name: s.name + "_count", Labels: s.labels, Value: s.count, Timestamp: now})
+            s.values = s.values[:0]
+        }
+    }
+    return samples
+}
+
+// Returns the q-quantile of sorted values using the nearest rank
+func quantile(values []float64, q float64) float64 {
+    if len(values) == 0 {
+        return math.NaN()
+    }
+    rank := int(math.Ceil(q * float64(len(values)))) - 1
+    if rank < 0 {
+        rank = 0
+    }
+    return values[rank]
+}
@@ -0,0 +1,207 @@
+package format
+
+import (
+    "sort"
+    "testing"
+    "time"
+)
+
+// Flushes the decoder and returns the values of the samples by name and
+// sorted labels
+func flushValues(d *StatsdDecoder) map[string]float64 {
+    values := make(map[string]float64)
+    for _, s := range d.Flush() {
+        values[seriesKey(s.Name, "", s.Labels)] = s.Value
+    }
+    return values
+}
+
+func TestStatsdDecoderAggregation(t *testing.T) {
+    tests := []struct {
+        name   string
+        lines  []string
+        want   map[string]float64
+    }{
+        {
+            name  : "counter with sample rate",
+            lines : []string{"hits:1|c", "hits:2|c|@0.5"},
+            want  : map[string]float64{"hits||": 5},
+        },
+        {
+            name  : "gauge with adjustments",
+            lines : []string{"temp:10|g", "temp:+5|g", "temp:-3|g"},
+            want  : map[string]float64{"temp||": 12},
+        },
+        {
+            name  : "set",
+            lines : []string{"users:alice|s", "users:bob|s", "users:alice|s"},
+            want  : map[string]float64{"users||": 2},
+        },
+        {
+            name  : "timer",
+            lines : []string{"rt:10|ms", "rt:20|ms", "rt:30|ms|@0.5"},
+            want  : map[string]float64{
+                "rt||quantile=0.5" : 20,
+                "rt||quantile=1"   : 30,
+                "rt_sum||"         : 90,
+                "rt_count||"       : 4,
+            },
+        },
+        {
+            name  : "dogstatsd tags",
+            lines : []string{"req.count:1|c|#env:prod,region:eu", "req.count:1|c|#region:eu,env:prod", "_e{1,1}:a|b", "_sc|check|0"},
+            want  : map[string]float64{"req_count||env=prod,region=eu": 2},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            d := NewStatsdDecoder(time.Hour, []float64{0.5, 1}, 0)
+            defer d.Close()
+            for _, line := range tt.lines {
+                if _, err := d.Decode(&Message{Value: []byte(line)}); err != nil {
+                    t.Fatal(err)
+                }
+            }
+
+            got := flushValues(d)
+            if len(got) != len(tt.want) {
+                t.Fatalf("got %v, want %v", got, tt.want)
+            }
+            for k, v := range tt.want {
+                if got[k] != v {
+                    t.Errorf("%s: got %v, want %v", k, got[k], v)
+                }
+            }
+        })
+    }
+}
+
+func TestStatsdDecoderInvalidMessage(t *testing.T) {
+    tests := []string{
+        "hits",
+        "hits:1",
+        "hits:x|c",
+        "hits:1|c|@2",
+        "hits:1|q",
+        "hits:|g",
+    }
+
+    for _, line := range tests {
+        t.Run(line, func(t *testing.T) {
+            d := NewStatsdDecoder(time.Hour, nil, 0)
+            defer d.Close()
+            _, err := d.Decode(&Message{Value: []byte("valid:1|c\n" + line)})
+            if err == nil {
+                t.Fatal("expected an error")
+            }
+            // The valid line of the message is not aggregated either
+            if got := d.Flush(); len(got) != 0 {
+                t.Errorf("got samples %v", got)
+            }
+        })
+    }
+}
+
+func TestStatsdDecoderIdleSeries(t *testing.T) {
+    d := NewStatsdDecoder(time.Hour, nil, 2)
+    defer d.Close()
+
+    d.Decode(&Message{Value: []byte("a:1|c\nb:1|c")})
+    d.Flush()
+
+    // b stays busy while a idles
+    for i := 0; i < 2; i++ {
+        d.Decode(&Message{Value: []byte("b:1|c")})
+        d.Flush()
+    }
+
+    var names []string
+    for _, s := range d.series {
+        names = append(names, s.name)
+    }
+    sort.Strings(names)
+    if len(names) != 1 || names[0] != "b" {
+        t.Fatalf("got series %v, want [b]", names)
+    }
+
+    // a starts over
+    d.Decode(&Message{Value: []byte("a:1|c")})
+    if got := flushValues(d)["a||"]; got != 1 {
+        t.Errorf("got %v, want 1", got)
+    }
+}
+
+func TestStatsdDecoderFlushed(t *testing.T) {
+    d := NewStatsdDecoder(10 * time.Millisecond, nil, 0)
+    defer d.Close()
+
+    d.Decode(&Message{Value: []byte("a:1|c")})
+    select {
+    case samples := <-d.Flushed():
+        if len(samples) != 1 || samples[0].Name != "a" || samples[0].Value != 1 {
+            t.Errorf("got %v", samples)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("expected a flush")
+    }
+}
+
+func TestStatsdDecoderClose(t *testing.T) {
+    d := NewStatsdDecoder(10 * time.Millisecond, nil, 0)
+
+    // Nobody takes the flushes, the one buffered and the one waiting to
+    // be sent are handed back by Close along with the open interval
+    d.Decode(&Message{Value: []byte("a:1|c")})
+    time.Sleep(50 * time.Millisecond)
+    d.Decode(&Message{Value: []byte("b:1|c")})
+    time.Sleep(50 * time.Millisecond)
+    d.Decode(&Message{Value: []byte("c:1|c")})
+
+    names := make(map[string]bool)
+    for _, s := range d.Close() {
+        names[s.Name] = true
+    }
+    if !names["a"] || !names["b"] || !names["c"] {
+        t.Errorf("got samples of %v, want a, b and c", names)
+    }
+
+    // Nothing flushes after Close
+    d.Decode(&Message{Value: []byte("d:1|c")})
+    time.Sleep(30 * time.Millisecond)
+    select {
+    case samples := <-d.Flushed():
+        t.Errorf("got a flush after Close: %v", samples)
+    default:
+    }
+}
+
+func TestParseQuantiles(t *testing.T) {
+    tests := []struct {
+        in    string
+        want  []float64
+        err   bool
+    }{
+        {"0.5,0.9, 0.99", []float64{0.5, 0.9, 0.99}, false},
+        {"", []float64{}, false},
+        {"1.5", nil, true},
+        {"x", nil, true},
+    }
+
+    for _, tt := range tests {
+        got, err := parseQuantiles(tt.in)
+        if tt.err != (err != nil) {
+            t.Errorf("%q: got error %v", tt.in, err)
+            continue
+        }
+        if len(got) != len(tt.want) {
+            t.Errorf("%q: got %v, want %v", tt.in, got, tt.want)
+            continue
+        }
+        for i := range got {
+            if got[i] != tt.want[i] {
+                t.Errorf("%q: got %v, want %v", tt.in, got, tt.want)
+            }
+        }
+    }
+}
@@ -0,0 +1,120 @@
+package format
+
+import (
+    "fmt"
+    "sort"
+    "bytes"
+    "strings"
+    "encoding/json"
+)
+
+// TelegrafDecoder decodes the output of Telegraf's JSON serializer. A
+// message holds either a single metric or, when Telegraf runs in batch
+// mode, a list of them under "metrics":
+// {"name": "cpu", "tags": {...}, "fields": {"usage_idle": 99.1, ...}, "timestamp": 1458229140}
+// {"metrics": [{"name": "cpu", ...}, {"name": "mem", ...}]}
+type TelegrafDecoder struct {
+    timestamps  *TimestampParser
+}
+
+type telegrafMetric struct {
+    Name       string                  `json:"name"`
+    Tags       map[string]string       `json:"tags"`
+    Fields     map[string]interface{}  `json:"fields"`
+    Timestamp  json.Number             `json:"timestamp"`
+}
+
+type telegrafMessage struct {
+    telegrafMetric
+    Metrics  []telegrafMetric  `json:"metrics"`
+}
+
+func (d *TelegrafDecoder) Decode(msg *Message) ([]Sample, error) {
+    var tm telegrafMessage
+
+    dec := json.NewDecoder(bytes.NewReader(msg.Value))
+    dec.UseNumber()
+    err := dec.Decode(&tm)
+    if err != nil {
+        return nil, err
+    }
+
+    metrics := tm.Metrics
+    if metrics == nil {
+        if tm.Name == "" {
+            return nil, fmt.Errorf("Can't find metric object")
+        }
+        metrics = []telegrafMetric{tm.telegrafMetric}
+    }
+
+    samples := make([]Sample, 0)
+    for i := range metrics {
+        expanded, err := d.expand(&metrics[i], msg)
+        if err != nil {
+            return nil, err
+        }
+        samples = append(samples, expanded...)
+    }
+    return samples, nil
+}
+
+// Every numeric field of a Telegraf metric becomes a sample of its own
+// named <measurement>_<field>. A field named "value" keeps the name of
+// the measurement, the same way Telegraf's Prometheus output does it.
+// Non-numeric fields are ignored.
+func (d *TelegrafDecoder) expand(m *telegrafMetric, msg *Message) ([]Sample, error) {
+    var v interface{}
+    if len(m.Timestamp) > 0 {
+        v = m.Timestamp
+    }
+
+    ts, err := d.timestamps.Parse(v, msg)
+    if err != nil {
+        return nil, fmt.Errorf("Can't parse timestamp of metric %s: %v", m.Name, err)
+    }
+
+    labels := make(map[string]string, len(m.Tags))
+    for k, v := range m.Tags {
+        labels[sanitizeName(k)] = v
+    }
+
+    fields := make([]string, 0, len(m.Fields))
+    for f := range m.Fields {
+        fields = append(fields, f)
+    }
+    sort.Strings(fields)
+
+    samples := make([]Sample, 0, len(fields))
+    for _, f := range fields {
+        n, ok := m.Fields[f].(json.Number)
+        if !ok {
+            continue
+        }
+        value, err := ParseValue(n)
+        if err != nil {
+            return nil, err
+        }
+
+        samples = append(samples, Sample{Name: fieldSampleName(m.Name, f), Labels: copyLabels(labels), Value: value, Timestamp: ts})
+    }
+    return samples, nil
+}
+
+// Samples are written with their own labels, so samples of the fields of
+// a metric don't share a map
+func copyLabels(labels map[string]string) map[string]string {
+    copied := make(map[string]string, len(labels))
+    for k, v := range labels {
+        copied[k] = v
+    }
+    return copied
+}
+
+// Samples of a field are named <measurement>_<field> except for fields
+// named "value" which keep the name of the measurement
+func fieldSampleName(measurement string, field string) string {
+    if field == "value" {
+        return sanitizeName(measurement)
+    }
+    return sanitizeName(strings.Join([]string{measurement, field}, "_"))
+}
@@ -0,0 +1,101 @@
+package format
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestTelegrafDecoder(t *testing.T) {
+    timestamps, err := NewTimestampParser("s", "", TIMESTAMP_FALLBACK_NONE)
+    if err != nil {
+        t.Fatal(err)
+    }
+    d := &TelegrafDecoder{timestamps: timestamps}
+    ts := time.Unix(1600000000, 0).UTC()
+    host := map[string]string{"host": "a"}
+
+    tests := []struct {
+        name   string
+        value  string
+        want   []Sample
+        err    bool
+    }{
+        {"single metric", `{"name":"cpu","tags":{"host":"a"},"fields":{"usage_user":0.5,"usage_idle":99.5},"timestamp":1600000000}`, []Sample{
+            {Name: "cpu_usage_idle", Labels: host, Value: 99.5, Timestamp: ts},
+            {Name: "cpu_usage_user", Labels: host, Value: 0.5, Timestamp: ts},
+        }, false},
+        {"batch", `{"metrics":[{"name":"cpu","tags":{"host":"a"},"fields":{"idle":1},"timestamp":1600000000},{"name":"mem","tags":{"host":"a"},"fields":{"free":2},"timestamp":1600000000}]}`, []Sample{
+            {Name: "cpu_idle", Labels: host, Value: 1, Timestamp: ts},
+            {Name: "mem_free", Labels: host, Value: 2, Timestamp: ts},
+        }, false},
+        {"value field", `{"name":"load","tags":{},"fields":{"value":1.5},"timestamp":1600000000}`, []Sample{
+            {Name: "load", Labels: map[string]string{}, Value: 1.5, Timestamp: ts},
+        }, false},
+        {"non-numeric fields skipped", `{"name":"svc","tags":{"host":"a"},"fields":{"state":"up","ok":true,"code":3},"timestamp":1600000000}`, []Sample{
+            {Name: "svc_code", Labels: host, Value: 3, Timestamp: ts},
+        }, false},
+        {"sanitized names", `{"name":"disk.io","tags":{"dev-name":"sda"},"fields":{"read-bytes":5},"timestamp":1600000000}`, []Sample{
+            {Name: "disk_io_read_bytes", Labels: map[string]string{"dev_name": "sda"}, Value: 5, Timestamp: ts},
+        }, false},
+        {"no metric", `{"tags":{}}`, nil, true},
+        {"invalid json", `{"name":`, nil, true},
+        {"missing timestamp", `{"name":"cpu","fields":{"idle":1}}`, nil, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            samples, err := d.Decode(&Message{Value: []byte(tt.value)})
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("expected an error, got %v", samples)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(samples, tt.want) {
+                t.Errorf("got %v, want %v", samples, tt.want)
+            }
+        })
+    }
+}
+
+func TestFieldSampleName(t *testing.T) {
+    tests := []struct {
+        measurement  string
+        field        string
+        want         string
+    }{
+        {"cpu", "usage_idle", "cpu_usage_idle"},
+        {"cpu", "value", "cpu"},
+        {"net.if", "bytes-in", "net_if_bytes_in"},
+    }
+    for _, tt := range tests {
+        if got := fieldSampleName(tt.measurement, tt.field); got != tt.want {
+            t.Errorf("fieldSampleName(%q, %q) = %s, want %s", tt.measurement, tt.field, got, tt.want)
+        }
+    }
+}
+
+func TestTelegrafDecoderOwnLabels(t *testing.T) {
+    timestamps, err := NewTimestampParser("s", "", TIMESTAMP_FALLBACK_NONE)
+    if err != nil {
+        t.Fatal(err)
+    }
+    d := &TelegrafDecoder{timestamps: timestamps}
+
+    samples, err := d.Decode(&Message{Value: []byte(`{"name":"cpu","tags":{"host":"a"},"fields":{"idle":1,"user":2},"timestamp":1600000000}`)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(samples) != 2 {
+        t.Fatalf("got %d samples, want 2", len(samples))
+    }
+
+    samples[0].Labels["cpu"] = "0"
+    if _, ok := samples[1].Labels["cpu"]; ok {
+        t.Error("expected the samples of the fields to have labels of their own")
+    }
+}
@@ -0,0 +1,192 @@
+package format
+
+import (
+    "fmt"
+    "math"
+    "time"
+    "strconv"
+    "strings"
+    "encoding/json"
+)
+
+// TimestampParser turns the timestamps found in messages into time
+// values. Numeric timestamps are taken as epoch time, either in a fixed
+// precision or, when the precision is zero, in a precision detected from
+// their magnitude. Strings are parsed with a custom layout first, so
+// all-digit layouts such as 20060102150405 work. Strings that don't
+// match it, or any string without a custom layout, are taken as epoch
+// time when they hold a number and parsed as RFC 3339 otherwise.
+type TimestampParser struct {
+    precision  time.Duration
+    layout     string
+    custom     bool
+    fallback   bool
+}
+
+const (
+    TIMESTAMP_FORMAT_AUTO    = "auto"
+    TIMESTAMP_FORMAT_RFC3339 = "rfc3339"
+
+    TIMESTAMP_FALLBACK_NONE  = "none"
+    TIMESTAMP_FALLBACK_KAFKA = "kafka"
+)
+
+var timestampPrecisions = map[string]time.Duration{
+    "s"  : time.Second,
+    "ms" : time.Millisecond,
+    "us" : time.Microsecond,
+    "ns" : time.Nanosecond,
+}
+
+// Creates a parser for the given format which is one of auto, rfc3339,
+// s, ms, us, ns or a Go time layout. A non-empty units string forces
+// the precision of numeric timestamps regardless of the format.
+func NewTimestampParser(format string, units string, fallback string) (*TimestampParser, error) {
+    p := &TimestampParser{layout: time.RFC3339Nano}
+
+    switch format {
+    case TIMESTAMP_FORMAT_AUTO, TIMESTAMP_FORMAT_RFC3339:
+    default:
+        if prec, ok := timestampPrecisions[format]; ok {
+            p.precision = prec
+        } else {
+            p.layout = format
+            p.custom = true
+        }
+    }
+
+    if len(units) > 0 {
+        prec, err := time.ParseDuration(units)
+        if err != nil {
+            return nil, err
+        }
+        p.precision = prec
+    }
+
+    switch fallback {
+    case TIMESTAMP_FALLBACK_NONE:
+    case TIMESTAMP_FALLBACK_KAFKA:
+        p.fallback = true
+    default:
+        return nil, fmt.Errorf("Unknown timestamp fallback %q", fallback)
+    }
+    return p, nil
+}
+
+// Parses the timestamp v found in msg. A nil v means the message has no
+// timestamp. If v is missing or can't be parsed the timestamp of the
+// Kafka message is used instead when the parser is configured to do so.
+func (p *TimestampParser) Parse(v interface{}, msg *Message) (time.Time, error) {
+    var ts time.Time
+    var err error
+
+    if v == nil {
+        err = fmt.Errorf("Missing timestamp")
+    } else {
+        ts, err = p.parse(v)
+    }
+
+    if err != nil && p.fallback && !msg.Timestamp.IsZero() {
+        return msg.Timestamp.UTC(), nil
+    }
+    return ts, err
+}
+
+func (p *TimestampParser) parse(v interface{}) (time.Time, error) {
+    switch t := v.(type) {
+    case json.Number:
+        return p.parseEpoch(t.String())
+    case float64:
+        return p.parseEpoch(strconv.FormatFloat(t, 'f', -1, 64))
+    case int64:
+        return p.parseEpoch(strconv.FormatInt(t, 10))
+    case string:
+        s := strings.TrimSpace(t)
+        if p.custom {
+            ts, err := time.Parse(p.layout, s)
+            if err == nil {
+                return ts, nil
+            }
+            if ts, eerr := p.parseEpoch(s); eerr == nil {
+                return ts, nil
+            }
+            return time.Time{}, err
+        }
+        if ts, err := p.parseEpoch(s); err == nil {
+            return ts, nil
+        }
+        return time.Parse(p.layout, s)
+    }
+    return time.Time{}, fmt.Errorf("Unsupported timestamp %v", v)
+}
+
+// Epoch timestamps are split into their integer and fractional parts so
+// that no precision is lost on the way to nanoseconds. The sign is taken
+// from the string since "-0" has none. Timestamps that don't fit into
+// int64 nanoseconds are refused.
+func (p *TimestampParser) parseEpoch(s string) (time.Time, error) {
+    intPart, fracPart := s, ""
+    if i := strings.IndexByte(s, '.'); i >= 0 {
+        intPart, fracPart = s[:i], s[i+1:]
+    }
+    neg := strings.HasPrefix(intPart, "-")
+
+    // Exponents only parse as floats
+    n, err := strconv.ParseInt(intPart, 10, 64)
+    if err != nil || strings.ContainsAny(fracPart, "eE") {
+        f, ferr := strconv.ParseFloat(s, 64)
+        if ferr != nil {
+            return time.Time{}, ferr
+        }
+        ns := f * float64(p.precisionOf(f))
+        if math.IsNaN(ns) || ns >= math.MaxInt64 || ns <= math.MinInt64 {
+            return time.Time{}, fmt.Errorf("Timestamp %q out of range", s)
+        }
+        return time.Unix(0, int64(ns)).UTC(), nil
+    }
+
+    prec := int64(p.precisionOf(float64(n)))
+    if n > math.MaxInt64 / prec || n < math.MinInt64 / prec {
+        return time.Time{}, fmt.Errorf("Timestamp %q out of range", s)
+    }
+    ns := n * prec
+
+    if len(fracPart) > 0 {
+        frac, err := strconv.ParseUint(fracPart, 10, 64)
+        if err != nil || len(fracPart) > 18 {
+            return time.Time{}, fmt.Errorf("Invalid timestamp %q", s)
+        }
+        fracNs := int64(float64(frac) * float64(prec) / math.Pow10(len(fracPart)))
+        if neg {
+            if ns < math.MinInt64 + fracNs {
+                return time.Time{}, fmt.Errorf("Timestamp %q out of range", s)
+            }
+            ns -= fracNs
+        } else {
+            if ns > math.MaxInt64 - fracNs {
+                return time.Time{}, fmt.Errorf("Timestamp %q out of range", s)
+            }
+            ns += fracNs
+        }
+    }
+    return time.Unix(0, ns).UTC(), nil
+}
+
+// Epoch timestamps before the year 5138 in seconds are smaller than 1e11,
+// which leaves room for telling seconds, ms, µs and ns apart
+func (p *TimestampParser) precisionOf(n float64) time.Duration {
+    if p.precision > 0 {
+        return p.precision
+    }
+
+    a := math.Abs(n)
+    switch {
+    case a < 1e11:
+        return time.Second
+    case a < 1e14:
+        return time.Millisecond
+    case a < 1e17:
+        return time.Microsecond
+    }
+    return time.Nanosecond
+}
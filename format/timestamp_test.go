@@ -0,0 +1,149 @@
+package format
+
+import (
+    "testing"
+    "time"
+    "encoding/json"
+)
+
+func TestTimestampParserEpoch(t *testing.T) {
+    auto, err := NewTimestampParser(TIMESTAMP_FORMAT_AUTO, "", TIMESTAMP_FALLBACK_NONE)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ms, err := NewTimestampParser("ms", "", TIMESTAMP_FALLBACK_NONE)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name    string
+        parser  *TimestampParser
+        value   interface{}
+        want    time.Time
+        err     bool
+    }{
+        {"seconds", auto, json.Number("1600000000"), time.Unix(1600000000, 0), false},
+        {"fractional seconds", auto, json.Number("1600000000.123456789"), time.Unix(1600000000, 123456789), false},
+        {"milliseconds", auto, json.Number("1600000000123"), time.Unix(1600000000, 123000000), false},
+        {"microseconds", auto, json.Number("1600000000123456"), time.Unix(1600000000, 123456000), false},
+        {"nanoseconds", auto, json.Number("1600000000123456789"), time.Unix(1600000000, 123456789), false},
+        {"negative", auto, json.Number("-1.5"), time.Unix(0, -1500000000), false},
+        {"negative below one", auto, json.Number("-0.5"), time.Unix(0, -500000000), false},
+        {"fixed precision", ms, json.Number("1000"), time.Unix(1, 0), false},
+        {"int64", ms, int64(1500), time.Unix(1, 500000000), false},
+        {"float64", auto, float64(1.25), time.Unix(1, 250000000), false},
+        {"numeric string", auto, "1600000000", time.Unix(1600000000, 0), false},
+        {"rfc3339 string", auto, "2020-09-13T12:26:40.5Z", time.Unix(1600000000, 500000000), false},
+        {"exponent", auto, json.Number("1.6e9"), time.Unix(1600000000, 0), false},
+        {"overflow", ms, json.Number("9223372036854775807"), time.Time{}, true},
+        {"negative overflow", ms, json.Number("-9223372036854775807"), time.Time{}, true},
+        {"fraction overflow", auto, json.Number("9223372036.9"), time.Time{}, true},
+        {"float overflow", auto, json.Number("1e30"), time.Time{}, true},
+        {"garbage", auto, "yesterday", time.Time{}, true},
+        {"unsupported type", auto, true, time.Time{}, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := tt.parser.Parse(tt.value, &Message{})
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("expected an error, got %v", got)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !got.Equal(tt.want) {
+                t.Errorf("got %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestTimestampParserLayout(t *testing.T) {
+    tests := []struct {
+        name    string
+        layout  string
+        value   interface{}
+        want    time.Time
+        err     bool
+    }{
+        {"layout", "2006-01-02 15:04:05", "2020-09-13 12:26:40", time.Unix(1600000000, 0), false},
+        {"epoch string", "2006-01-02 15:04:05", "1600000000", time.Unix(1600000000, 0), false},
+        {"numeric layout", "20060102150405", "20200913122640", time.Unix(1600000000, 0), false},
+        {"epoch string with numeric layout", "20060102150405", "1600000000", time.Unix(1600000000, 0), false},
+        {"number with numeric layout", "20060102150405", json.Number("1600000000"), time.Unix(1600000000, 0), false},
+        {"no match", "2006-01-02 15:04:05", "yesterday", time.Time{}, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            p, err := NewTimestampParser(tt.layout, "", TIMESTAMP_FALLBACK_NONE)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            got, err := p.Parse(tt.value, &Message{})
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("expected an error, got %v", got)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !got.Equal(tt.want) {
+                t.Errorf("got %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestTimestampParserFallback(t *testing.T) {
+    kafka := time.Unix(1600000000, 0)
+
+    tests := []struct {
+        name      string
+        fallback  string
+        value     interface{}
+        msg       Message
+        want      time.Time
+        err       bool
+    }{
+        {"missing with fallback", TIMESTAMP_FALLBACK_KAFKA, nil, Message{Timestamp: kafka}, kafka, false},
+        {"invalid with fallback", TIMESTAMP_FALLBACK_KAFKA, "never", Message{Timestamp: kafka}, kafka, false},
+        {"no kafka timestamp", TIMESTAMP_FALLBACK_KAFKA, nil, Message{}, time.Time{}, true},
+        {"missing without fallback", TIMESTAMP_FALLBACK_NONE, nil, Message{Timestamp: kafka}, time.Time{}, true},
+        {"valid ignores fallback", TIMESTAMP_FALLBACK_KAFKA, int64(1), Message{Timestamp: kafka}, time.Unix(1, 0), false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            p, err := NewTimestampParser(TIMESTAMP_FORMAT_AUTO, "", tt.fallback)
+            if err != nil {
+                t.Fatal(err)
+            }
+            got, err := p.Parse(tt.value, &tt.msg)
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("expected an error, got %v", got)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !got.Equal(tt.want) {
+                t.Errorf("got %v, want %v", got, tt.want)
+            }
+        })
+    }
+
+    if _, err := NewTimestampParser(TIMESTAMP_FORMAT_AUTO, "", "later"); err == nil {
+        t.Error("expected an error for an unknown fallback")
+    }
+}
@@ -0,0 +1,117 @@
+package format
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "encoding/json"
+)
+
+// Prometheus marks a series as stale by writing a NaN with this bit
+// pattern. Formats that carry raw floats pass it through as is, text
+// formats such as the JSON of prometheus-kafka-adapter turn it into an
+// ordinary NaN.
+const StaleNaN uint64 = 0x7ff0000000000002
+
+func IsStaleNaN(v float64) bool {
+    return math.Float64bits(v) == StaleNaN
+}
+
+// Parses a sample value. Numbers are decoded from their textual form
+// straight into a float64, which is what the value columns hold, so
+// integers above 2^53 are rounded to the nearest float. Strings may hold
+// a number or one of the special values NaN, +Inf, -Inf and Infinity in
+// any case.
+func ParseValue(v interface{}) (float64, error) {
+    switch t := v.(type) {
+    case nil:
+        return 0, fmt.Errorf("Missing value")
+    case json.Number:
+        return strconv.ParseFloat(t.String(), 64)
+    case float64:
+        return t, nil
+    case string:
+        s := strings.TrimSpace(t)
+        switch strings.ToLower(s) {
+        case "nan":
+            return math.NaN(), nil
+        case "inf", "+inf", "infinity", "+infinity":
+            return math.Inf(1), nil
+        case "-inf", "-infinity":
+            return math.Inf(-1), nil
+        }
+        return strconv.ParseFloat(s, 64)
+    }
+    return 0, fmt.Errorf("Unsupported value %v", v)
+}
+
+// Formats a value the way PostgreSQL reads double precision numbers,
+// without an exponent so no digits are lost on the way
+func FormatValue(v float64) string {
+    switch {
+    case math.IsNaN(v):
+        return "NaN"
+    case math.IsInf(v, 1):
+        return "Infinity"
+    case math.IsInf(v, -1):
+        return "-Infinity"
+    }
+    return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+const (
+    VALUE_POLICY_KEEP = "keep"
+    VALUE_POLICY_DROP = "drop"
+    VALUE_POLICY_NAN  = "nan"
+)
+
+// ValuePolicy decides what happens to samples with special values.
+// NaN and ±Inf samples are kept or dropped, staleness markers are kept,
+// dropped or converted to an ordinary NaN.
+type ValuePolicy struct {
+    nan    string
+    inf    string
+    stale  string
+}
+
+func NewValuePolicy(nan string, inf string, stale string) (*ValuePolicy, error) {
+    for _, p := range []string{nan, inf} {
+        if p != VALUE_POLICY_KEEP && p != VALUE_POLICY_DROP {
+            return nil, fmt.Errorf("Unknown value policy %q", p)
+        }
+    }
+    if stale != VALUE_POLICY_KEEP && stale != VALUE_POLICY_DROP && stale != VALUE_POLICY_NAN {
+        return nil, fmt.Errorf("Unknown staleness marker policy %q", stale)
+    }
+    return &ValuePolicy{nan: nan, inf: inf, stale: stale}, nil
+}
+
+// Returns false if the sample should be dropped. Staleness markers
+// converted to NaN are subject to the NaN policy afterwards.
+func (p *ValuePolicy) Apply(s *Sample) bool {
+    if IsStaleNaN(s.Value) {
+        switch p.stale {
+        case VALUE_POLICY_KEEP:
+            return true
+        case VALUE_POLICY_DROP:
+            droppedMetrics.WithLabelValues("stale").Inc()
+            return false
+        }
+        s.Value = math.NaN()
+    }
+
+    switch {
+    case math.IsNaN(s.Value):
+        if p.nan == VALUE_POLICY_DROP {
+            droppedMetrics.WithLabelValues("nan").Inc()
+            return false
+        }
+    case math.IsInf(s.Value, 0):
+        if p.inf == VALUE_POLICY_DROP {
+            droppedMetrics.WithLabelValues("inf").Inc()
+            return false
+        }
+    }
+    return true
+}
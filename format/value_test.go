@@ -0,0 +1,119 @@
+package format
+
+import (
+    "math"
+    "testing"
+    "encoding/json"
+)
+
+func TestParseValue(t *testing.T) {
+    tests := []struct {
+        name   string
+        value  interface{}
+        want   float64
+        err    bool
+    }{
+        {"number", json.Number("1.5"), 1.5, false},
+        {"exact number", json.Number("0.1"), 0.1, false},
+        {"large integer", json.Number("9007199254740993"), 9007199254740993, false},
+        {"float64", float64(2), 2, false},
+        {"string", " 3.25 ", 3.25, false},
+        {"exponent", "1e3", 1000, false},
+        {"NaN", "NaN", math.NaN(), false},
+        {"+Inf", "+Inf", math.Inf(1), false},
+        {"Infinity", "infinity", math.Inf(1), false},
+        {"-Inf", "-Inf", math.Inf(-1), false},
+        {"missing", nil, 0, true},
+        {"text", "high", 0, true},
+        {"bool", true, 0, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := ParseValue(tt.value)
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("expected an error, got %v", got)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if got != tt.want && !(math.IsNaN(got) && math.IsNaN(tt.want)) {
+                t.Errorf("got %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestFormatValue(t *testing.T) {
+    tests := []struct {
+        value  float64
+        want   string
+    }{
+        {1.5, "1.5"},
+        {1e21, "1000000000000000000000"},
+        {0.000001, "0.000001"},
+        {-2, "-2"},
+        {math.NaN(), "NaN"},
+        {math.Inf(1), "Infinity"},
+        {math.Inf(-1), "-Infinity"},
+    }
+    for _, tt := range tests {
+        if got := FormatValue(tt.value); got != tt.want {
+            t.Errorf("FormatValue(%v) = %s, want %s", tt.value, got, tt.want)
+        }
+    }
+}
+
+func TestValuePolicy(t *testing.T) {
+    stale := math.Float64frombits(StaleNaN)
+
+    tests := []struct {
+        name       string
+        nan        string
+        inf        string
+        stale      string
+        value      float64
+        keep       bool
+        staleNaN   bool
+    }{
+        {"number", VALUE_POLICY_DROP, VALUE_POLICY_DROP, VALUE_POLICY_DROP, 1, true, false},
+        {"keep NaN", VALUE_POLICY_KEEP, VALUE_POLICY_KEEP, VALUE_POLICY_KEEP, math.NaN(), true, false},
+        {"drop NaN", VALUE_POLICY_DROP, VALUE_POLICY_KEEP, VALUE_POLICY_KEEP, math.NaN(), false, false},
+        {"drop Inf", VALUE_POLICY_KEEP, VALUE_POLICY_DROP, VALUE_POLICY_KEEP, math.Inf(-1), false, false},
+        {"keep stale", VALUE_POLICY_DROP, VALUE_POLICY_KEEP, VALUE_POLICY_KEEP, stale, true, true},
+        {"drop stale", VALUE_POLICY_KEEP, VALUE_POLICY_KEEP, VALUE_POLICY_DROP, stale, false, true},
+        {"stale to NaN", VALUE_POLICY_KEEP, VALUE_POLICY_KEEP, VALUE_POLICY_NAN, stale, true, false},
+        {"stale to dropped NaN", VALUE_POLICY_DROP, VALUE_POLICY_KEEP, VALUE_POLICY_NAN, stale, false, false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            p, err := NewValuePolicy(tt.nan, tt.inf, tt.stale)
+            if err != nil {
+                t.Fatal(err)
+            }
+            s := &Sample{Name: "up", Value: tt.value}
+            if keep := p.Apply(s); keep != tt.keep {
+                t.Errorf("got %v, want %v", keep, tt.keep)
+            }
+            if IsStaleNaN(s.Value) != tt.staleNaN {
+                t.Errorf("staleness marker is %v, want %v", IsStaleNaN(s.Value), tt.staleNaN)
+            }
+        })
+    }
+}
+
+func TestNewValuePolicyInvalid(t *testing.T) {
+    for _, p := range [][3]string{
+        {"skip", VALUE_POLICY_KEEP, VALUE_POLICY_KEEP},
+        {VALUE_POLICY_KEEP, VALUE_POLICY_NAN, VALUE_POLICY_KEEP},
+        {VALUE_POLICY_KEEP, VALUE_POLICY_KEEP, "zero"},
+    } {
+        if _, err := NewValuePolicy(p[0], p[1], p[2]); err == nil {
+            t.Errorf("expected an error for %v", p)
+        }
+    }
+}
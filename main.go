@@ -6,12 +6,14 @@ import (
     "time"
     "os/signal"
     "syscall"
+    "strings"
     "runtime"
     "net/http"
 
     "github.com/confluentinc/confluent-kafka-go/kafka"
 
     "github.com/arslanm/kafka-timescaledb-adapter/db"
+    "github.com/arslanm/kafka-timescaledb-adapter/format"
     "github.com/arslanm/kafka-timescaledb-adapter/kafka"
     "github.com/arslanm/kafka-timescaledb-adapter/log"
     "github.com/arslanm/kafka-timescaledb-adapter/util"
@@ -19,6 +21,19 @@ import (
     "github.com/prometheus/client_golang/prometheus"
 )
 
+// Copies what the decoders need from a Kafka message. Header names are
+// lower-cased so they can be looked up regardless of the producer.
+func newMessage(ev *kafka.Message) format.Message {
+    msg := format.Message{Value: ev.Value, Timestamp: ev.Timestamp}
+    if len(ev.Headers) > 0 {
+        msg.Headers = make(map[string]string, len(ev.Headers))
+        for _, h := range ev.Headers {
+            msg.Headers[strings.ToLower(h.Key)] = string(h.Value)
+        }
+    }
+    return msg
+}
+
 func main() {
     cfg := GetConfig()
 
@@ -27,15 +42,21 @@ func main() {
     log.Init(cfg.logLevel)
     log.Debug("config", fmt.Sprintf("%+v",cfg))
 
+    if len(os.Args) > 1 && os.Args[1] == "migrate" {
+        os.Exit(migrate(cfg, os.Args[2:]))
+    }
+
     whiteList := util.LoadWhitelist(cfg.whitelistFile)
 
-    db := pgdb.NewClient(&cfg.pgDBConfig, whiteList)
+    decoder := format.NewDecoder(&cfg.formatConfig)
+
+    db := pgdb.NewFanout(&cfg.pgDBConfig, whiteList, decoder)
     defer db.Close()
 
     consumer := pgkafka.NewConsumer(&cfg.pgKafkaConfig)
     defer consumer.Close()
 
-    Foreman(db.Write, cfg.writeTimeout, cfg.writeRetry, numCPU)
+    Foreman(db.Write, db.Decode, numCPU)
 
     http.Handle(cfg.telemetryPath, prometheus.Handler())
     go func() {
@@ -47,10 +68,14 @@ func main() {
         log.Info("msg", fmt.Sprintf("Listening on %d for telemetry", cfg.listenAddr))
     }()
 
+    // Samples aggregated by the decoder, e.g. from StatsD, are written
+    // like any other batch once they are flushed
+    flusher := decoder.(format.Flusher)
+
     sigchan := make(chan os.Signal, 1)
     signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
 
-    req := WorkRequest{Metrics: make([]string, 0), NumMetrics: 0}
+    req := WorkRequest{Metrics: make([]format.Message, 0), NumMetrics: 0}
 
     run := true
     for run == true {
@@ -58,6 +83,9 @@ func main() {
         case sig := <-sigchan:
             log.Info("msg", fmt.Sprintf("Received signal %v: terminating", sig))
             run = false
+        case samples := <- flusher.Flushed():
+            WorkQueue <- WorkRequest{Metrics: []format.Message{{Samples: samples}}, NumMetrics: len(samples)}
+            <- CanSendMore
         case e := <- consumer.Events():
             switch ev := e.(type) {
             case kafka.AssignedPartitions:
@@ -67,11 +95,11 @@ func main() {
                 log.Info("msg", "Unassigning partition")
                 consumer.Unassign()
             case *kafka.Message:
-                req.Metrics = append(req.Metrics, string(ev.Value))
+                req.Metrics = append(req.Metrics, newMessage(ev))
                 req.NumMetrics += 1
                 if req.NumMetrics == cfg.batchSize {
                     WorkQueue <- req
-                    req = WorkRequest{Metrics: make([]string, 0), NumMetrics: 0}
+                    req = WorkRequest{Metrics: make([]format.Message, 0), NumMetrics: 0}
                     <- CanSendMore
                 }
             case kafka.PartitionEOF:
@@ -80,6 +108,12 @@ func main() {
         }
     }
 
+    // Stops the flushes and writes what was aggregated since the last one
+    if samples := flusher.Close(); len(samples) > 0 {
+        WorkQueue <- WorkRequest{Metrics: []format.Message{{Samples: samples}}, NumMetrics: len(samples)}
+        <- CanSendMore
+    }
+
     if req.NumMetrics > 0 {
         WorkQueue <- req
         time.Sleep(100 * time.Millisecond)
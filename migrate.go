@@ -0,0 +1,41 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "text/tabwriter"
+
+    "github.com/arslanm/kafka-timescaledb-adapter/db"
+    "github.com/arslanm/kafka-timescaledb-adapter/log"
+)
+
+// Shows the schema migrations of each target with "status", the default,
+// and applies the pending ones with "up". Returns the exit code.
+func migrate(cfg *Config, args []string) int {
+    action := "status"
+    if len(args) > 0 {
+        action = args[0]
+    }
+    if action != "status" && action != "up" {
+        fmt.Fprintf(os.Stderr, "Usage: %s migrate [status|up]\n", os.Args[0])
+        return 2
+    }
+
+    statuses, err := pgdb.Migrate(&cfg.pgDBConfig, action == "up")
+    if err != nil {
+        log.Error("msg", "Migration failed", "error", err)
+        return 1
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+    fmt.Fprintln(w, "TARGET\tTABLE\tVERSION\tDESCRIPTION\tAPPLIED")
+    for _, s := range statuses {
+        applied := "pending"
+        if s.Applied {
+            applied = s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+        }
+        fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", s.Target, s.Table, s.Version, s.Description, applied)
+    }
+    w.Flush()
+    return 0
+}